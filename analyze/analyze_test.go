@@ -0,0 +1,150 @@
+package analyze
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+)
+
+func TestRisk(t *testing.T) {
+	now := time.Now()
+	curve := func(vals ...float64) []Point {
+		var out []Point
+		for i, v := range vals {
+			out = append(out, Point{Time: now.Add(time.Duration(i) * time.Hour), Value: v})
+		}
+		return out
+	}
+	tests := []struct {
+		name     string
+		points   []Point
+		ret      float64
+		drawdown float64
+	}{
+		{"up only", curve(100, 110, 121), 0.21, 0},
+		{"worst fall from the peak", curve(100, 120, 90, 130, 117), 0.17, 0.25},
+		{"empty", nil, 0, 0},
+	}
+	for _, tt := range tests {
+		if r := TotalReturn(tt.points); math.Abs(r-tt.ret) > 1e-9 {
+			t.Errorf("%s: expected a return of %v, got %v", tt.name, tt.ret, r)
+		}
+		if dd := MaxDrawdown(tt.points); math.Abs(dd-tt.drawdown) > 1e-9 {
+			t.Errorf("%s: expected a drawdown of %v, got %v", tt.name, tt.drawdown, dd)
+		}
+	}
+	// steady gains have no deviation to measure risk by
+	if s := Sharpe(Returns(curve(100, 110, 121)), 365); s != 0 {
+		t.Error("expected no sharpe ratio, got", s)
+	}
+	rets := Returns(curve(100, 120, 90, 130, 117))
+	if Sharpe(rets, 1) <= 0 || Sortino(rets, 1) <= Sharpe(rets, 1) {
+		t.Error("expected a positive sortino above the sharpe ratio", Sharpe(rets, 1), Sortino(rets, 1))
+	}
+	if r := ReturnOver(curve(100, 120, 90, 130, 117), time.Hour*2); math.Abs(r-0.3) > 1e-9 {
+		t.Error("expected a return of 30% over the last two hours, got", r)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	now := time.Now()
+	ago := func(days float64) time.Time {
+		return now.Add(-time.Duration(days * float64(time.Hour*24)))
+	}
+	m := arango.NewMem()
+	stamps := []arango.Stamp{
+		{Symbol: "USDC", Price: 1, Time: ago(10)},
+		{Symbol: "ETH", Price: 100, Time: ago(10)},
+		{Symbol: "ETH", Price: 150, Time: ago(5)},
+		{Symbol: "USDC", Price: 1, Time: ago(0.01)},
+		{Symbol: "ETH", Price: 120, Time: ago(0.01)},
+	}
+	for _, s := range stamps {
+		s.Cap = 1
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// what folio.Record saves every tick
+	type valued struct {
+		User  string    `json:"user"`
+		Time  time.Time `json:"time"`
+		Total float64   `json:"total"`
+	}
+	docs := []struct {
+		col string
+		doc interface{}
+	}{
+		{"balances", arango.Balance{User: "zkFART", Balances: map[string]float64{"USDC": 1000}, Timestamp: ago(10)}},
+		// buy 10 eth at 100 and sell half of it at 150
+		{"trades", trade.Limit{User: "zkFART", Sell: "USDC", Buy: "ETH", SellAmount: 1000, BuyAmount: 10, Value: 1000, ExecTime: ago(9)}},
+		{"balances", arango.Balance{User: "zkFART", Balances: map[string]float64{"ETH": 10}, Timestamp: ago(9)}},
+		{"trades", trade.Limit{User: "zkFART", Sell: "ETH", Buy: "USDC", SellAmount: 5, BuyAmount: 750, ExecTime: ago(4)}},
+		{"balances", arango.Balance{User: "zkFART", Balances: map[string]float64{"ETH": 5, "USDC": 750}, Timestamp: ago(4)}},
+		// a position held for a day that lost 20
+		{"positions", trade.Position{Limit: trade.Limit{Key: "1", User: "zkFART", Sell: "USDC", Buy: "ETH", Collat: "USDC", CollAmount: 100}, Start: ago(3), End: ago(2)}},
+		{"post_events", trade.PosEvent{Position: "1", Kind: trade.EventOpen, Amount: 100, CollPrice: 1, Time: ago(3)}},
+		{"post_events", trade.PosEvent{Position: "1", Kind: trade.EventClose, Amount: -80, CollPrice: 1, Time: ago(2)}},
+		// the portfolio followed eth up to 1500 and back down to 1350
+		{"valuations", valued{User: "zkFART", Time: ago(10), Total: 1000}},
+		{"valuations", valued{User: "zkFART", Time: ago(9), Total: 1000}},
+		{"valuations", valued{User: "zkFART", Time: ago(5), Total: 1500}},
+		{"valuations", valued{User: "zkFART", Time: ago(4), Total: 1500}},
+		{"valuations", valued{User: "zkFART", Time: ago(0.01), Total: 1350}},
+	}
+	for _, d := range docs {
+		err := m.CreateDoc(d.col, d.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := Analyze(m, arango.NewSnapshot(m), "zkFART", 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(st.Realized-230) > 1e-9 || math.Abs(st.Unrealized-100) > 1e-9 {
+		t.Errorf("expected 230 realized and 100 unrealized, got %v and %v", st.Realized, st.Unrealized)
+	}
+	if st.Wins != 1 || st.Losses != 1 || st.Closed != 1 || st.AvgHold() != time.Hour*24 {
+		t.Errorf("unexpected win rate or hold time %+v", st.PnL)
+	}
+	if math.Abs(st.Worth-1350) > 1e-9 || math.Abs(st.Return-0.35) > 1e-9 {
+		t.Errorf("expected a worth of 1350 and a 35%% return, got %v and %v", st.Worth, st.Return)
+	}
+	if st.MaxDrawdown <= 0 {
+		t.Error("expected the fall from 150 to 120 to be a drawdown")
+	}
+	if !strings.Contains(st.Render(), "+35.00%") {
+		t.Error("expected the return to be rendered", st.Render())
+	}
+
+	// only what was realized in the window counts
+	recent, err := Analyze(m, arango.NewSnapshot(m), "zkFART", time.Hour*84, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(recent.Realized+20) > 1e-9 || recent.Wins != 0 || recent.Losses != 1 {
+		t.Errorf("expected only the position's loss, got %+v", recent.PnL)
+	}
+
+	other := &Stats{User: "degen", Return: 0.5, MaxDrawdown: 0.4}
+	ranked := []*Stats{st, other}
+	err = Rank(ranked, "return")
+	if err != nil || ranked[0] != other {
+		t.Error("expected degen to have the best return", err)
+	}
+	best, err := Best(ranked, "drawdown")
+	if err != nil || best != st {
+		t.Error("expected zkFART to have the smallest drawdown", err)
+	}
+	err = Rank(ranked, "luck")
+	if err == nil {
+		t.Error("expected an unknown metric to fail")
+	}
+}
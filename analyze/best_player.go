@@ -1 +1,148 @@
-package award
+// Package analyze replays each user's trades, positions and their recorded
+// values to work out how well they trade, so that players can be compared.
+package analyze
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/pkg/errors"
+)
+
+// Stats summarize how well a user traded over a window of time
+type Stats struct {
+	User string
+	// Start and End are the window the stats cover
+	Start time.Time
+	End   time.Time
+	// Worth is what the user currently owns in USD
+	Worth float64
+	PnL
+	// Return is the change in worth over the window
+	Return      float64
+	Sharpe      float64
+	Sortino     float64
+	MaxDrawdown float64
+	// Equity is the user's worth sampled over the window
+	Equity []Point
+}
+
+// Analyze computes the stats of user over the window ending at now. A zero
+// window covers all of their history.
+func Analyze(sesh arango.Store, prices arango.PriceOracle, user string, window time.Duration, now time.Time) (*Stats, error) {
+	const errMsg = "failure to analyze user"
+	h, err := load(sesh, user)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	start := now.Add(-window)
+	if window <= 0 {
+		start = h.first()
+		if start.IsZero() || !now.After(start) {
+			start = now.Add(-minStep)
+		}
+	}
+	out := &Stats{User: user, Start: start, End: now}
+	out.PnL, err = h.pnl(sesh, prices, start)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	step := Step(now.Sub(start))
+	out.Equity, err = h.equity(sesh, prices, start, now, step)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	if n := len(out.Equity); n > 0 {
+		out.Worth = out.Equity[n-1].Value
+	}
+	rets := Returns(out.Equity)
+	out.Return = TotalReturn(out.Equity)
+	out.Sharpe = Sharpe(rets, periodsPerYear(step))
+	out.Sortino = Sortino(rets, periodsPerYear(step))
+	out.MaxDrawdown = MaxDrawdown(out.Equity)
+	return out, nil
+}
+
+// Metrics are what players can be ranked by
+var Metrics = []string{"return", "pnl", "sharpe", "sortino", "drawdown", "winrate"}
+
+// Metric returns the value of the named metric, where higher is always better,
+// so drawdowns are negative
+func (s *Stats) Metric(name string) (float64, error) {
+	switch name {
+	case "return":
+		return s.Return, nil
+	case "pnl":
+		return s.Realized + s.Unrealized, nil
+	case "sharpe":
+		return s.Sharpe, nil
+	case "sortino":
+		return s.Sortino, nil
+	case "drawdown":
+		return -s.MaxDrawdown, nil
+	case "winrate":
+		return s.WinRate(), nil
+	}
+	return 0, errors.Errorf("unknown metric %s", name)
+}
+
+// Rank sorts stats by metric, best player first. Ties keep their order.
+func Rank(stats []*Stats, metric string) error {
+	vals := make(map[*Stats]float64, len(stats))
+	for _, s := range stats {
+		v, err := s.Metric(metric)
+		if err != nil {
+			return err
+		}
+		vals[s] = v
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return vals[stats[i]] > vals[stats[j]]
+	})
+	return nil
+}
+
+// Best returns the best player by metric, or nil if there are none
+func Best(stats []*Stats, metric string) (*Stats, error) {
+	if len(stats) == 0 {
+		return nil, nil
+	}
+	ranked := append([]*Stats(nil), stats...)
+	err := Rank(ranked, metric)
+	if err != nil {
+		return nil, err
+	}
+	return ranked[0], nil
+}
+
+// Render returns a formatted string that describes the stats
+func (s *Stats) Render() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "@%s from %s to %s\n", s.User, s.Start.Format("2006-01-02 15:04"), s.End.Format("2006-01-02 15:04"))
+	twr := tabwriter.NewWriter(&buf, 1, 4, 8, ' ', 0)
+	rows := []struct {
+		name, val string
+	}{
+		{"worth", fmt.Sprintf("$%.2f", s.Worth)},
+		{"return", fmt.Sprintf("%+.2f%%", s.Return*100)},
+		{"realized pnl", fmt.Sprintf("$%.2f", s.Realized)},
+		{"unrealized pnl", fmt.Sprintf("$%.2f", s.Unrealized)},
+		{"sharpe", fmt.Sprintf("%.2f", s.Sharpe)},
+		{"sortino", fmt.Sprintf("%.2f", s.Sortino)},
+		{"max drawdown", fmt.Sprintf("%.2f%%", s.MaxDrawdown*100)},
+		{"win rate", fmt.Sprintf("%.1f%% (%d won, %d lost)", s.WinRate()*100, s.Wins, s.Losses)},
+		{"avg hold", fmt.Sprintf("%s over %d closed positions", s.AvgHold().Round(time.Minute), s.Closed)},
+	}
+	for _, r := range rows {
+		fmt.Fprintf(twr, "%s\t%s\n", r.name, r.val)
+	}
+	err := twr.Flush()
+	if err != nil {
+		fmt.Println("failure to render stats", err)
+	}
+	return buf.String()
+}
@@ -0,0 +1,223 @@
+package analyze
+
+import (
+	"sort"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/pkg/errors"
+)
+
+// Point is the worth of a user in USD at a point in time
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// maxPoints is the most points an equity curve is sampled at
+const maxPoints = 100
+
+// minStep matches how often prices are ingested and positions are valued,
+// there is no point in sampling more often
+const minStep = time.Minute * 15
+
+// Step picks how far apart the points of an equity curve over window are
+func Step(window time.Duration) time.Duration {
+	step := window / maxPoints
+	if step < minStep {
+		return minStep
+	}
+	return step
+}
+
+// history is everything a user has done, replayed to compute their stats
+type history struct {
+	user string
+	// balances and trades are oldest first
+	balances  []*arango.Balance
+	trades    []*trade.Limit
+	positions []*trade.Position
+	// vals and events of each position, oldest first
+	vals   map[string][]trade.PosVal
+	events map[string][]trade.PosEvent
+}
+
+// load fetches the history of user
+func load(sesh arango.Store, user string) (*history, error) {
+	const errMsg = "failure to load user history"
+	h := &history{
+		user:   user,
+		vals:   make(map[string][]trade.PosVal),
+		events: make(map[string][]trade.PosEvent),
+	}
+	iter, err := sesh.Iter("balances", arango.Match{"user": user})
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	err = arango.ReadAll(iter, &h.balances)
+	iter.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	sort.SliceStable(h.balances, func(i, j int) bool {
+		return h.balances[i].Timestamp.Before(h.balances[j].Timestamp)
+	})
+	iter, err = sesh.Iter("trades", arango.Match{"user": user})
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	err = arango.ReadAll(iter, &h.trades)
+	iter.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	sort.SliceStable(h.trades, func(i, j int) bool {
+		return h.trades[i].ExecTime.Before(h.trades[j].ExecTime)
+	})
+	err = sesh.Find("positions", arango.Match{"user": user}, &h.positions)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	for _, p := range h.positions {
+		iter, err := sesh.Iter("post_val", arango.Match{"position": p.Key})
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		var vals []trade.PosVal
+		err = arango.ReadAll(iter, &vals)
+		iter.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		sort.SliceStable(vals, func(i, j int) bool {
+			return vals[i].Time.Before(vals[j].Time)
+		})
+		h.vals[p.Key] = vals
+		events, err := trade.Events(sesh, p.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Time.Before(events[j].Time)
+		})
+		h.events[p.Key] = events
+	}
+	return h, nil
+}
+
+// first is when the user's history starts, or the zero time if there is none
+func (h *history) first() time.Time {
+	var first time.Time
+	for _, b := range h.balances {
+		if !b.Timestamp.IsZero() && (first.IsZero() || b.Timestamp.Before(first)) {
+			first = b.Timestamp
+		}
+	}
+	for _, p := range h.positions {
+		if !p.Start.IsZero() && (first.IsZero() || p.Start.Before(first)) {
+			first = p.Start
+		}
+	}
+	return first
+}
+
+// valuation is the part of a valuation recorded by folio.Record that the
+// equity curve is built from
+type valuation struct {
+	Time  time.Time `json:"time"`
+	Total float64   `json:"total"`
+}
+
+// lookback is how far before the start of an equity curve a valuation is
+// looked for, as compaction keeps only one valuation a day of old history
+const lookback = time.Hour * 24
+
+// equity samples the worth of the user every step from start, ending with
+// their current worth at end. The worth at each point is the last valuation
+// recorded for the user at or before it. Points before their first valuation
+// are left out.
+func (h *history) equity(sesh arango.Store, prices arango.PriceOracle, start, end time.Time, step time.Duration) ([]Point, error) {
+	const errMsg = "failure to build equity curve"
+	if step <= 0 || !end.After(start) {
+		return nil, errors.Errorf("%s: invalid range", errMsg)
+	}
+	iter, err := sesh.Valuations(h.user, start.Add(-lookback), end)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	var vals []valuation
+	err = arango.ReadAll(iter, &vals)
+	iter.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	n := int(end.Sub(start) / step)
+	var out []Point
+	next := 0
+	var last *valuation
+	for i := 0; i < n; i++ {
+		t := start.Add(time.Duration(i) * step)
+		for next < len(vals) && !vals[next].Time.After(t) {
+			last = &vals[next]
+			next++
+		}
+		if last == nil {
+			continue
+		}
+		out = append(out, Point{Time: t, Value: last.Total})
+	}
+	curr, err := h.worth(prices)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	if len(h.balances) > 0 {
+		out = append(out, Point{Time: end, Value: curr})
+	}
+	return out, nil
+}
+
+// worth is the user's current worth, their latest balance plus their open
+// positions at current prices
+func (h *history) worth(prices arango.PriceOracle) (float64, error) {
+	if len(h.balances) == 0 {
+		return 0, nil
+	}
+	bal := h.balances[len(h.balances)-1]
+	var total float64
+	for asset, amount := range bal.Balances {
+		if amount < 0.0000009 {
+			continue
+		}
+		price, err := prices.Price(asset)
+		if err != nil {
+			return 0, err
+		}
+		total += amount * price
+	}
+	for _, p := range h.positions {
+		if !p.Alive {
+			continue
+		}
+		val, err := p.Value(prices)
+		if err != nil {
+			return 0, err
+		}
+		total += val.Value
+	}
+	return total, nil
+}
+
+// priceAt is the last price of symbol recorded in the day before t, falling
+// back to its current price
+func priceAt(sesh arango.Store, prices arango.PriceOracle, symbol string, t time.Time) (float64, error) {
+	const day = time.Hour * 24
+	candles, err := arango.PriceHistory(sesh, symbol, t.Add(-day), t.Add(time.Second), day+time.Second)
+	if err != nil {
+		return 0, err
+	}
+	if len(candles) > 0 {
+		return candles[len(candles)-1].Close, nil
+	}
+	return prices.Price(symbol)
+}
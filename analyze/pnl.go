@@ -0,0 +1,183 @@
+package analyze
+
+import (
+	"math"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/pkg/errors"
+)
+
+// PnL is the profit and loss of a user in USD. Trades realize gains or losses
+// when they sell an asset bought by an earlier trade, against the average
+// cost of what was bought. Positions realize theirs when they are closed, and
+// open positions count as unrealized until then.
+type PnL struct {
+	Realized   float64
+	Unrealized float64
+	// Wins and Losses count the trades and closed positions that realized a
+	// gain or a loss
+	Wins   int
+	Losses int
+	// Closed counts the closed positions, which were held for Held in total
+	Closed int
+	Held   time.Duration
+}
+
+// lot is the amount of an asset bought by trades, and what it cost in USD
+type lot struct {
+	amount float64
+	cost   float64
+}
+
+// pnl replays the user's trades and positions. Only gains and losses realized
+// since since are counted.
+func (h *history) pnl(sesh arango.Store, prices arango.PriceOracle, since time.Time) (PnL, error) {
+	var out PnL
+	err := h.tradePnL(sesh, prices, since, &out)
+	if err != nil {
+		return out, errors.Wrap(err, "failure to replay trades")
+	}
+	for _, p := range h.positions {
+		err := h.positionPnL(sesh, prices, p, since, &out)
+		if err != nil {
+			return out, errors.Wrapf(err, "failure to replay position %s", p.Key)
+		}
+	}
+	return out, nil
+}
+
+func (h *history) tradePnL(sesh arango.Store, prices arango.PriceOracle, since time.Time, out *PnL) error {
+	lots := make(map[string]*lot)
+	for _, t := range h.trades {
+		if t.SellAmount <= 0 {
+			continue
+		}
+		usd := t.Value
+		// trades from before their value was recorded
+		if usd == 0 {
+			price, err := priceAt(sesh, prices, t.Sell, t.ExecTime)
+			if err != nil {
+				return err
+			}
+			usd = price * t.SellAmount
+		}
+		if l := lots[t.Sell]; l != nil && l.amount > 0 {
+			sold := math.Min(t.SellAmount, l.amount)
+			cost := l.cost * sold / l.amount
+			l.amount -= sold
+			l.cost -= cost
+			if !t.ExecTime.Before(since) {
+				gain := usd*sold/t.SellAmount - cost
+				out.Realized += gain
+				out.count(gain)
+			}
+		}
+		l, has := lots[t.Buy]
+		if !has {
+			l = &lot{}
+			lots[t.Buy] = l
+		}
+		l.amount += t.BuyAmount
+		l.cost += usd
+	}
+	if len(h.balances) == 0 {
+		return nil
+	}
+	// whatever is still held is valued at current prices
+	bal := h.balances[len(h.balances)-1]
+	for asset, l := range lots {
+		held := math.Min(l.amount, bal.Balances[asset])
+		if held <= 0 {
+			continue
+		}
+		price, err := prices.Price(asset)
+		if err != nil {
+			return err
+		}
+		out.Unrealized += held*price - l.cost*held/l.amount
+	}
+	return nil
+}
+
+func (h *history) positionPnL(sesh arango.Store, prices arango.PriceOracle, p *trade.Position, since time.Time, out *PnL) error {
+	var in, paid float64
+	opened, closed := false, false
+	for _, ev := range h.events[p.Key] {
+		price := ev.CollPrice
+		if price == 0 {
+			var err error
+			price, err = priceAt(sesh, prices, p.Collat, ev.Time)
+			if err != nil {
+				return err
+			}
+		}
+		if ev.Amount > 0 {
+			in += ev.Amount * price
+		} else {
+			paid -= ev.Amount * price
+		}
+		switch ev.Kind {
+		case trade.EventOpen:
+			opened = true
+		case trade.EventClose, trade.EventLiquidation:
+			closed = true
+		}
+	}
+	// positions from before they were recorded opening paid their collateral
+	// and fee when they started
+	if !opened {
+		price, err := priceAt(sesh, prices, p.Collat, p.Start)
+		if err != nil {
+			return err
+		}
+		in += (p.CollAmount + p.Fee) * price
+	}
+	if p.Alive {
+		val, err := p.Value(prices)
+		if err != nil {
+			return err
+		}
+		out.Unrealized += val.Value + paid - in
+		return nil
+	}
+	// or closing, in which case they were worth their last value
+	if vals := h.vals[p.Key]; !closed && len(vals) > 0 {
+		paid += vals[len(vals)-1].Value
+	}
+	if p.End.Before(since) {
+		return nil
+	}
+	gain := paid - in
+	out.Realized += gain
+	out.count(gain)
+	out.Closed++
+	out.Held += p.End.Sub(p.Start)
+	return nil
+}
+
+// count records a realized gain as a win or a loss
+func (p *PnL) count(gain float64) {
+	if gain > 0 {
+		p.Wins++
+	} else {
+		p.Losses++
+	}
+}
+
+// WinRate is the fraction of realized gains or losses that were gains
+func (p PnL) WinRate() float64 {
+	if p.Wins+p.Losses == 0 {
+		return 0
+	}
+	return float64(p.Wins) / float64(p.Wins+p.Losses)
+}
+
+// AvgHold is how long closed positions were held on average
+func (p PnL) AvgHold() time.Duration {
+	if p.Closed == 0 {
+		return 0
+	}
+	return p.Held / time.Duration(p.Closed)
+}
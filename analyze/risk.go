@@ -0,0 +1,113 @@
+package analyze
+
+import (
+	"math"
+	"time"
+)
+
+// year is the period returns are annualized over
+const year = time.Hour * 24 * 365
+
+// Returns are the fractional changes between consecutive points. Changes from
+// a worth of zero are left out.
+func Returns(points []Point) []float64 {
+	var out []float64
+	for i := 1; i < len(points); i++ {
+		prev := points[i-1].Value
+		if prev <= 0 {
+			continue
+		}
+		out = append(out, points[i].Value/prev-1)
+	}
+	return out
+}
+
+// TotalReturn is the change in worth from the first point to the last, as a
+// fraction of the first
+func TotalReturn(points []Point) float64 {
+	if len(points) < 2 || points[0].Value <= 0 {
+		return 0
+	}
+	return points[len(points)-1].Value/points[0].Value - 1
+}
+
+// ReturnOver is the change in worth over the window ending at the last point
+func ReturnOver(points []Point, window time.Duration) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+	start := points[len(points)-1].Time.Add(-window)
+	for i, p := range points {
+		if !p.Time.Before(start) {
+			return TotalReturn(points[i:])
+		}
+	}
+	return 0
+}
+
+// Sharpe is the annualized mean of rets over their standard deviation, taking
+// the risk free rate to be zero. There are periods returns in a year.
+func Sharpe(rets []float64, periods float64) float64 {
+	if len(rets) < 2 {
+		return 0
+	}
+	mean := mean(rets)
+	var sq float64
+	for _, r := range rets {
+		sq += (r - mean) * (r - mean)
+	}
+	std := math.Sqrt(sq / float64(len(rets)-1))
+	if std == 0 {
+		return 0
+	}
+	return mean / std * math.Sqrt(periods)
+}
+
+// Sortino is like Sharpe, but only counts the deviation of losing returns
+func Sortino(rets []float64, periods float64) float64 {
+	if len(rets) < 2 {
+		return 0
+	}
+	var sq float64
+	for _, r := range rets {
+		if r < 0 {
+			sq += r * r
+		}
+	}
+	down := math.Sqrt(sq / float64(len(rets)))
+	if down == 0 {
+		return 0
+	}
+	return mean(rets) / down * math.Sqrt(periods)
+}
+
+// MaxDrawdown is the largest fall in worth from a peak, as a fraction of the
+// peak
+func MaxDrawdown(points []Point) float64 {
+	var peak, worst float64
+	for _, p := range points {
+		if p.Value > peak {
+			peak = p.Value
+		}
+		if peak <= 0 {
+			continue
+		}
+		if dd := (peak - p.Value) / peak; dd > worst {
+			worst = dd
+		}
+	}
+	return worst
+}
+
+// periodsPerYear is how many steps fit in a year
+func periodsPerYear(step time.Duration) float64 {
+	return float64(year) / float64(step)
+}
+
+func mean(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
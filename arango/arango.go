@@ -2,11 +2,11 @@ package arango
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
+	"log"
 
 	driver "github.com/arangodb/go-driver"
 	"github.com/arangodb/go-driver/http"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 )
 
@@ -16,15 +16,17 @@ type Sesh struct {
 	client      driver.Client
 	Collections map[string]driver.Collection
 	Ctx         context.Context
+	// tid is set when the Sesh is bound to a stream transaction
+	tid driver.TransactionID
 }
 
-// NewSesh establishes a connection to an arangodb instance
-func NewSesh(ctx context.Context, db string) (*Sesh, error) {
-	client, err := Connect("http://192.168.0.33:8529")
+// NewSesh establishes a connection to the arangodb instance described by cfg
+func NewSesh(ctx context.Context, cfg *config.Config) (*Sesh, error) {
+	client, err := Connect(cfg)
 	if err != nil {
 		return nil, err
 	}
-	database, err := client.Database(ctx, db)
+	database, err := client.Database(ctx, cfg.Database)
 	if err != nil {
 		return nil, err
 	}
@@ -35,9 +37,11 @@ func NewSesh(ctx context.Context, db string) (*Sesh, error) {
 	}, nil
 }
 
-// Execute completes a query and scans the result(s) into data
-func (s *Sesh) Execute(query string, data interface{}) error {
-	cursor, err := s.db.Query(s.Ctx, query, nil)
+// Execute completes a query and scans the result(s) into data. Any value that
+// comes from a user must be passed in bindVars and referenced in the query as
+// @name (or @@name for a collection), never formatted into the query itself.
+func (s *Sesh) Execute(query string, bindVars map[string]interface{}, data interface{}) error {
+	cursor, err := s.db.Query(s.Ctx, query, bindVars)
 	if err != nil {
 		return errors.Wrap(err, "Issue with query:")
 	}
@@ -52,6 +56,40 @@ func (s *Sesh) Execute(query string, data interface{}) error {
 	return nil
 }
 
+// Atomic runs fn inside of a stream transaction that can write to the
+// collections in write. Everything fn does through tx is committed if fn
+// returns nil, and aborted otherwise. Calling Atomic on a tx joins the
+// transaction that is already running.
+func (s *Sesh) Atomic(write []string, fn func(tx Store) error) error {
+	if s.tid != "" {
+		return fn(s)
+	}
+	tid, err := s.db.BeginTransaction(
+		s.Ctx,
+		driver.TransactionCollections{Write: write},
+		&driver.BeginTransactionOptions{AllowImplicit: true},
+	)
+	if err != nil {
+		return errors.Wrap(err, "failure to begin transaction")
+	}
+	tx := *s
+	tx.tid = tid
+	tx.Ctx = driver.WithTransactionID(s.Ctx, tid)
+	err = fn(&tx)
+	if err != nil {
+		abortErr := s.db.AbortTransaction(s.Ctx, tid, nil)
+		if abortErr != nil {
+			log.Println("failure to abort transaction", tid, abortErr)
+		}
+		return err
+	}
+	err = s.db.CommitTransaction(s.Ctx, tid, nil)
+	if err != nil {
+		return errors.Wrap(err, "failure to commit transaction")
+	}
+	return nil
+}
+
 // CreateDoc wraps the arango driver's collection CreateDoc method, supplementing
 // with the Sesh's own context
 func (s *Sesh) CreateDoc(col string, data interface{}) (err error) {
@@ -63,6 +101,21 @@ func (s *Sesh) CreateDoc(col string, data interface{}) (err error) {
 	return err
 }
 
+// CreateDocs wraps the arango driver's collection CreateDocuments method,
+// inserting every element of the slice data in one request
+func (s *Sesh) CreateDocs(col string, data interface{}) error {
+	collection, err := s.GetCol(col)
+	if err != nil {
+		return err
+	}
+	_, errs, err := collection.CreateDocuments(s.Ctx, data)
+	if err != nil {
+		return err
+	}
+	return errs.FirstNonNil()
+}
+
+// Update wraps the arango driver's collection UpdateDocument method
 func (s *Sesh) Update(col string, key string, data interface{}) (err error) {
 	collection, err := s.GetCol(col)
 	if err != nil {
@@ -72,6 +125,7 @@ func (s *Sesh) Update(col string, key string, data interface{}) (err error) {
 	return err
 }
 
+// RemoveDoc wraps the arango driver's collection RemoveDocument method
 func (s *Sesh) RemoveDoc(col string, key string) (err error) {
 	collection, err := s.GetCol(col)
 	if err != nil {
@@ -90,15 +144,15 @@ func (s *Sesh) GetCol(colName string) (driver.Collection, error) {
 	return col, nil
 }
 
-// Connect to an arangodb instance using Client
-func Connect(host string) (driver.Client, error) {
-	crds, err := creds()
+// Connect to the arangodb endpoints in cfg using its credentials
+func Connect(cfg *config.Config) (driver.Client, error) {
+	err := cfg.CheckArango()
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "failure to connect to arangodb")
 	}
 	conn, err := http.NewConnection(
 		http.ConnectionConfig{
-			Endpoints: []string{host},
+			Endpoints: cfg.Endpoints,
 		},
 	)
 	if err != nil {
@@ -106,7 +160,7 @@ func Connect(host string) (driver.Client, error) {
 	}
 	c, err := driver.NewClient(driver.ClientConfig{
 		Connection:     conn,
-		Authentication: driver.BasicAuthentication(crds.ArangoUser, crds.ArangoPass),
+		Authentication: driver.BasicAuthentication(cfg.ArangoUser, cfg.ArangoPass),
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "::Retry:: ::WriteLocal:: could not connect to arangodb")
@@ -127,26 +181,6 @@ func GetCol(ctx context.Context, client driver.Client, dbName, colName string) (
 	return db, col, nil
 }
 
-type cred struct {
-	ArangoPass string `json:"ARANGO_PASS"`
-	ArangoUser string `json:"ARANGO_USER"`
-	CMCSecret  string `json:"CMC_API_KEY"`
-}
-
-// open creds file
-func creds() (*cred, error) {
-	var out cred
-	jsonFile, err := ioutil.ReadFile("/home/evan/.creds/arango-cmc.json")
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(jsonFile, &out)
-	if err != nil {
-		return nil, err
-	}
-	return &out, nil
-}
-
 // // Writer manages a connection to an arangodb instance, and writes
 // // everything put into chan
 // type Writer struct {
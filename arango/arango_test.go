@@ -3,21 +3,31 @@ package arango
 import (
 	"context"
 	"testing"
+
+	"github.com/evan-forbes/chip/config"
 )
 
 func TestConnect(t *testing.T) {
-	_, err := Connect("192.168.0.33")
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Connect(cfg)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestGetCol(t *testing.T) {
-	client, err := Connect("http://192.168.0.33:8529")
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Connect(cfg)
 	if err != nil {
 		t.Error(err)
 	}
-	_, _, err = GetCol(context.Background(), client, "cookie", "stamps")
+	_, _, err = GetCol(context.Background(), client, cfg.Database, "stamps")
 	if err != nil {
 		t.Error(err)
 	}
@@ -25,11 +35,11 @@ func TestGetCol(t *testing.T) {
 
 func TestFieldFilter(t *testing.T) {
 	retVal := `{"symbol": stamp.symbol, "time": stamp.time, "cap": stamp.market_cap}`
-	result, err := FieldFilter("symbol", "||", retVal, "ETH", "BTC", "LTC")
+	result, bindVars, err := FieldFilter("symbol", "||", retVal, "ETH", "BTC", "LTC")
 	if err != nil {
 		t.Error(err)
 	}
-	t.Log(result)
+	t.Log(result, bindVars)
 }
 
 const exptdFieldFilterQuery = `
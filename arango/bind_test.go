@@ -0,0 +1,171 @@
+package arango
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	driver "github.com/arangodb/go-driver"
+)
+
+// hostile are inputs that would break or inject into a query if they were
+// formatted into it instead of bound
+var hostile = []string{
+	`boo"`,
+	`boo" || true || "`,
+	`" return 1 //`,
+	"boo`\\",
+	`ETH" remove s in stamps //`,
+	`@evil`,
+	`ETH,|BTC,prefix:`,
+}
+
+// recordDB stands in for an arangodb database, recording the last query made
+type recordDB struct {
+	driver.Database
+	query    string
+	bindVars map[string]interface{}
+	result   interface{}
+}
+
+func (db *recordDB) Query(ctx context.Context, query string, bindVars map[string]interface{}) (driver.Cursor, error) {
+	db.query = query
+	db.bindVars = bindVars
+	docs, isList := db.result.([]interface{})
+	if !isList {
+		docs = []interface{}{db.result}
+	}
+	return &recordCursor{docs: docs}, nil
+}
+
+// recordCursor serves a canned list of documents
+type recordCursor struct {
+	driver.Cursor
+	docs []interface{}
+}
+
+func (c *recordCursor) Close() error { return nil }
+
+func (c *recordCursor) HasMore() bool { return len(c.docs) > 0 }
+
+func (c *recordCursor) ReadDocument(ctx context.Context, result interface{}) (driver.DocumentMeta, error) {
+	if len(c.docs) == 0 {
+		return driver.DocumentMeta{}, driver.NoMoreDocumentsError{}
+	}
+	raw, err := json.Marshal(c.docs[0])
+	if err != nil {
+		return driver.DocumentMeta{}, err
+	}
+	c.docs = c.docs[1:]
+	return driver.DocumentMeta{}, json.Unmarshal(raw, result)
+}
+
+// checkBound makes sure input only made it to the database as a bind variable
+func checkBound(t *testing.T, db *recordDB, input string) {
+	t.Helper()
+	if strings.Contains(db.query, input) {
+		t.Errorf("input %q was formatted into query:\n%s", input, db.query)
+	}
+	for _, val := range db.bindVars {
+		if val == input {
+			return
+		}
+	}
+	t.Errorf("input %q was not bound: %v", input, db.bindVars)
+}
+
+func TestBindHostile(t *testing.T) {
+	for _, input := range hostile {
+		db := &recordDB{}
+		sesh := &Sesh{db: db, Ctx: context.Background()}
+
+		_, err := sesh.LatestBalance(input)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+
+		db.result = 1.5
+		_, err = sesh.LatestPrice(input)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+
+		db.result = true
+		_, err = sesh.AssetExists(input)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+
+		db.result = "123"
+		_, err = sesh.UserChanID(input)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+
+		db.result = []interface{}{}
+		var found []map[string]interface{}
+		err = sesh.Find("positions", Match{"alive": true, "user": input}, &found)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+		// field names are bound as well
+		err = sesh.Find("users", Match{input: "boo"}, &found)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, db, input)
+
+		query, bindVars, err := FieldFilter("symbol", "||", "stamp", "ETH", input)
+		if err != nil {
+			t.Error(err)
+		}
+		checkBound(t, &recordDB{query: query, bindVars: bindVars}, input)
+	}
+}
+
+func TestFieldFilterOperator(t *testing.T) {
+	_, _, err := FieldFilter("symbol", `|| true ||`, "stamp", "ETH", "BTC")
+	if err == nil {
+		t.Error("expected an invalid operator to fail")
+	}
+}
+
+func TestMemHostile(t *testing.T) {
+	m := NewMem()
+	for i, input := range hostile {
+		err := m.CreateDoc("users", map[string]interface{}{"_key": input, "channel_id": fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.CreateDoc("balances", Balance{User: input, Balances: map[string]float64{"USDC": float64(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, input := range hostile {
+		id, err := m.UserChanID(input)
+		if err != nil || id != fmt.Sprint(i) {
+			t.Errorf("unexpected channel id for %q: %s %v", input, id, err)
+		}
+		bal, err := m.LatestBalance(input)
+		if err != nil || bal.Balances["USDC"] != float64(i) {
+			t.Errorf("unexpected balance for %q: %+v %v", input, bal, err)
+		}
+	}
+	// a user named like an injection only sees their own balances
+	var bals []Balance
+	err := m.Find("balances", Match{"user": `boo" || true || "`}, &bals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bals) != 1 {
+		t.Errorf("expected 1 balance, got %d", len(bals))
+	}
+}
@@ -0,0 +1,80 @@
+package arango
+
+import (
+	"context"
+	"reflect"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/pkg/errors"
+)
+
+// BatchSize is the number of documents a Cursor fetches from arangodb per
+// round trip
+const BatchSize = 500
+
+// Iterator streams documents one at a time
+type Iterator interface {
+	// Next scans the next document into data, returning false once there are
+	// no documents left
+	Next(data interface{}) (bool, error)
+	Close() error
+}
+
+// Cursor streams the results of an arangodb query in batches, so that large
+// results never have to be held in memory all at once
+type Cursor struct {
+	cursor driver.Cursor
+	ctx    context.Context
+}
+
+// Query starts a streaming query. The caller must Close the returned Cursor.
+func (s *Sesh) Query(query string, bindVars map[string]interface{}) (*Cursor, error) {
+	ctx := driver.WithQueryStream(driver.WithQueryBatchSize(s.Ctx, BatchSize), true)
+	cursor, err := s.db.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, errors.Wrap(err, "Issue with query:")
+	}
+	return &Cursor{cursor: cursor, ctx: s.Ctx}, nil
+}
+
+// Next scans the next document into data, fetching another batch if needed
+func (c *Cursor) Next(data interface{}) (bool, error) {
+	if !c.cursor.HasMore() {
+		return false, nil
+	}
+	_, err := c.cursor.ReadDocument(c.ctx, data)
+	if driver.IsNoMoreDocuments(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "Could not read document")
+	}
+	return true, nil
+}
+
+// Close releases the cursor on the server
+func (c *Cursor) Close() error {
+	return c.cursor.Close()
+}
+
+// ReadAll drains iter into out, which must be a pointer to a slice
+func ReadAll(iter Iterator, out interface{}) error {
+	slice := reflect.ValueOf(out)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return errors.Errorf("can only read documents into a pointer to a slice, not %T", out)
+	}
+	items := reflect.MakeSlice(slice.Elem().Type(), 0, 0)
+	for {
+		item := reflect.New(items.Type().Elem())
+		more, err := iter.Next(item.Interface())
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+		items = reflect.Append(items, item.Elem())
+	}
+	slice.Elem().Set(items)
+	return nil
+}
@@ -0,0 +1,591 @@
+package arango
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mem is an in memory Store. Documents are kept as decoded json, just like
+// arangodb keeps them, so anything that round trips through a Sesh round trips
+// through a Mem the same way.
+type Mem struct {
+	mu sync.RWMutex
+	// wmu serializes writes, so that a running transaction only has to block
+	// other writers and never readers
+	wmu  sync.Mutex
+	path string
+	// Cols maps collection name -> document key -> document
+	Cols map[string]map[string]map[string]interface{} `json:"collections"`
+	// Tick is used to generate keys. It is shared by every collection, so a
+	// key copied from one collection to another never collides with a new one
+	Tick int64 `json:"tick"`
+
+	// writable limits which collections a transaction can write to, and is
+	// nil outside of a transaction
+	writable map[string]bool
+	// shared marks the collections a transaction has not copied yet
+	shared map[string]bool
+}
+
+// NewMem creates an empty in memory store
+func NewMem() *Mem {
+	return &Mem{Cols: make(map[string]map[string]map[string]interface{})}
+}
+
+// OpenMem creates an in memory store that is saved to path after every write,
+// loading any documents already saved there. An empty path is never saved.
+func OpenMem(path string) (*Mem, error) {
+	m := NewMem()
+	m.path = path
+	if path == "" {
+		return m, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to open memory store")
+	}
+	err = json.Unmarshal(raw, m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to open memory store")
+	}
+	if m.Cols == nil {
+		m.Cols = make(map[string]map[string]map[string]interface{})
+	}
+	return m, nil
+}
+
+// CreateDoc inserts data into col, generating a key if data doesn't have one
+func (m *Mem) CreateDoc(col string, data interface{}) error {
+	doc, err := toDoc(data)
+	if err != nil {
+		return errors.Wrapf(err, "failure to insert into %s", col)
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.writeCol(col)
+	if err != nil {
+		return err
+	}
+	key, _ := doc["_key"].(string)
+	if key == "" {
+		m.Tick++
+		key = fmt.Sprintf("%012d", m.Tick)
+		doc["_key"] = key
+	}
+	if _, has := docs[key]; has {
+		return errors.Errorf("unique constraint violated: %s/%s already exists", col, key)
+	}
+	docs[key] = doc
+	return m.save()
+}
+
+// CreateDocs inserts every element of the slice data into col. Either all of
+// the documents are inserted or none of them are.
+func (m *Mem) CreateDocs(col string, data interface{}) error {
+	docs := reflect.ValueOf(data)
+	if docs.Kind() != reflect.Slice {
+		return errors.Errorf("can only insert a slice of documents, not %T", data)
+	}
+	return m.Atomic([]string{col}, func(tx Store) error {
+		for i := 0; i < docs.Len(); i++ {
+			err := tx.CreateDoc(col, docs.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update merges data into the document stored under key, the same way
+// arangodb does by default
+func (m *Mem) Update(col, key string, data interface{}) error {
+	patch, err := toDoc(data)
+	if err != nil {
+		return errors.Wrapf(err, "failure to update %s/%s", col, key)
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.writeCol(col)
+	if err != nil {
+		return err
+	}
+	doc, has := docs[key]
+	if !has {
+		return errors.Errorf("document not found: %s/%s", col, key)
+	}
+	// patch a copy, as the original may be shared with a transaction
+	updated, err := toDoc(doc)
+	if err != nil {
+		return errors.Wrapf(err, "failure to update %s/%s", col, key)
+	}
+	delete(patch, "_key")
+	merge(updated, patch)
+	docs[key] = updated
+	return m.save()
+}
+
+// RemoveDoc deletes the document stored under key
+func (m *Mem) RemoveDoc(col, key string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.writeCol(col)
+	if err != nil {
+		return err
+	}
+	if _, has := docs[key]; !has {
+		return errors.Errorf("document not found: %s/%s", col, key)
+	}
+	delete(docs, key)
+	return m.save()
+}
+
+// Find scans the documents in col that match into out, newest first
+func (m *Mem) Find(col string, match Match, out interface{}) error {
+	want, err := toDoc(match)
+	if err != nil {
+		return errors.Wrapf(err, "failure to search %s", col)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var found []map[string]interface{}
+	for _, key := range m.keys(col) {
+		doc := m.Cols[col][key]
+		if matches(doc, want) {
+			found = append(found, doc)
+		}
+	}
+	return fromDocs(found, out)
+}
+
+// Iter streams the documents in col that match, oldest first. The documents
+// are copied when Iter is called, so writes made while iterating are not seen.
+func (m *Mem) Iter(col string, match Match) (Iterator, error) {
+	want, err := toDoc(match)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failure to search %s", col)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := m.keys(col)
+	var found []json.RawMessage
+	for i := len(keys) - 1; i >= 0; i-- {
+		doc := m.Cols[col][keys[i]]
+		if !matches(doc, want) {
+			continue
+		}
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failure to search %s", col)
+		}
+		found = append(found, raw)
+	}
+	return &memIter{docs: found}, nil
+}
+
+// memIter iterates over a snapshot of documents
+type memIter struct {
+	docs []json.RawMessage
+}
+
+func (it *memIter) Next(data interface{}) (bool, error) {
+	if len(it.docs) == 0 {
+		return false, nil
+	}
+	raw := it.docs[0]
+	it.docs = it.docs[1:]
+	return true, json.Unmarshal(raw, data)
+}
+
+func (it *memIter) Close() error {
+	it.docs = nil
+	return nil
+}
+
+// LatestBalance fetches the most recent balance of user
+func (m *Mem) LatestBalance(user string) (*Balance, error) {
+	var bals []*Balance
+	err := m.Find("balances", Match{"user": user}, &bals)
+	if err != nil {
+		return nil, err
+	}
+	if len(bals) == 0 {
+		return nil, errors.Errorf("no balance found for %s", user)
+	}
+	latest := bals[0]
+	for _, b := range bals[1:] {
+		if b.Timestamp.After(latest.Timestamp) {
+			latest = b
+		}
+	}
+	return latest, nil
+}
+
+// LatestPrice fetches the most recent usd price of symbol
+func (m *Mem) LatestPrice(symbol string) (float64, error) {
+	s, err := m.latestStamp(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return s.Price, nil
+}
+
+// LatestPrices fetches the most recent stamp of each of symbols in a single
+// pass over the stamps. Symbols without any stamps are left out.
+func (m *Mem) LatestPrices(symbols []string) (map[string]*Stamp, error) {
+	want := make(map[string]bool)
+	for _, symbol := range symbols {
+		want[symbol] = true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string]*Stamp)
+	for _, key := range m.keys("stamps") {
+		var s Stamp
+		err := fromDoc(m.Cols["stamps"][key], &s)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to lookup prices:")
+		}
+		if !want[s.Symbol] {
+			continue
+		}
+		if prev, has := out[s.Symbol]; has && !s.Time.After(prev.Time) {
+			continue
+		}
+		out[s.Symbol] = &s
+	}
+	return out, nil
+}
+
+// StampSeries streams the stamps of symbol recorded from start up to end,
+// oldest first. Like Iter, the stamps are copied when StampSeries is called.
+func (m *Mem) StampSeries(symbol string, start, end time.Time) (Iterator, error) {
+	var stamps []*Stamp
+	err := m.Find("stamps", Match{"symbol": symbol}, &stamps)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stamps, func(i, j int) bool {
+		if !stamps[i].Time.Equal(stamps[j].Time) {
+			return stamps[i].Time.Before(stamps[j].Time)
+		}
+		return stamps[i].Key < stamps[j].Key
+	})
+	var found []json.RawMessage
+	for _, s := range stamps {
+		if s.Time.Before(start) || !s.Time.Before(end) {
+			continue
+		}
+		raw, err := json.Marshal(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to search stamps")
+		}
+		found = append(found, raw)
+	}
+	return &memIter{docs: found}, nil
+}
+
+// Valuations streams the valuations of user recorded from start up to end,
+// oldest first. Like Iter, the valuations are copied when Valuations is called.
+func (m *Mem) Valuations(user string, start, end time.Time) (Iterator, error) {
+	var docs []map[string]interface{}
+	err := m.Find("valuations", Match{"user": user}, &docs)
+	if err != nil {
+		return nil, err
+	}
+	type timed struct {
+		Key  string    `json:"_key"`
+		Time time.Time `json:"time"`
+		raw  json.RawMessage
+	}
+	var found []*timed
+	for _, doc := range docs {
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to fetch valuations")
+		}
+		v := &timed{raw: raw}
+		err = json.Unmarshal(raw, v)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to fetch valuations")
+		}
+		if v.Time.Before(start) || !v.Time.Before(end) {
+			continue
+		}
+		found = append(found, v)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Time.Equal(found[j].Time) {
+			return found[i].Time.Before(found[j].Time)
+		}
+		return found[i].Key < found[j].Key
+	})
+	out := make([]json.RawMessage, len(found))
+	for i, v := range found {
+		out[i] = v.raw
+	}
+	return &memIter{docs: out}, nil
+}
+
+// AssetExists checks that the latest stamp for symbol has a market cap
+func (m *Mem) AssetExists(symbol string) (bool, error) {
+	s, err := m.latestStamp(symbol)
+	if err != nil {
+		return false, nil
+	}
+	return s.Cap > 0, nil
+}
+
+func (m *Mem) latestStamp(symbol string) (*Stamp, error) {
+	var stamps []*Stamp
+	err := m.Find("stamps", Match{"symbol": symbol}, &stamps)
+	if err != nil {
+		return nil, err
+	}
+	if len(stamps) == 0 {
+		return nil, errors.Errorf("no stamps found for %s", symbol)
+	}
+	latest := stamps[0]
+	for _, s := range stamps[1:] {
+		if s.Time.After(latest.Time) {
+			latest = s
+		}
+	}
+	return latest, nil
+}
+
+// UserChanID fetches the channel used to notify user
+func (m *Mem) UserChanID(user string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, has := m.Cols["users"][user]
+	if !has {
+		return "", errors.Errorf("no user found named %s", user)
+	}
+	id, _ := u["channel_id"].(string)
+	return id, nil
+}
+
+// AllUsers lists the names of every registered user
+func (m *Mem) AllUsers() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys("users"), nil
+}
+
+// ExportStamps fetches the oldest incr stamps recorded before before, oldest
+// first, along with their keys
+func (m *Mem) ExportStamps(before time.Time, incr int) ([]*Stamp, []string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []*Stamp
+	for _, doc := range m.Cols["stamps"] {
+		var s Stamp
+		err := fromDoc(doc, &s)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failure to export stamps:")
+		}
+		if s.Time.Before(before) {
+			out = append(out, &s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Time.Equal(out[j].Time) {
+			return out[i].Time.Before(out[j].Time)
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > incr {
+		out = out[:incr]
+	}
+	var keys []string
+	for _, s := range out {
+		keys = append(keys, s.Key)
+	}
+	return out, keys, nil
+}
+
+// RemoveStamps deletes the stamps stored under keys
+func (m *Mem) RemoveStamps(keys []string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.writeCol("stamps")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(docs, key)
+	}
+	return m.save()
+}
+
+// CountStamps counts the stamps currently stored
+func (m *Mem) CountStamps() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.Cols["stamps"]), nil
+}
+
+// Atomic runs fn against a copy of the store, keeping the copy only if fn
+// succeeds. Other writes wait until fn returns, while reads keep seeing the
+// store as it was before the transaction. Calling Atomic on a tx joins the
+// transaction that is already running.
+func (m *Mem) Atomic(write []string, fn func(tx Store) error) error {
+	if m.writable != nil {
+		return fn(m)
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.RLock()
+	tx := &Mem{
+		Cols:     make(map[string]map[string]map[string]interface{}),
+		Tick:     m.Tick,
+		writable: make(map[string]bool),
+		shared:   make(map[string]bool),
+	}
+	for name, docs := range m.Cols {
+		tx.Cols[name] = docs
+		tx.shared[name] = true
+	}
+	for _, name := range write {
+		tx.writable[name] = true
+	}
+	m.mu.RUnlock()
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Cols = tx.Cols
+	m.Tick = tx.Tick
+	return m.save()
+}
+
+// writeCol returns the documents of col so that they can be changed, creating
+// the collection if needed. The caller must hold the write lock.
+func (m *Mem) writeCol(col string) (map[string]map[string]interface{}, error) {
+	if m.writable != nil && !m.writable[col] {
+		return nil, errors.Errorf("collection %s was not declared for writing in this transaction", col)
+	}
+	docs, has := m.Cols[col]
+	switch {
+	case !has:
+		docs = make(map[string]map[string]interface{})
+		m.Cols[col] = docs
+	case m.shared[col]:
+		// copy on first write so the original is untouched if fn fails
+		docs = make(map[string]map[string]interface{}, len(m.Cols[col]))
+		for key, doc := range m.Cols[col] {
+			docs[key] = doc
+		}
+		m.Cols[col] = docs
+		delete(m.shared, col)
+	}
+	return docs, nil
+}
+
+// keys returns the keys of col in reverse order. Generated keys count up, so
+// documents inserted without a key come newest first, but anything that needs
+// to be in time order sorts by its time. The caller must hold a lock.
+func (m *Mem) keys(col string) []string {
+	var keys []string
+	for key := range m.Cols[col] {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys
+}
+
+// save writes the store to its path, if it has one. The caller must hold the
+// write lock.
+func (m *Mem) save() error {
+	if m.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failure to save memory store")
+	}
+	tmp := m.path + ".tmp"
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failure to save memory store")
+	}
+	return os.Rename(tmp, m.path)
+}
+
+/////////////////////////////////
+// Utility funcs
+///////////////////////////////
+
+// toDoc converts data into the generic form arangodb would store it in
+func toDoc(data interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	err = json.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+func fromDoc(doc map[string]interface{}, out interface{}) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func fromDocs(docs []map[string]interface{}, out interface{}) error {
+	if docs == nil {
+		docs = []map[string]interface{}{}
+	}
+	raw, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func matches(doc, want map[string]interface{}) bool {
+	for field, val := range want {
+		if !reflect.DeepEqual(doc[field], val) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge recursively patches doc, like arangodb's default mergeObjects behavior
+func merge(doc, patch map[string]interface{}) {
+	for field, val := range patch {
+		sub, isObj := val.(map[string]interface{})
+		curr, wasObj := doc[field].(map[string]interface{})
+		if isObj && wasObj {
+			merge(curr, sub)
+			continue
+		}
+		doc[field] = val
+	}
+}
@@ -0,0 +1,389 @@
+package arango
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDoc struct {
+	Key   string             `json:"_key,omitempty"`
+	User  string             `json:"user"`
+	Alive bool               `json:"alive"`
+	Vals  map[string]float64 `json:"vals,omitempty"`
+}
+
+func TestMemFind(t *testing.T) {
+	m := NewMem()
+	docs := []testDoc{
+		{User: "boo", Alive: true},
+		{User: "boo", Alive: false},
+		{User: "zkFART", Alive: true},
+		{User: "boo", Alive: true},
+	}
+	for _, d := range docs {
+		err := m.CreateDoc("positions", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var found []testDoc
+	err := m.Find("positions", Match{"user": "boo", "alive": true}, &found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 documents, got %d", len(found))
+	}
+	// newest first
+	if found[0].Key <= found[1].Key {
+		t.Error("documents are not sorted newest first", found[0].Key, found[1].Key)
+	}
+	var all []testDoc
+	err = m.Find("positions", nil, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(docs) {
+		t.Errorf("expected %d documents, got %d", len(docs), len(all))
+	}
+	var none []testDoc
+	err = m.Find("nothing", nil, &none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(none) != 0 {
+		t.Error("found documents in an empty collection")
+	}
+}
+
+func TestMemUpdateRemove(t *testing.T) {
+	m := NewMem()
+	err := m.CreateDoc("positions", testDoc{Key: "1", User: "boo", Vals: map[string]float64{"a": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateDoc("positions", testDoc{Key: "1", User: "boo"})
+	if err == nil {
+		t.Error("expected duplicate key to fail")
+	}
+	err = m.Update("positions", "1", testDoc{Alive: true, Vals: map[string]float64{"b": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []testDoc
+	err = m.Find("positions", Match{"_key": "1"}, &found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected 1 document, got %d", len(found))
+	}
+	d := found[0]
+	if !d.Alive || d.Vals["a"] != 1 || d.Vals["b"] != 2 {
+		t.Errorf("update was not merged: %+v", d)
+	}
+	err = m.RemoveDoc("positions", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RemoveDoc("positions", "1")
+	if err == nil {
+		t.Error("expected removing a missing document to fail")
+	}
+	err = m.Update("positions", "1", d)
+	if err == nil {
+		t.Error("expected updating a missing document to fail")
+	}
+}
+
+func TestMemLatest(t *testing.T) {
+	m := NewMem()
+	_, err := m.LatestBalance("boo")
+	if err == nil {
+		t.Error("expected missing balance to fail")
+	}
+	for _, amount := range []float64{100, 50, 25} {
+		err = m.CreateDoc("balances", Balance{User: "boo", Balances: map[string]float64{"USDC": amount}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bal, err := m.LatestBalance("boo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal.Balances["USDC"] != 25 {
+		t.Error("expected latest balance of 25, got", bal.Balances["USDC"])
+	}
+
+	for _, price := range []float64{300, 400} {
+		err = m.CreateDoc("stamps", Stamp{Symbol: "ETH", Price: price, Cap: 1, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	price, err := m.LatestPrice("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price != 400 {
+		t.Error("expected latest price of 400, got", price)
+	}
+	exists, err := m.AssetExists("ETH")
+	if err != nil || !exists {
+		t.Error("expected ETH to exist", err)
+	}
+	exists, err = m.AssetExists("FXC")
+	if err != nil || exists {
+		t.Error("expected FXC not to exist", err)
+	}
+	count, err := m.CountStamps()
+	if err != nil || count != 2 {
+		t.Error("expected 2 stamps, got", count, err)
+	}
+	stamps, keys, err := m.ExportStamps(time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 1 || stamps[0].Price != 300 {
+		t.Fatal("expected the oldest stamp to be exported", stamps)
+	}
+	err = m.RemoveStamps(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, _ = m.CountStamps()
+	if count != 1 {
+		t.Error("expected 1 stamp after removal, got", count)
+	}
+}
+
+func TestMemLatestByTime(t *testing.T) {
+	m := NewMem()
+	now := time.Now()
+	// the keys sort the opposite way to the times
+	docs := []struct {
+		key   string
+		price float64
+		at    time.Time
+	}{
+		{"b", 100, now.Add(-time.Hour)},
+		{"a", 200, now},
+	}
+	for _, d := range docs {
+		err := m.CreateDoc("balances", map[string]interface{}{"_key": d.key, "user": "boo", "balances": map[string]float64{"USDC": d.price}, "timestamp": d.at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.CreateDoc("stamps", Stamp{Key: d.key, Symbol: "ETH", Price: d.price, Cap: 1, Time: d.at})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bal, err := m.LatestBalance("boo")
+	if err != nil || bal.Balances["USDC"] != 200 {
+		t.Error("expected the newest balance by time", bal, err)
+	}
+	price, err := m.LatestPrice("ETH")
+	if err != nil || price != 200 {
+		t.Error("expected the newest price by time", price, err)
+	}
+	latest, err := m.LatestPrices([]string{"ETH", "eth"})
+	if err != nil || len(latest) != 1 || latest["ETH"].Price != 200 {
+		t.Error("expected the newest stamp, matching symbols exactly like arango", latest, err)
+	}
+}
+
+func TestMemUsers(t *testing.T) {
+	m := NewMem()
+	err := m.CreateDoc("users", map[string]interface{}{"_key": "boo", "channel_id": "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := m.UserChanID("boo")
+	if err != nil || id != "123" {
+		t.Error("unexpected channel id", id, err)
+	}
+	_, err = m.UserChanID("nobody")
+	if err == nil {
+		t.Error("expected missing user to fail")
+	}
+	users, err := m.AllUsers()
+	if err != nil || len(users) != 1 || users[0] != "boo" {
+		t.Error("unexpected users", users, err)
+	}
+}
+
+func TestOpenMem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chip.json")
+	m, err := OpenMem(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateDoc("balances", Balance{User: "boo", Balances: map[string]float64{"USDC": 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenMem(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, err := reopened.LatestBalance("boo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal.Balances["USDC"] != 100 {
+		t.Error("balance was not saved", bal)
+	}
+	// keys must keep increasing after reopening
+	err = reopened.CreateDoc("balances", Balance{User: "boo", Balances: map[string]float64{"USDC": 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = reopened.LatestBalance("boo")
+	if bal.Balances["USDC"] != 5 {
+		t.Error("expected the newest balance after reopening", bal)
+	}
+}
+
+func TestMemIter(t *testing.T) {
+	m := NewMem()
+	for _, user := range []string{"a", "b", "c"} {
+		err := m.CreateDoc("positions", testDoc{User: user, Alive: user != "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err := m.Iter("positions", Match{"alive": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	// writes made while iterating are not seen
+	err = m.CreateDoc("positions", testDoc{User: "d", Alive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for {
+		var d testDoc
+		more, err := iter.Next(&d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !more {
+			break
+		}
+		err = m.RemoveDoc("positions", d.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, d.User)
+	}
+	if strings.Join(users, "") != "ac" {
+		t.Error("expected a then c, oldest first, got", users)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	m := NewMem()
+	for _, amount := range []float64{1, 2, 3} {
+		err := m.CreateDoc("balances", Balance{User: "boo", Balances: map[string]float64{"USDC": amount}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err := m.Iter("balances", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bals []*Balance
+	err = ReadAll(iter, &bals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bals) != 3 || bals[2].Balances["USDC"] != 3 {
+		t.Error("unexpected balances", bals)
+	}
+	var notSlice Balance
+	err = ReadAll(iter, &notSlice)
+	if err == nil {
+		t.Error("expected reading into a non slice to fail")
+	}
+}
+
+func TestMemAtomic(t *testing.T) {
+	m := NewMem()
+	err := m.CreateDoc("limits", testDoc{Key: "1", User: "boo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a failed transaction leaves nothing behind
+	err = m.Atomic([]string{"limits", "trades"}, func(tx Store) error {
+		err := tx.CreateDoc("trades", testDoc{User: "boo"})
+		if err != nil {
+			return err
+		}
+		err = tx.Update("limits", "1", testDoc{Alive: true})
+		if err != nil {
+			return err
+		}
+		err = tx.RemoveDoc("limits", "1")
+		if err != nil {
+			return err
+		}
+		return errors.New("crash")
+	})
+	if err == nil || err.Error() != "crash" {
+		t.Fatal("expected the transaction's error, got", err)
+	}
+	var trades, limits []testDoc
+	m.Find("trades", nil, &trades)
+	m.Find("limits", nil, &limits)
+	if len(trades) != 0 || len(limits) != 1 || limits[0].Alive {
+		t.Errorf("failed transaction was not rolled back: %v %v", trades, limits)
+	}
+
+	// writing to a collection that wasn't declared fails
+	err = m.Atomic([]string{"limits"}, func(tx Store) error {
+		return tx.CreateDoc("trades", testDoc{User: "boo"})
+	})
+	if err == nil {
+		t.Error("expected writing to an undeclared collection to fail")
+	}
+
+	// a successful transaction keeps everything, including nested ones
+	err = m.Atomic([]string{"limits", "trades"}, func(tx Store) error {
+		err := tx.CreateDoc("trades", testDoc{User: "boo"})
+		if err != nil {
+			return err
+		}
+		// reading outside of the transaction doesn't block or see its writes
+		var outside []testDoc
+		err = m.Find("trades", nil, &outside)
+		if err != nil || len(outside) != 0 {
+			t.Error("uncommitted write seen outside of the transaction", outside, err)
+		}
+		return tx.Atomic(nil, func(tx Store) error {
+			return tx.RemoveDoc("limits", "1")
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Find("trades", nil, &trades)
+	m.Find("limits", nil, &limits)
+	if len(trades) != 1 || len(limits) != 0 {
+		t.Errorf("transaction was not committed: %v %v", trades, limits)
+	}
+}
@@ -0,0 +1,219 @@
+package arango
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+)
+
+// PriceOracle provides usd prices for assets
+type PriceOracle interface {
+	// Price returns the usd price of symbol
+	Price(symbol string) (float64, error)
+	// Prices returns the usd price of every one of symbols
+	Prices(symbols ...string) (map[string]float64, error)
+	// Volume returns the 24 hour usd trading volume of symbol, or 0 if it
+	// isn't known
+	Volume(symbol string) (float64, error)
+	// Quote returns the usd prices that symbol can be sold at, its bid, and
+	// bought at, its ask
+	Quote(symbol string) (bid, ask float64, err error)
+	// FeesFor returns the fees of an order trading symbols
+	FeesFor(symbols ...string) config.Fees
+	// Slippage returns the fraction that an order worth size USD moves the
+	// price of symbol
+	Slippage(symbol string, size float64) (float64, error)
+}
+
+// BadPrice is returned by a PriceOracle for a price that is missing, zero, or
+// too old to trade against
+type BadPrice struct {
+	Symbol string
+	// Time is when the price was recorded, and is zero if there is no price
+	Time   time.Time
+	Reason string
+}
+
+func (b *BadPrice) Error() string {
+	if b.Time.IsZero() {
+		return fmt.Sprintf("bad price for %s: %s", b.Symbol, b.Reason)
+	}
+	return fmt.Sprintf("bad price for %s from %s: %s", b.Symbol, b.Time.Format(time.RFC3339), b.Reason)
+}
+
+// IsBadPrice checks if err was caused by a missing, zero, or stale price
+func IsBadPrice(err error) bool {
+	_, ok := errors.Cause(err).(*BadPrice)
+	return ok
+}
+
+// Snapshot is a PriceOracle that remembers every price it looks up, so that
+// everything priced against the same Snapshot sees the same prices. A fresh
+// Snapshot is used for each cron tick or command.
+type Snapshot struct {
+	// MaxAge is how old a price can be before it is refused. Zero allows
+	// prices of any age.
+	MaxAge time.Duration
+	// Spread returns the gap between the bid and ask of symbol as a fraction
+	// of its price, for prices recorded without a bid and ask. A nil Spread
+	// quotes those prices with no gap.
+	Spread func(symbol string) float64
+	// Fees returns the fees of an order trading symbols. A nil Fees charges
+	// nothing.
+	Fees func(symbols ...string) config.Fees
+	// Impact returns the fraction that an order worth size USD moves a price
+	// with 24 hour volume vol. A nil Impact doesn't slip.
+	Impact func(size, vol float64) float64
+	sesh   Store
+	mu     sync.Mutex
+	stamps map[string]*Stamp
+}
+
+// NewSnapshot creates an empty Snapshot that looks up prices using sesh
+func NewSnapshot(sesh Store) *Snapshot {
+	return &Snapshot{
+		sesh:   sesh,
+		stamps: make(map[string]*Stamp),
+	}
+}
+
+// NewSnapshotFrom creates an empty Snapshot that looks up prices using sesh,
+// refusing prices older than cfg allows and quoting the spreads, fees and
+// slippage it sets. Everything that values or trades for a user uses one.
+func NewSnapshotFrom(sesh Store, cfg *config.Config) *Snapshot {
+	s := NewSnapshot(sesh)
+	s.MaxAge = cfg.PriceAge()
+	s.Spread = cfg.SpreadFor
+	s.Fees = cfg.FeesFor
+	s.Impact = cfg.SlippageFor
+	return s
+}
+
+// Load fetches the prices of any of symbols that aren't in the snapshot yet
+// using a single query. Symbols without a price are not an error until they
+// are asked for.
+func (s *Snapshot) Load(symbols ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(symbols)
+}
+
+func (s *Snapshot) load(symbols []string) error {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, symbol := range symbols {
+		if _, has := s.stamps[symbol]; has || seen[symbol] {
+			continue
+		}
+		seen[symbol] = true
+		missing = append(missing, symbol)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	stamps, err := s.sesh.LatestPrices(missing)
+	if err != nil {
+		return errors.Wrap(err, "failure to load price snapshot")
+	}
+	for _, symbol := range missing {
+		// remember missing prices too, so they aren't looked up again
+		s.stamps[symbol] = stamps[symbol]
+	}
+	return nil
+}
+
+// Price returns the usd price of symbol, looking it up if it isn't in the
+// snapshot yet
+func (s *Snapshot) Price(symbol string) (float64, error) {
+	prices, err := s.Prices(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return prices[symbol], nil
+}
+
+// Prices returns the usd price of every one of symbols, looking up any that
+// aren't in the snapshot yet in a single query. A *BadPrice is returned for
+// the first price that is missing, zero, or older than MaxAge.
+func (s *Snapshot) Prices(symbols ...string) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load(symbols)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]float64, len(symbols))
+	for _, symbol := range symbols {
+		stamp := s.stamps[symbol]
+		switch {
+		case stamp == nil:
+			return nil, &BadPrice{Symbol: symbol, Reason: "no price found"}
+		case stamp.Price <= 0:
+			return nil, &BadPrice{Symbol: symbol, Time: stamp.Time, Reason: "price is zero"}
+		case s.MaxAge > 0 && time.Since(stamp.Time) > s.MaxAge:
+			return nil, &BadPrice{Symbol: symbol, Time: stamp.Time, Reason: "price is stale"}
+		}
+		out[symbol] = stamp.Price
+	}
+	return out, nil
+}
+
+// Volume returns the 24 hour usd trading volume of symbol recorded along with
+// its price, or 0 if there is no price
+func (s *Snapshot) Volume(symbol string) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load([]string{symbol})
+	if err != nil {
+		return 0, err
+	}
+	stamp := s.stamps[symbol]
+	if stamp == nil {
+		return 0, nil
+	}
+	return stamp.Volume, nil
+}
+
+// Quote returns the bid and ask of symbol recorded along with its price. If
+// there is no usable bid and ask, they are spread evenly around the price.
+func (s *Snapshot) Quote(symbol string) (float64, float64, error) {
+	price, err := s.Price(symbol)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.mu.Lock()
+	stamp := s.stamps[symbol]
+	s.mu.Unlock()
+	if stamp.Bid > 0 && stamp.Ask >= stamp.Bid {
+		return stamp.Bid, stamp.Ask, nil
+	}
+	var spread float64
+	if s.Spread != nil {
+		spread = s.Spread(symbol)
+	}
+	return price * (1 - spread/2), price * (1 + spread/2), nil
+}
+
+// FeesFor returns the fees of an order trading symbols
+func (s *Snapshot) FeesFor(symbols ...string) config.Fees {
+	if s.Fees == nil {
+		return config.Fees{}
+	}
+	return s.Fees(symbols...)
+}
+
+// Slippage returns the fraction that an order worth size USD moves the price
+// of symbol, given the volume recorded along with its price
+func (s *Snapshot) Slippage(symbol string, size float64) (float64, error) {
+	if s.Impact == nil {
+		return 0, nil
+	}
+	vol, err := s.Volume(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return s.Impact(size, vol), nil
+}
@@ -0,0 +1,177 @@
+package arango
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/config"
+)
+
+// countStore counts how many times prices are looked up
+type countStore struct {
+	*Mem
+	lookups int
+}
+
+func (c *countStore) LatestPrices(symbols []string) (map[string]*Stamp, error) {
+	c.lookups++
+	return c.Mem.LatestPrices(symbols)
+}
+
+func TestSnapshot(t *testing.T) {
+	m := &countStore{Mem: NewMem()}
+	for symbol, price := range map[string]float64{"ETH": 400, "BTC": 11000, "USDC": 1} {
+		err := m.CreateDoc("stamps", Stamp{Symbol: symbol, Price: price, Cap: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := NewSnapshot(m)
+	err := prices.Load("ETH", "BTC", "USDC", "ETH", "FXC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.lookups != 1 {
+		t.Error("expected a single lookup, got", m.lookups)
+	}
+	// newer prices written during the tick are not seen
+	err = m.CreateDoc("stamps", Stamp{Symbol: "ETH", Price: 500, Cap: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := prices.Prices("ETH", "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found["ETH"] != 400 || found["BTC"] != 11000 {
+		t.Error("unexpected prices", found)
+	}
+	_, err = prices.Price("FXC")
+	if !IsBadPrice(err) {
+		t.Error("expected a missing price to be bad, got", err)
+	}
+	if m.lookups != 1 {
+		t.Error("expected cached prices to be reused, got", m.lookups, "lookups")
+	}
+	// a fresh snapshot sees the new price
+	price, err := NewSnapshot(m).Price("ETH")
+	if err != nil || price != 500 {
+		t.Error("expected the latest price of 500, got", price, err)
+	}
+}
+
+func TestSnapshotBadPrices(t *testing.T) {
+	m := NewMem()
+	stamps := []Stamp{
+		{Symbol: "ETH", Price: 400, Cap: 1, Time: time.Now().Add(-time.Minute)},
+		{Symbol: "BTC", Price: 11000, Cap: 1, Time: time.Now().Add(-time.Hour)},
+		{Symbol: "DOGE", Price: 0, Cap: 1, Time: time.Now()},
+	}
+	for _, s := range stamps {
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := NewSnapshot(m)
+	prices.MaxAge = time.Minute * 30
+	price, err := prices.Price("ETH")
+	if err != nil || price != 400 {
+		t.Error("expected a fresh price of 400, got", price, err)
+	}
+	for _, symbol := range []string{"BTC", "DOGE", "FXC"} {
+		_, err = prices.Price(symbol)
+		if !IsBadPrice(err) {
+			t.Errorf("expected %s to have a bad price, got %v", symbol, err)
+		}
+	}
+	_, err = prices.Prices("ETH", "BTC")
+	if !IsBadPrice(err) {
+		t.Error("expected one stale price to fail the batch, got", err)
+	}
+	// without a max age any price that isn't zero is fine
+	_, err = NewSnapshot(m).Price("BTC")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotQuote(t *testing.T) {
+	m := NewMem()
+	stamps := []Stamp{
+		{Symbol: "ETH", Price: 400, Cap: 1},
+		{Symbol: "BTC", Price: 11000, Bid: 10990, Ask: 11020, Cap: 1},
+		// a crossed bid and ask isn't trusted
+		{Symbol: "LINK", Price: 10, Bid: 11, Ask: 9, Cap: 1},
+	}
+	for _, s := range stamps {
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := NewSnapshot(m)
+	bid, ask, err := prices.Quote("ETH")
+	if err != nil || bid != 400 || ask != 400 {
+		t.Error("expected no spread without a Spread, got", bid, ask, err)
+	}
+	prices.Spread = func(symbol string) float64 { return 0.01 }
+	tests := []struct {
+		symbol   string
+		bid, ask float64
+	}{
+		{"ETH", 398, 402},
+		{"BTC", 10990, 11020},
+		{"LINK", 9.95, 10.05},
+	}
+	for _, tt := range tests {
+		bid, ask, err := prices.Quote(tt.symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(bid-tt.bid) > 1e-9 || math.Abs(ask-tt.ask) > 1e-9 {
+			t.Errorf("%s: expected %v/%v, got %v/%v", tt.symbol, tt.bid, tt.ask, bid, ask)
+		}
+	}
+	_, _, err = prices.Quote("FXC")
+	if !IsBadPrice(err) {
+		t.Error("expected a missing price to be bad, got", err)
+	}
+}
+
+func TestNewSnapshotFrom(t *testing.T) {
+	m := NewMem()
+	for _, s := range []Stamp{
+		{Symbol: "ETH", Price: 400, Cap: 1, Time: time.Now()},
+		{Symbol: "BTC", Price: 11000, Cap: 1, Time: time.Now().Add(-time.Hour)},
+	} {
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := config.Default()
+	cfg.MaxPriceAge = 60
+	cfg.Spread = 0.01
+	cfg.Fees = config.Fees{Maker: 0.001, Taker: 0.002}
+	cfg.SlippageImpact = 0.1
+	cfg.MaxSlippage = 0.05
+	prices := NewSnapshotFrom(m, cfg)
+	bid, ask, err := prices.Quote("ETH")
+	if err != nil || math.Abs(bid-398) > 1e-9 || math.Abs(ask-402) > 1e-9 {
+		t.Error("expected the configured spread, got", bid, ask, err)
+	}
+	if fees := prices.FeesFor("ETH"); fees != cfg.Fees {
+		t.Error("expected the configured fees, got", fees)
+	}
+	// without a volume, orders slip the most
+	slip, err := prices.Slippage("ETH", 1000)
+	if err != nil || slip != 0.05 {
+		t.Error("expected the configured slippage, got", slip, err)
+	}
+	_, err = prices.Price("BTC")
+	if !IsBadPrice(err) {
+		t.Error("expected a stale price to be bad, got", err)
+	}
+}
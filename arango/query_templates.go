@@ -3,7 +3,10 @@ package arango
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,13 +18,28 @@ type FilterMany struct {
 	ReturnVal string
 }
 
-// GenQuery generates an arangodb query from data stored in the FilterMany caller
-func (fm *FilterMany) GenQuery() (string, error) {
+// GenQuery generates an arangodb query from data stored in the FilterMany
+// caller, along with the bind variables holding each filter's field and value
+func (fm *FilterMany) GenQuery() (string, map[string]interface{}, error) {
+	bindVars := make(map[string]interface{})
+	for i, f := range fm.Filters {
+		switch f.Operator {
+		case "", "||", "&&":
+		default:
+			return "", nil, errors.Errorf("invalid filter operator: %s", f.Operator)
+		}
+		bindVars[fmt.Sprintf("f%d", i)] = f.Field
+		bindVars[fmt.Sprintf("v%d", i)] = f.Value
+	}
 	temp, err := template.New("filterMany").Parse(getManyTemp)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	query, err := strGen(temp, fm)
+	if err != nil {
+		return "", nil, err
 	}
-	return strGen(temp, fm)
+	return query, bindVars, nil
 }
 
 // Filter holds data for a filter operation in an arangodb query template
@@ -37,7 +55,7 @@ type Filter struct {
 const getManyTemp = `
 let out = (
 	for stamp in stamps
-		filter {{range .Filters}} stamp.{{.Field}} == "{{.Value}}" {{.Operator}}{{end}}
+		filter {{range $i, $f := .Filters}} stamp.@f{{$i}} == @v{{$i}} {{$f.Operator}}{{end}}
 		return {{.ReturnVal}}
 )
 return out
@@ -45,7 +63,7 @@ return out
 
 // FieldFilter generates an arangodb query with multiple filters on the same field.
 // allows for easy obj.field == "value1" || obj.field == "value2"
-func FieldFilter(field, op, returnVal string, values ...string) (string, error) {
+func FieldFilter(field, op, returnVal string, values ...string) (string, map[string]interface{}, error) {
 	var out FilterMany
 	out.ReturnVal = returnVal
 	for i, val := range values {
@@ -70,60 +88,218 @@ func strGen(temp *template.Template, data interface{}) (string, error) {
 	return buf.String(), nil
 }
 
+// findQ is filled in by findQuery with one filter per matched field and the
+// sort direction
+const findQ = `
+for d in @@col
+	%s
+	sort d._key %s
+	return d
+`
+
+// findQuery generates a query for every document in col matching match
+func findQuery(col string, match Match, dir string) (string, map[string]interface{}) {
+	bindVars := map[string]interface{}{"@col": col}
+	var fields []string
+	for field := range match {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var filters []string
+	for i, field := range fields {
+		filters = append(filters, fmt.Sprintf("filter d.@f%d == @v%d", i, i))
+		bindVars[fmt.Sprintf("f%d", i)] = field
+		bindVars[fmt.Sprintf("v%d", i)] = match[field]
+	}
+	return fmt.Sprintf(findQ, strings.Join(filters, "\n\t"), dir), bindVars
+}
+
+// Find scans every document in col whose fields equal those in match into out,
+// newest first
+func (s *Sesh) Find(col string, match Match, out interface{}) error {
+	query, bindVars := findQuery(col, match, "desc")
+	cursor, err := s.Query(query, bindVars)
+	if err != nil {
+		return errors.Wrapf(err, "failure to search %s", col)
+	}
+	defer cursor.Close()
+	err = ReadAll(cursor, out)
+	if err != nil {
+		return errors.Wrapf(err, "failure to search %s", col)
+	}
+	return nil
+}
+
+// Iter streams every document in col whose fields equal those in match, oldest
+// first
+func (s *Sesh) Iter(col string, match Match) (Iterator, error) {
+	query, bindVars := findQuery(col, match, "asc")
+	cursor, err := s.Query(query, bindVars)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failure to search %s", col)
+	}
+	return cursor, nil
+}
+
+// LatestBalanceQ picks the balance with the newest timestamp, parsed like
+// stamp times, falling back to the newest key when timestamps tie
 const LatestBalanceQ = `
 for b in balances
-    sort b._key desc
-    filter b.user == "%s"
+    filter b.user == @user
+    sort date_timestamp(b.timestamp) desc, b._key desc
     limit 1
     return b 
 `
 
-func LatestBalance(sesh *Sesh, user string) (*Balance, error) {
+// LatestBalance fetches the most recent balance of user
+func (s *Sesh) LatestBalance(user string) (*Balance, error) {
 	var bal Balance
-	err := sesh.Execute(fmt.Sprintf(LatestBalanceQ, user), &bal)
+	err := s.Execute(LatestBalanceQ, map[string]interface{}{"user": user}, &bal)
 	return &bal, err
 }
 
+// StampSeries selects the stamps of a symbol from @start up to @end, both in
+// unix milliseconds. Stamp times are strings written with varying offsets and
+// precision, so they are parsed rather than compared as text.
 const StampSeries = `
-let out = (
-	for s in stamps
-		sort b._key asc
-		filter b.time > "%s"
-		filter b.time < "%s"
-		return s
-)
-return out
+for s in stamps
+	filter s.symbol == @symbol
+	filter date_timestamp(s.time) >= @start
+	filter date_timestamp(s.time) < @end
+	sort s.time asc
+	return s
 `
 
+// StampSeries streams the stamps of symbol recorded from start up to end,
+// oldest first. The caller must Close the returned Iterator.
+func (s *Sesh) StampSeries(symbol string, start, end time.Time) (Iterator, error) {
+	return s.Query(StampSeries, map[string]interface{}{
+		"symbol": symbol,
+		"start":  unixMillis(start),
+		"end":    unixMillis(end),
+	})
+}
+
+// valuationsQ selects the valuations of a user from @start up to @end, parsing
+// their times like StampSeries does
+const valuationsQ = `
+for v in valuations
+	filter v.user == @user
+	filter date_timestamp(v.time) >= @start
+	filter date_timestamp(v.time) < @end
+	sort date_timestamp(v.time) asc
+	return v
+`
+
+// Valuations streams the valuations of user recorded from start up to end,
+// oldest first. The caller must Close the returned Iterator.
+func (s *Sesh) Valuations(user string, start, end time.Time) (Iterator, error) {
+	cursor, err := s.Query(valuationsQ, map[string]interface{}{
+		"user":  user,
+		"start": unixMillis(start),
+		"end":   unixMillis(end),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch valuations")
+	}
+	return cursor, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 const StampClean = `
 for s in stamps
 	filter s.market_cap == 0
 	remove s._key in stamps
 `
 
+// LatestPrice picks the stamp with the newest time, not the newest key, as
+// backfilled stamps are inserted after more recent ones
 const LatestPrice = `
 for s in stamps
-    filter s.symbol == "%s"
-	sort s._key desc
+    filter s.symbol == @symbol
+	sort date_timestamp(s.time) desc, s._key desc
 	limit 1
 	return s.price
 `
 
-func FetchLatestPrice(sesh *Sesh, symbol string) (float64, error) {
+// LatestPrice fetches the most recent usd price of symbol
+func (s *Sesh) LatestPrice(symbol string) (float64, error) {
 	var price float64
-	err := sesh.Execute(fmt.Sprintf(LatestPrice, symbol), &price)
+	err := s.Execute(LatestPrice, map[string]interface{}{"symbol": symbol}, &price)
 	return price, err
 }
 
+// latestPricesQ looks up the newest stamp of every symbol in one round trip
+const latestPricesQ = `
+for sym in @symbols
+	let stamp = first(
+		for s in stamps
+			filter s.symbol == sym
+			sort date_timestamp(s.time) desc, s._key desc
+			limit 1
+			return s
+	)
+	filter stamp != null
+	return merge(stamp, {symbol: sym})
+`
+
+// LatestPrices fetches the most recent stamp of each of symbols in a single
+// query. Symbols without any stamps are left out.
+func (s *Sesh) LatestPrices(symbols []string) (map[string]*Stamp, error) {
+	cursor, err := s.Query(latestPricesQ, map[string]interface{}{"symbols": symbols})
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to lookup prices")
+	}
+	defer cursor.Close()
+	out := make(map[string]*Stamp)
+	for {
+		var stamp Stamp
+		more, err := cursor.Next(&stamp)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to lookup prices")
+		}
+		if !more {
+			break
+		}
+		out[stamp.Symbol] = &stamp
+	}
+	return out, nil
+}
+
+// assetExistsQ matches the symbol exactly instead of using the fulltext index,
+// as fulltext search strings have their own syntax a symbol could abuse
+const assetExistsQ = `
+for s in stamps
+	filter s.symbol == @symbol
+	sort date_timestamp(s.time) desc, s._key desc
+	limit 1
+	return s.market_cap > 0
+`
+
+// AssetExists checks that symbol is a tracked asset with a market cap
+func (s *Sesh) AssetExists(symbol string) (bool, error) {
+	var exists bool
+	err := s.Execute(assetExistsQ, map[string]interface{}{"symbol": symbol}, &exists)
+	if err != nil {
+		// no stamps means no asset
+		return false, nil
+	}
+	return exists, nil
+}
+
 const UserChannelQ = `
 for u in users
-	filter u._key == "%s"
+	filter u._key == @user
 	return u.channel_id
 `
 
-func UserChanID(sesh *Sesh, user string) (string, error) {
+// UserChanID fetches the channel used to notify user
+func (s *Sesh) UserChanID(user string) (string, error) {
 	var id string
-	err := sesh.Execute(fmt.Sprintf(UserChannelQ, user), &id)
+	err := s.Execute(UserChannelQ, map[string]interface{}{"user": user}, &id)
 	return id, err
 }
 
@@ -139,45 +315,52 @@ func UserChanID(sesh *Sesh, user string) (string, error) {
 // 	return nil
 // }
 
-func ExportStamps(sesh *Sesh, incr int) ([]*Stamp, []string, error) {
+// ExportStamps fetches the oldest incr stamps recorded before before, oldest
+// first, along with their keys
+func (s *Sesh) ExportStamps(before time.Time, incr int) ([]*Stamp, []string, error) {
 	const query = `
-	let out = (
-		for s in stamps
-			sort s._key asc
-			limit %d
-			return s
-	)
-	return out
+	for s in stamps
+		filter date_timestamp(s.time) < @before
+		sort date_timestamp(s.time) asc
+		limit @incr
+		return s
 	`
+	cursor, err := s.Query(query, map[string]interface{}{"before": unixMillis(before), "incr": incr})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failure to export stamps:")
+	}
+	defer cursor.Close()
 	var out []*Stamp
-	err := sesh.Execute(fmt.Sprintf(query, incr), &out)
+	err = ReadAll(cursor, &out)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failure to export stamps:")
 	}
 	var keys []string
-	for _, s := range out {
-		keys = append(keys, s.Key)
+	for _, st := range out {
+		keys = append(keys, st.Key)
 	}
 	return out, keys, nil
 }
 
-func RemoveStamps(sesh *Sesh, keys []string) error {
-	col, err := sesh.GetCol("stamps")
+// RemoveStamps deletes the stamps stored under keys
+func (s *Sesh) RemoveStamps(keys []string) error {
+	col, err := s.GetCol("stamps")
 	if err != nil {
 		return err
 	}
-	_, _, err = col.RemoveDocuments(sesh.Ctx, keys)
+	_, _, err = col.RemoveDocuments(s.Ctx, keys)
 	return err
 }
 
-func CountStamps(sesh *Sesh) (int, error) {
+// CountStamps counts the stamps currently stored
+func (s *Sesh) CountStamps() (int, error) {
 	const query = `
 	for s in stamps
 		collect with count into length
 		return length
 	`
 	var out int
-	err := sesh.Execute(query, &out)
+	err := s.Execute(query, nil, &out)
 	if err != nil {
 		return 0, err
 	}
@@ -185,16 +368,19 @@ func CountStamps(sesh *Sesh) (int, error) {
 }
 
 const allUsersQ = `
-let out = (
 for u in users
 	return u._key
-)
-return out
 `
 
-func AllUsers(sesh *Sesh) ([]string, error) {
+// AllUsers lists the names of every registered user
+func (s *Sesh) AllUsers() ([]string, error) {
+	cursor, err := s.Query(allUsersQ, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
 	var out []string
-	err := sesh.Execute(allUsersQ, &out)
+	err = ReadAll(cursor, &out)
 	if err != nil {
 		return nil, err
 	}
@@ -29,13 +29,46 @@ pending # all pending trades, ported to to trades everytime the price is updated
 
 // Balance represents the state of a user portfolio at a give time
 type Balance struct {
-	User      string             `json:"user"`
-	Balances  map[string]float64 `json:"balances"`
+	User     string             `json:"user"`
+	Balances map[string]float64 `json:"balances"`
+	// Reserved is the part of Balances locked by orders that haven't been
+	// executed yet
+	Reserved  map[string]float64 `json:"reserved,omitempty"`
 	Timestamp time.Time          `json:"timestamp"`
 	Prices    map[string]float64
 	Total     float64
 }
 
+// Available is the amount of asset that isn't reserved by an open order
+func (b *Balance) Available(asset string) float64 {
+	return b.Balances[asset] - b.Reserved[asset]
+}
+
+// Reserve locks amount of asset for an open order, returning false if that
+// much isn't available
+func (b *Balance) Reserve(asset string, amount float64) bool {
+	if amount < 0 || b.Available(asset) < amount {
+		return false
+	}
+	if b.Reserved == nil {
+		b.Reserved = make(map[string]float64)
+	}
+	b.Reserved[asset] = b.Reserved[asset] + amount
+	return true
+}
+
+// Release unlocks amount of asset once its order is executed or removed. Orders
+// placed before reservations existed never reserved anything, so no more than
+// is reserved is released.
+func (b *Balance) Release(asset string, amount float64) {
+	left := b.Reserved[asset] - amount
+	if left <= 0.0000009 {
+		delete(b.Reserved, asset)
+		return
+	}
+	b.Reserved[asset] = left
+}
+
 // Total calculates the total prices given that the prices
 func (b *Balance) CalcTotal() (float64, error) {
 	var total float64
@@ -51,7 +84,7 @@ func (b *Balance) CalcTotal() (float64, error) {
 }
 
 // Clean deletes coins that are too small to matter
-func (b *Balance) Clean(sesh *Sesh) {
+func (b *Balance) Clean(sesh Store) {
 	for coin, bal := range b.Balances {
 		if bal < 0.0000009 {
 			delete(b.Balances, coin)
@@ -66,42 +99,35 @@ func (b *Balance) Clean(sesh *Sesh) {
 }
 
 func (b *Balance) Update(asset string, amount float64) bool {
-	amm, has := b.Balances[asset]
+	_, has := b.Balances[asset]
 	if !has {
 		if amount < 0 {
 			return false
 		}
-		b.Balances[asset] = amm
+		b.Balances[asset] = amount
 		return true
 	}
 	b.Balances[asset] = b.Balances[asset] + amount
 	return true
 }
 
-// LookupPrices searches for the most recent prices for each asset in b.Balances
-func (b *Balance) LookupPrices(sesh *Sesh) error {
-	const query = `
-	for s in fulltext(stamps, "symbol", "%s")
-		sort s._key desc
-		limit 1
-		return s.price
-	`
-	b.Prices = make(map[string]float64)
+// LookupPrices fetches the price of every asset in b.Balances from prices
+func (b *Balance) LookupPrices(prices PriceOracle) error {
+	var coins []string
 	for coin := range b.Balances {
-		// fetch the latest price for the coin
-		var price float64
-		err := sesh.Execute(fmt.Sprintf(query, coin), &price)
-		if err != nil {
-			log.Println("failure to get price for", coin, b.User, err)
-			return errors.Wrap(err, "failure to lookup prices")
-		}
-		b.Prices[coin] = price
+		coins = append(coins, coin)
+	}
+	found, err := prices.Prices(coins...)
+	if err != nil {
+		log.Println("failure to get prices for", b.User, err)
+		return errors.Wrap(err, "failure to lookup prices")
 	}
+	b.Prices = found
 	return nil
 }
 
 func renderFloat(x float64) string {
-	return fmt.Sprintf("%.3f")
+	return fmt.Sprintf("%.3f", x)
 }
 
 // Render returns a formatted string that descibes the state of the balance
@@ -124,8 +150,8 @@ func (b *Balance) Render() string {
 	return buf.String()
 }
 
-func UpdateBalance(sesh *Sesh, user, asset string, amount float64) error {
-	bal, err := LatestBalance(sesh, user)
+func UpdateBalance(sesh Store, user, asset string, amount float64) error {
+	bal, err := sesh.LatestBalance(user)
 	if err != nil {
 		return errors.Wrap(err, "failure to update balance")
 	}
@@ -142,7 +168,7 @@ func UpdateBalance(sesh *Sesh, user, asset string, amount float64) error {
 }
 
 const balanceTempl = `@{{.User}}{{ range $asset, $bal := .Balances}}
-{{with $b := $bal}}{{printf "%.3f" $b}}{{end}}	{{$asset}}	${{ index $.Prices $asset}}{{end}}
+{{with $b := $bal}}{{printf "%.3f" $b}}{{end}}	{{$asset}}	${{ index $.Prices $asset}}{{with $r := index $.Reserved $asset}}	{{printf "%.3f" ($.Available $asset)}} available	{{printf "%.3f" $r}} reserved{{end}}{{end}}
 TOTAL	${{.Total}}`
 
 // Trade represents a pending or successful trade. Trades become successful after
@@ -171,4 +197,8 @@ type Stamp struct {
 	Price             float64   `json:"price"`
 	Volume            float64   `json:"volume24"`
 	Time              time.Time `json:"time"`
+	// Bid and Ask are the best prices that the asset can be sold and bought
+	// at, if the source provides them
+	Bid float64 `json:"bid,omitempty"`
+	Ask float64 `json:"ask,omitempty"`
 }
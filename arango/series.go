@@ -0,0 +1,178 @@
+package arango
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Candle summarizes the price of an asset over an interval. Candles are also
+// stored in the candles collection when old stamps are compacted.
+type Candle struct {
+	Key    string `json:"_key,omitempty"`
+	Symbol string `json:"symbol,omitempty"`
+	// Span is the length of a stored candle, like 1h or 1d
+	Span  string    `json:"span,omitempty"`
+	Start time.Time `json:"start"`
+	// First and Last are when the first and last prices in the candle were
+	// recorded, so that candles can be merged in any order
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Open  float64   `json:"open"`
+	High  float64   `json:"high"`
+	Low   float64   `json:"low"`
+	Close float64   `json:"close"`
+}
+
+// CandleKey is the key that the candle of symbol that is span long and starts
+// at start is stored under
+func CandleKey(symbol, span string, start time.Time) string {
+	return fmt.Sprintf("%s_%s_%d", symbol, span, start.Unix())
+}
+
+// Change is the fraction the price moved from the open to the close
+func (c *Candle) Change() float64 {
+	if c.Open == 0 {
+		return 0
+	}
+	return (c.Close - c.Open) / c.Open
+}
+
+// Merge folds o into c. The open and close are taken from whichever candle has
+// the earliest and latest prices, so candles can be merged in any order.
+func (c *Candle) Merge(o *Candle) {
+	if o.First.Before(c.First) {
+		c.First = o.First
+		c.Open = o.Open
+	}
+	if !o.Last.Before(c.Last) {
+		c.Last = o.Last
+		c.Close = o.Close
+	}
+	if o.High > c.High {
+		c.High = o.High
+	}
+	if o.Low < c.Low {
+		c.Low = o.Low
+	}
+}
+
+// Sampler downsamples stamps and candles into candles that are interval long,
+// the first one starting at start
+type Sampler struct {
+	start    time.Time
+	interval time.Duration
+	buckets  map[int64]*Candle
+}
+
+// NewSampler creates a Sampler for candles that are interval long, the first
+// one starting at start
+func NewSampler(start time.Time, interval time.Duration) (*Sampler, error) {
+	if interval <= 0 {
+		return nil, errors.Errorf("invalid candle interval %s", interval)
+	}
+	return &Sampler{
+		start:    start,
+		interval: interval,
+		buckets:  make(map[int64]*Candle),
+	}, nil
+}
+
+// AddStamp adds the price of s. Stamps without a price, or from before the
+// first candle, are ignored.
+func (sm *Sampler) AddStamp(s *Stamp) {
+	if s.Price <= 0 {
+		return
+	}
+	sm.AddCandle(&Candle{
+		First: s.Time,
+		Last:  s.Time,
+		Open:  s.Price,
+		High:  s.Price,
+		Low:   s.Price,
+		Close: s.Price,
+	})
+}
+
+// AddCandle folds c into the candle covering the time of its first price
+func (sm *Sampler) AddCandle(c *Candle) {
+	if c.First.Before(sm.start) {
+		return
+	}
+	i := int64(c.First.Sub(sm.start) / sm.interval)
+	curr, has := sm.buckets[i]
+	if !has {
+		bucket := *c
+		bucket.Key = ""
+		bucket.Span = ""
+		bucket.Start = sm.start.Add(time.Duration(i) * sm.interval)
+		sm.buckets[i] = &bucket
+		return
+	}
+	curr.Merge(c)
+}
+
+// Candles returns the candles made so far, oldest first. Intervals without
+// any prices are left out.
+func (sm *Sampler) Candles() []*Candle {
+	out := make([]*Candle, 0, len(sm.buckets))
+	for _, c := range sm.buckets {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Start.Before(out[j].Start)
+	})
+	return out
+}
+
+// PriceHistory fetches the prices of symbol recorded from start up to end,
+// both compacted and not, and downsamples them into candles that are interval
+// long
+func PriceHistory(sesh Store, symbol string, start, end time.Time, interval time.Duration) ([]*Candle, error) {
+	const errMsg = "failure to fetch price history"
+	symbol = strings.ToUpper(symbol)
+	sm, err := NewSampler(start, interval)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	// compacted history
+	iter, err := sesh.Iter("candles", Match{"symbol": symbol})
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	defer iter.Close()
+	for {
+		var c Candle
+		more, err := iter.Next(&c)
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		if !more {
+			break
+		}
+		if c.First.Before(end) {
+			sm.AddCandle(&c)
+		}
+	}
+	// recent history
+	stamps, err := sesh.StampSeries(symbol, start, end)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	defer stamps.Close()
+	for {
+		var s Stamp
+		more, err := stamps.Next(&s)
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		if !more {
+			break
+		}
+		sm.AddStamp(&s)
+	}
+	return sm.Candles(), nil
+}
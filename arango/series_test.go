@@ -0,0 +1,51 @@
+package arango
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriceHistory(t *testing.T) {
+	m := NewMem()
+	start := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	prices := []float64{10, 12, 9, 11, 20, 0, 18}
+	for i, price := range prices {
+		err := m.CreateDoc("stamps", Stamp{Symbol: "ETH", Price: price, Cap: 1, Time: start.Add(time.Minute * 15 * time.Duration(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// another asset and a stamp outside of the range
+	err := m.CreateDoc("stamps", Stamp{Symbol: "BTC", Price: 11000, Cap: 1, Time: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateDoc("stamps", Stamp{Symbol: "ETH", Price: 1000, Cap: 1, Time: start.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candles, err := PriceHistory(m, "eth", start, start.Add(time.Hour*2), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 2 {
+		t.Fatalf("expected 2 candles, got %d", len(candles))
+	}
+	first, second := candles[0], candles[1]
+	if !first.Start.Equal(start) || first.Open != 10 || first.High != 12 || first.Low != 9 || first.Close != 11 {
+		t.Errorf("unexpected first candle %+v", first)
+	}
+	// the zero price is skipped
+	if !second.Start.Equal(start.Add(time.Hour)) || second.Open != 20 || second.Low != 18 || second.Close != 18 {
+		t.Errorf("unexpected second candle %+v", second)
+	}
+	if second.Change() != -0.1 {
+		t.Error("expected a change of -0.1, got", second.Change())
+	}
+
+	_, err = PriceHistory(m, "eth", start, start.Add(time.Hour), 0)
+	if err == nil {
+		t.Error("expected a zero interval to fail")
+	}
+}
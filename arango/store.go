@@ -0,0 +1,98 @@
+package arango
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/evan-forbes/chip/config"
+)
+
+// Store describes everything chip needs from its database. Sesh implements it
+// on top of arangodb, and Mem implements it in process memory so that chip can
+// run locally and in tests without any infrastructure.
+type Store interface {
+	// CreateDoc inserts data into the collection col
+	CreateDoc(col string, data interface{}) error
+	// CreateDocs inserts every element of the slice data into col at once
+	CreateDocs(col string, data interface{}) error
+	// Update merges data into the document stored under key in col
+	Update(col, key string, data interface{}) error
+	// RemoveDoc deletes the document stored under key in col
+	RemoveDoc(col, key string) error
+	// Find scans every document in col whose top level fields equal those in
+	// match into out, which must be a pointer to a slice. Documents are
+	// returned newest first by insertion, callers that need them in time
+	// order sort them by time.
+	Find(col string, match Match, out interface{}) error
+	// Iter streams every document in col whose top level fields equal those in
+	// match, oldest first. The caller must Close the returned Iterator.
+	Iter(col string, match Match) (Iterator, error)
+
+	// Symbols are matched exactly, so callers upper case what users type.
+
+	// LatestBalance fetches the most recent balance of user
+	LatestBalance(user string) (*Balance, error)
+	// LatestPrice fetches the most recent usd price of symbol
+	LatestPrice(symbol string) (float64, error)
+	// LatestPrices fetches the most recent stamp of each of symbols at once,
+	// keyed by the symbol as given. Symbols without a stamp are left out.
+	LatestPrices(symbols []string) (map[string]*Stamp, error)
+	// StampSeries streams the stamps of symbol recorded from start up to end,
+	// oldest first. The caller must Close the returned Iterator.
+	StampSeries(symbol string, start, end time.Time) (Iterator, error)
+	// Valuations streams the valuations of user recorded from start up to end,
+	// oldest first. The caller must Close the returned Iterator.
+	Valuations(user string, start, end time.Time) (Iterator, error)
+	// AssetExists checks that symbol is a tracked asset with a market cap
+	AssetExists(symbol string) (bool, error)
+	// UserChanID fetches the channel used to notify user
+	UserChanID(user string) (string, error)
+	// AllUsers lists the names of every registered user
+	AllUsers() ([]string, error)
+
+	// ExportStamps fetches the oldest incr stamps recorded before before,
+	// oldest first, along with their keys
+	ExportStamps(before time.Time, incr int) ([]*Stamp, []string, error)
+	// RemoveStamps deletes the stamps stored under keys
+	RemoveStamps(keys []string) error
+	// CountStamps counts the stamps currently stored
+	CountStamps() (int, error)
+
+	// Atomic runs fn inside of a transaction that may write to the collections
+	// in write. Either everything fn writes through tx is kept, or, if fn
+	// returns an error, none of it is. fn must only write through tx, not the
+	// Store it was called on, which keeps seeing the state from before the
+	// transaction.
+	Atomic(write []string, fn func(tx Store) error) error
+}
+
+// Match holds the field values a document must have to be returned by Find
+type Match map[string]interface{}
+
+var (
+	memOnce sync.Once
+	memErr  error
+	mem     *Mem
+)
+
+// Open connects to the store selected by cfg. The memory store is shared by
+// the whole process, and is opened using the first cfg it is asked for.
+func Open(ctx context.Context, cfg *config.Config) (Store, error) {
+	if cfg.Store != "memory" {
+		sesh, err := NewSesh(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return sesh, nil
+	}
+	memOnce.Do(func() {
+		mem, memErr = OpenMem(cfg.StorePath)
+	})
+	return mem, memErr
+}
+
+var (
+	_ Store = (*Sesh)(nil)
+	_ Store = (*Mem)(nil)
+)
@@ -0,0 +1,75 @@
+package award
+
+import (
+	"fmt"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const HistoryUsageText = `
+// show the winners of the last 5 rounds
+!chip award history
+
+// show the last 10 rounds
+!chip award history -n 10
+
+// Note: every user's balance plus open positions are valued at the start and end
+// of each round, and the best percentage return wins
+`
+
+// HistoryFlags returns the flags for the award history command
+func HistoryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "number",
+			Aliases: []string{"n"},
+			Value:   5,
+			Usage:   "how many of the latest rounds to show",
+		},
+	}
+}
+
+// History shows the results of the latest finished rounds, and when the
+// current one ends
+func History(ctx *cli.Context) error {
+	const errMsg = "failure to show award history"
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	rounds, err := Finished(sesh, ctx.Int("number"))
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	curr, err := Current(sesh)
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if curr != nil {
+		ctx.Println(fmt.Sprintf("the current round ends %s", curr.End.Format("2006-01-02 15:04 MST")))
+	}
+	if len(rounds) == 0 {
+		ctx.Println("meat bag, no rounds have finished yet")
+		return nil
+	}
+	for _, r := range rounds {
+		ctx.Println(r.Render())
+	}
+	return nil
+}
+
+// Finished fetches up to n of the latest finished rounds, newest first
+func Finished(sesh arango.Store, n int) ([]*Round, error) {
+	var rounds []*Round
+	err := sesh.Find("awards", arango.Match{"open": false}, &rounds)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch finished rounds")
+	}
+	if n > 0 && len(rounds) > n {
+		rounds = rounds[:n]
+	}
+	return rounds, nil
+}
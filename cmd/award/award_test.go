@@ -0,0 +1,102 @@
+package award
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+)
+
+func setPrices(t *testing.T, m *arango.Mem, prices map[string]float64) {
+	for symbol, price := range prices {
+		err := m.CreateDoc("stamps", arango.Stamp{Symbol: symbol, Price: price, Cap: 1, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRounds(t *testing.T) {
+	m := arango.NewMem()
+	setPrices(t, m, map[string]float64{"USDC": 1, "ETH": 200})
+	balances := map[string]map[string]float64{
+		"zkFART": {"USDC": 1000},
+		"degen":  {"USDC": 500, "ETH": 2.5},
+		// users without a balance aren't part of the round
+		"lurker": nil,
+	}
+	for user, bal := range balances {
+		err := m.CreateDoc("users", map[string]string{"_key": user, "channel_id": "local"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bal == nil {
+			continue
+		}
+		err = m.CreateDoc("balances", arango.Balance{User: user, Balances: bal})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a levered position counts towards its owner's worth
+	err := m.CreateDoc("positions", trade.Position{
+		Limit: trade.Limit{
+			Key: "1", User: "zkFART", Sell: "USDC", Buy: "ETH", Collat: "USDC",
+			SellAmount: 100, CollAmount: 100, BuyAmount: 0.5, Price: 200, Leverage: 1, Long: true,
+		},
+		Alive: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = Tick(nil, m, arango.NewSnapshot(m), time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	round, err := Current(m)
+	if err != nil || round == nil {
+		t.Fatal("expected a round to start", err)
+	}
+	if len(round.Starts) != 2 || round.Starts["zkFART"] != 1100 || round.Starts["degen"] != 1000 {
+		t.Fatal("unexpected starting worths", round.Starts)
+	}
+
+	// nothing happens until the round is over
+	setPrices(t, m, map[string]float64{"ETH": 300})
+	err = Tick(nil, m, arango.NewSnapshot(m), time.Hour, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rounds, err := Finished(m, 0)
+	if err != nil || len(rounds) != 0 {
+		t.Fatal("expected no finished rounds", rounds, err)
+	}
+
+	err = Tick(nil, m, arango.NewSnapshot(m), time.Hour, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rounds, err = Finished(m, 0)
+	if err != nil || len(rounds) != 1 {
+		t.Fatal("expected the round to finish", rounds, err)
+	}
+	res := rounds[0].Results
+	if len(res) != 2 || res[0].User != "degen" || res[0].Place != 1 || math.Abs(res[0].Return-0.25) > 1e-9 {
+		t.Fatal("expected degen to win with 25%", res)
+	}
+	if res[1].User != "zkFART" || math.Abs(res[1].End-1150) > 1e-9 {
+		t.Error("expected zkFART's position to be valued", res[1])
+	}
+	if !strings.Contains(rounds[0].Render(), "+25.00%") {
+		t.Error("expected the return in the results", rounds[0].Render())
+	}
+	next, err := Current(m)
+	if err != nil || next == nil || next.Key == round.Key || next.Starts["degen"] != 1250 {
+		t.Error("expected the next round to start at the new worths", next, err)
+	}
+}
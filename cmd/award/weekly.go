@@ -1 +1,209 @@
 package award
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/folio"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2/disc"
+)
+
+// Interval is how often the tick that runs rounds is scheduled, matching the
+// "*/15 * * * *" cron schedule in main
+const Interval = 15 * time.Minute
+
+// Round is a competition between every user with a balance, won by the best
+// percentage return. Each user's worth, their balance plus their open
+// positions, is recorded when the round starts and again when it ends.
+type Round struct {
+	Key   string    `json:"_key,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Open is true until the round has been finished
+	Open bool `json:"open"`
+	// Starts is the worth of each user in USD when the round started
+	Starts map[string]float64 `json:"starts"`
+	// Results are sorted by return, best first
+	Results []Result `json:"results,omitempty"`
+}
+
+// Result is how a user did over a round
+type Result struct {
+	User  string  `json:"user"`
+	Place int     `json:"place"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// Return is the change in worth as a fraction of the starting worth
+	Return float64 `json:"return"`
+}
+
+// Current fetches the round that hasn't been finished yet, or nil if there is
+// none
+func Current(sesh arango.Store) (*Round, error) {
+	var open []*Round
+	err := sesh.Find("awards", arango.Match{"open": true}, &open)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch current round")
+	}
+	if len(open) == 0 {
+		return nil, nil
+	}
+	return open[0], nil
+}
+
+// Tick starts a round if none is running, or finishes the current round once
+// it is over, announcing the winners and starting the next one. Rounds last
+// length. A round isn't started or finished with a bad price, so that every
+// user is valued fairly, and is tried again next tick instead.
+func Tick(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle, length time.Duration, now time.Time) error {
+	const errMsg = "failure to update award round"
+	round, err := Current(sesh)
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if round != nil && now.Before(round.End) {
+		return nil
+	}
+	worths, err := Worths(sesh, prices)
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	// truncated to the tick so that rounds line up with the schedule and are
+	// over by the tick length after now
+	start := now.Truncate(Interval)
+	next := &Round{
+		Start:  start,
+		End:    start.Add(length),
+		Open:   true,
+		Starts: worths,
+	}
+	err = sesh.Atomic([]string{"awards"}, func(tx arango.Store) error {
+		if round != nil {
+			round.Finish(worths)
+			err := tx.Update("awards", round.Key, round)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.CreateDoc("awards", next)
+	})
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if round != nil {
+		announce(srv, sesh, round)
+	}
+	return nil
+}
+
+// Worths values every user with a balance in USD. Users whose worth can't be
+// found are left out, but a bad price fails the whole valuation.
+func Worths(sesh arango.Store, prices arango.PriceOracle) (map[string]float64, error) {
+	users, err := sesh.AllUsers()
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch users")
+	}
+	out := make(map[string]float64, len(users))
+	for _, user := range users {
+		worth, err := folio.Worth(sesh, prices, user)
+		if arango.IsBadPrice(err) {
+			return nil, err
+		}
+		if err != nil {
+			log.Println("leaving user out of the round", user, err)
+			continue
+		}
+		out[user] = worth
+	}
+	return out, nil
+}
+
+// Finish closes the round, ranking every user that was in it from the start
+// by the return of their worth ends
+func (r *Round) Finish(ends map[string]float64) {
+	r.Open = false
+	r.Results = nil
+	for user, start := range r.Starts {
+		end, has := ends[user]
+		if !has || start <= 0 {
+			continue
+		}
+		r.Results = append(r.Results, Result{
+			User:   user,
+			Start:  start,
+			End:    end,
+			Return: end/start - 1,
+		})
+	}
+	sort.Slice(r.Results, func(i, j int) bool {
+		if r.Results[i].Return == r.Results[j].Return {
+			return r.Results[i].User < r.Results[j].User
+		}
+		return r.Results[i].Return > r.Results[j].Return
+	})
+	for i := range r.Results {
+		r.Results[i].Place = i + 1
+	}
+}
+
+// Winner returns the best result of a finished round, or nil if nobody took
+// part
+func (r *Round) Winner() *Result {
+	if len(r.Results) == 0 {
+		return nil
+	}
+	return &r.Results[0]
+}
+
+// Render returns a formatted string that describes the results of the round
+func (r *Round) Render() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "round from %s to %s\n", r.Start.Format("2006-01-02"), r.End.Format("2006-01-02"))
+	if len(r.Results) == 0 {
+		buf.WriteString("nobody took part\n")
+		return buf.String()
+	}
+	twr := tabwriter.NewWriter(&buf, 1, 4, 8, ' ', 0)
+	for _, res := range r.Results {
+		fmt.Fprintf(twr, "- %d )\t%s\t%+.2f%%\t$%.2f -> $%.2f\n", res.Place, res.User, res.Return*100, res.Start, res.End)
+	}
+	err := twr.Flush()
+	if err != nil {
+		fmt.Println("failure to render round", err)
+	}
+	return buf.String()
+}
+
+// announce sends the results of a finished round to every user's channel
+func announce(srv *disc.Server, sesh arango.Store, r *Round) {
+	if srv == nil {
+		return
+	}
+	msg := "meat bags, the round is over!\n" + r.Render()
+	if win := r.Winner(); win != nil {
+		msg = fmt.Sprintf(":trophy: %s wins the round with a %+.2f%% return, the next round has already begun meat bags\n%s", win.User, win.Return*100, r.Render())
+	}
+	users, err := sesh.AllUsers()
+	if err != nil {
+		log.Println("failure to announce round", err)
+		return
+	}
+	sent := make(map[string]bool)
+	for _, user := range users {
+		id, err := sesh.UserChanID(user)
+		if err != nil || id == "" || sent[id] {
+			continue
+		}
+		sent[id] = true
+		err = srv.Message(id, msg)
+		if err != nil {
+			log.Println("failure to announce round to", user, err)
+		}
+	}
+}
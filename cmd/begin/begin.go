@@ -1,11 +1,11 @@
 package begin
 
 import (
-	"fmt"
 	"os"
 	"time"
 
 	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -22,24 +22,16 @@ func Begin(ctx *cli.Context) error {
 		return nil
 	}
 	// see if they already exist
-	sesh, err := arango.NewSesh(ctx.Context, "cookie")
+	sesh, err := arango.Open(ctx.Context, config.Current())
 	if err != nil {
 		return errors.Wrap(err, "failure to begin")
 	}
-	const query = `
-	let out = (
-		for u in users
-			filter u._key == "%s"
-			return u
-	)
-	return length(out)
-	`
-	var already int
-	err = sesh.Execute(fmt.Sprintf(query, user), &already)
+	var already []User
+	err = sesh.Find("users", arango.Match{"_key": user}, &already)
 	if err != nil {
 		return errors.Wrap(err, "failure to begin")
 	}
-	if already > 0 {
+	if len(already) > 0 {
 		ctx.Println("you have already begun your journey with chip")
 		return nil
 	}
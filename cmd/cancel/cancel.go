@@ -0,0 +1,176 @@
+package cancel
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/orders"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// I want to select an order and cancel it
+!chip cancel
+- 1 )   limit   2x long   ETH   USDC   @ 400.000   Size: 1000 USDC   key: 1234
+- 2 )   market  trade     BTC   ETH    @ market    Size: 5 ETH       key: 1240
+// I input just the number '1' and order 1 gets cancelled
+
+OR
+
+// cancel order 2
+!chip cancel -o 2
+
+// cancel the order with key 1240
+!chip cancel -k 1240
+
+// cancel all of my orders
+!chip cancel -a
+
+// Note: cancelling one of a stop and take-profit pair cancels both
+`
+
+// Flags returns the flags for the cancel command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "order",
+			Aliases: []string{"o"},
+			Value:   0,
+			Usage:   "select which order to cancel",
+		},
+		&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "select the order to cancel by its key",
+		},
+		&cli.BoolFlag{
+			Name:    "all",
+			Aliases: []string{"a"},
+			Value:   false,
+			Usage:   "cancel all of your orders",
+		},
+	}
+}
+
+// Cancel removes one or all of the user's orders before they get executed
+func Cancel(ctx *cli.Context) error {
+	// detected user
+	user, valid := posts.DetectUser(ctx)
+	if !valid {
+		ctx.Println("no user detected, set CHIP_USERNAME")
+		return nil
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch open orders")
+	}
+	// orders selected by key don't need to be listed
+	if key := ctx.String("key"); key != "" {
+		o, err := orders.ByKey(sesh, key)
+		if err != nil {
+			return errors.Wrap(err, "failure to cancel order")
+		}
+		if o == nil {
+			ctx.Println(fmt.Sprintf("meat bag, there is no open order with key %s", key))
+			return nil
+		}
+		return cancel(ctx, sesh, user, o)
+	}
+	ords, err := orders.Open(sesh, user)
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch open orders")
+	}
+	if len(ords) == 0 {
+		ctx.Println("beloved meat bag, you do not have any open orders")
+		return nil
+	}
+	if ctx.Bool("all") {
+		msgs, err := cancelAll(sesh, user, ords)
+		for _, msg := range msgs {
+			ctx.Println(msg)
+		}
+		return err
+	}
+	o, err := ensureInput(ctx, ords)
+	if err != nil {
+		return errors.Wrap(err, "failure to cancel order")
+	}
+	if o == nil {
+		return nil
+	}
+	return cancel(ctx, sesh, user, o)
+}
+
+// cancel removes o, as long as it belongs to user, and says what happened
+func cancel(ctx *cli.Context, sesh arango.Store, user string, o *trade.Limit) error {
+	msg, err := cancelOrder(sesh, user, o)
+	ctx.Println(msg)
+	return err
+}
+
+// cancelOrder removes o, as long as it belongs to user, and describes what
+// happened to it
+func cancelOrder(sesh arango.Store, user string, o *trade.Limit) (string, error) {
+	if o.User != user {
+		return fmt.Sprintf("meat bag, order %s is not yours to cancel", o.Key), nil
+	}
+	err := o.Cancel(sesh)
+	if err != nil {
+		// it might have been executed in the meantime
+		return fmt.Sprintf("could not cancel order %s, it may have already been executed", o.Key), err
+	}
+	if o.Group != "" {
+		return fmt.Sprintf("order %s and the orders grouped with it have been cancelled", o.Key), nil
+	}
+	return fmt.Sprintf("order %s has been cancelled", o.Key), nil
+}
+
+// cancelAll cancels every one of ords, stopping at the first that fails.
+// Cancelling an order cancels the rest of its group, so each group is only
+// cancelled once.
+func cancelAll(sesh arango.Store, user string, ords []*trade.Limit) ([]string, error) {
+	var msgs []string
+	groups := make(map[string]bool)
+	for _, o := range ords {
+		if o.Group != "" && groups[o.Group] {
+			continue
+		}
+		groups[o.Group] = true
+		msg, err := cancelOrder(sesh, user, o)
+		msgs = append(msgs, msg)
+		if err != nil {
+			return msgs, err
+		}
+	}
+	return msgs, nil
+}
+
+func ensureInput(ctx *cli.Context, ords []*trade.Limit) (*trade.Limit, error) {
+	i := ctx.Int("order")
+	if i > 0 && i <= len(ords) {
+		return ords[i-1], nil
+	}
+	// show the orders and ask for input
+	ctx.Println(orders.Render(ords))
+	rawinput, err := ctx.Input("please select an order (enter a number)")
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to cancel order: no input")
+	}
+	input, err := strconv.ParseInt(rawinput, 10, 64)
+	if err != nil {
+		ctx.Println(fmt.Sprintf("aborting: could not parse input: %s, please enter a number next time", rawinput))
+		return nil, nil
+	}
+	i = int(input)
+	if i > 0 && i <= len(ords) {
+		return ords[i-1], nil
+	}
+	ctx.Println("aborting: invalid selection, please select an order number")
+	return nil, nil
+}
@@ -0,0 +1,127 @@
+package cancel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/orders"
+	"github.com/evan-forbes/chip/cmd/trade"
+)
+
+// testStore has zkFART holding usdc and eth, with a limit order buying eth and
+// a stop and take-profit pair selling it
+func testStore(t *testing.T) *arango.Mem {
+	m := arango.NewMem()
+	for symbol, price := range map[string]float64{"USDC": 1, "ETH": 400} {
+		err := m.CreateDoc("stamps", arango.Stamp{Symbol: symbol, Price: price, Cap: 1, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, user := range []string{"zkFART", "boo"} {
+		err := m.CreateDoc("users", map[string]string{"_key": user, "channel_id": "local"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.CreateDoc("balances", arango.Balance{User: user, Balances: map[string]float64{"USDC": 1000, "ETH": 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lim := &trade.Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 600, CollAmount: 600, Price: 100}
+	placed, err := lim.Place(m)
+	if err != nil || !placed {
+		t.Fatal("expected the limit order to be placed", err)
+	}
+	base := trade.Limit{Sell: "ETH", Buy: "USDC", Collat: "ETH", User: "zkFART", SellAmount: 5, CollAmount: 5}
+	placed, err = trade.PlaceGroup(m, trade.Protect(base, 300, 0, 500)...)
+	if err != nil || !placed {
+		t.Fatal("expected the stop and take-profit to be placed", err)
+	}
+	return m
+}
+
+// open returns the open orders of zkFART
+func open(t *testing.T, m *arango.Mem) []*trade.Limit {
+	ords, err := orders.Open(m, "zkFART")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ords) != 3 {
+		t.Fatal("expected 3 open orders, got", len(ords))
+	}
+	return ords
+}
+
+func TestCancel(t *testing.T) {
+	m := testStore(t)
+	ords := open(t, m)
+	var lim, stop *trade.Limit
+	for _, o := range ords {
+		switch o.Type {
+		case trade.Stop:
+			stop = o
+		case trade.TakeProfit:
+		default:
+			lim = o
+		}
+	}
+
+	// nobody else can cancel an order
+	msg, err := cancelOrder(m, "boo", lim)
+	if err != nil || !strings.Contains(msg, "not yours") {
+		t.Error("expected boo to be refused", msg, err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Reserved["USDC"] != 600 {
+		t.Error("expected the order to stay reserved", bal.Reserved)
+	}
+
+	// cancelling releases the reservation
+	msg, err = cancelOrder(m, "zkFART", lim)
+	if err != nil || !strings.Contains(msg, "has been cancelled") {
+		t.Fatal("expected the order to be cancelled", msg, err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	if bal.Available("USDC") != 1000 || bal.Reserved["ETH"] != 5 {
+		t.Error("expected only the usdc to be released", bal.Reserved)
+	}
+	msg, err = cancelOrder(m, "zkFART", lim)
+	if err == nil || !strings.Contains(msg, "could not cancel") {
+		t.Error("expected cancelling twice to fail", msg)
+	}
+
+	// cancelling the stop cancels the take-profit with it
+	msg, err = cancelOrder(m, "zkFART", stop)
+	if err != nil || !strings.Contains(msg, "grouped with it") {
+		t.Fatal("expected the group to be cancelled", msg, err)
+	}
+	left, _ := orders.Open(m, "zkFART")
+	bal, _ = m.LatestBalance("zkFART")
+	if len(left) != 0 || len(bal.Reserved) != 0 {
+		t.Error("expected no orders or reservations left", left, bal.Reserved)
+	}
+}
+
+func TestCancelAll(t *testing.T) {
+	m := testStore(t)
+	msgs, err := cancelAll(m, "zkFART", open(t, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the group is cancelled once, not once for each of its orders
+	if len(msgs) != 2 {
+		t.Error("expected the limit order and the group to be cancelled, got", msgs)
+	}
+	left, _ := orders.Open(m, "zkFART")
+	bal, _ := m.LatestBalance("zkFART")
+	if len(left) != 0 || len(bal.Reserved) != 0 {
+		t.Error("expected no orders or reservations left", left, bal.Reserved)
+	}
+	bal, _ = m.LatestBalance("boo")
+	if bal.Balances["USDC"] != 1000 || len(bal.Reserved) != 0 {
+		t.Error("expected boo's balance to be untouched", bal.Balances, bal.Reserved)
+	}
+}
@@ -0,0 +1,263 @@
+package chart
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// see how eth did over the last week
+!chip chart -s eth -r 7d
+
+// see the last day of btc as candles
+!chip chart -s btc -r 24h -c
+
+// see a month of link in 12 hour candles
+!chip chart -s link -r 30d -i 12h -c
+`
+
+// Width is the most columns a chart uses, which keeps it readable in a discord
+// message
+const Width = 40
+
+// Height is the number of rows in a candle chart
+const Height = 10
+
+// minInterval matches how often prices are ingested, there is no point in
+// smaller candles
+const minInterval = time.Minute * 15
+
+// Flags returns the flags for the chart command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "symbol",
+			Aliases: []string{"s"},
+			Value:   "",
+			Usage:   "specify the asset to chart",
+		},
+		&cli.StringFlag{
+			Name:    "range",
+			Aliases: []string{"r"},
+			Value:   "7d",
+			Usage:   "how far back to chart, like 24h, 7d or 2w",
+		},
+		&cli.StringFlag{
+			Name:    "interval",
+			Aliases: []string{"i"},
+			Value:   "",
+			Usage:   "length of each candle (default fits the range into the chart)",
+		},
+		&cli.BoolFlag{
+			Name:    "candles",
+			Aliases: []string{"c"},
+			Value:   false,
+			Usage:   "draw candles instead of a sparkline",
+		},
+	}
+}
+
+// Chart renders the price history of an asset
+func Chart(ctx *cli.Context) error {
+	const errMsg = "failure to chart prices"
+	symbol := strings.ToUpper(ctx.String("symbol"))
+	if symbol == "" {
+		ctx.Println("meat bag, please specify the asset to chart with -s")
+		return nil
+	}
+	rng, err := ParseRange(ctx.String("range"))
+	if err != nil {
+		ctx.Println(fmt.Sprintf("meat bag, I don't understand the range %s, try something like 24h or 7d", ctx.String("range")))
+		return nil
+	}
+	interval := FitInterval(rng)
+	if raw := ctx.String("interval"); raw != "" {
+		interval, err = ParseRange(raw)
+		if err != nil {
+			ctx.Println(fmt.Sprintf("meat bag, I don't understand the interval %s, try something like 1h or 1d", raw))
+			return nil
+		}
+		interval = ClampInterval(rng, interval)
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	end := time.Now()
+	candles, err := arango.PriceHistory(sesh, symbol, end.Add(-rng), end, interval)
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if len(candles) == 0 {
+		ctx.Println(fmt.Sprintf("meat bag, I have no prices for %s over the last %s", symbol, ctx.String("range")))
+		return nil
+	}
+	if ctx.Bool("candles") {
+		ctx.Println(Render(symbol, ctx.String("range"), candles, RenderCandles(candles, Height)))
+		return nil
+	}
+	ctx.Println(Render(symbol, ctx.String("range"), candles, Sparkline(candles)))
+	return nil
+}
+
+// ParseRange parses a duration that can also be given in days (d) or weeks (w)
+func ParseRange(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(raw, "d"):
+		unit = time.Hour * 24
+	case strings.HasSuffix(raw, "w"):
+		unit = time.Hour * 24 * 7
+	}
+	var d time.Duration
+	if unit == 0 {
+		var err error
+		d, err = time.ParseDuration(raw)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		n, err := strconv.ParseFloat(raw[:len(raw)-1], 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid duration %s", raw)
+		}
+		d = time.Duration(n * float64(unit))
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid duration %s", raw)
+	}
+	return d, nil
+}
+
+// FitInterval picks the candle length that fits rng into Width columns
+func FitInterval(rng time.Duration) time.Duration {
+	interval := (rng + Width - 1) / Width
+	if interval < minInterval {
+		return minInterval
+	}
+	return interval
+}
+
+// ClampInterval keeps a requested candle length from being shorter than prices
+// are ingested or too short to fit rng into Width columns
+func ClampInterval(rng, interval time.Duration) time.Duration {
+	if fit := FitInterval(rng); interval < fit {
+		return fit
+	}
+	return interval
+}
+
+// Render wraps a chart with a summary of the candles so that it can be sent as
+// a discord message
+func Render(symbol, rng string, candles []*arango.Candle, chart string) string {
+	first, last := candles[0], candles[len(candles)-1]
+	high, low := bounds(candles)
+	change := 0.0
+	if first.Open != 0 {
+		change = (last.Close - first.Open) / first.Open * 100
+	}
+	return fmt.Sprintf(
+		"```\n%s  %s  $%s  %+.2f%%\nhigh $%s  low $%s\n%s\n```",
+		symbol,
+		rng,
+		renderPrice(last.Close),
+		change,
+		renderPrice(high),
+		renderPrice(low),
+		chart,
+	)
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline draws the close of each candle as a single character
+func Sparkline(candles []*arango.Candle) string {
+	var closes []float64
+	for _, c := range candles {
+		closes = append(closes, c.Close)
+	}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, c := range closes {
+		low = math.Min(low, c)
+		high = math.Max(high, c)
+	}
+	var out []rune
+	for _, c := range closes {
+		i := 0
+		if high > low {
+			i = int((c - low) / (high - low) * float64(len(sparks)-1))
+		}
+		out = append(out, sparks[i])
+	}
+	return string(out)
+}
+
+// RenderCandles draws each candle as a column, with rows rows. Rising candles
+// have solid bodies and falling candles have shaded ones.
+func RenderCandles(candles []*arango.Candle, rows int) string {
+	high, low := bounds(candles)
+	if high == low {
+		rows = 1
+	}
+	step := (high - low) / float64(rows)
+	lines := make([]string, rows)
+	for r := 0; r < rows; r++ {
+		// the price range covered by this row, top row first
+		top := high - step*float64(r)
+		bottom := top - step
+		var line []rune
+		for _, c := range candles {
+			bodyTop := math.Max(c.Open, c.Close)
+			bodyBottom := math.Min(c.Open, c.Close)
+			switch {
+			case step == 0 || overlaps(bodyBottom, bodyTop, bottom, top):
+				if c.Close >= c.Open {
+					line = append(line, '█')
+				} else {
+					line = append(line, '▒')
+				}
+			case overlaps(c.Low, c.High, bottom, top):
+				line = append(line, '│')
+			default:
+				line = append(line, ' ')
+			}
+		}
+		lines[r] = strings.TrimRight(string(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// overlaps checks if the price range lo-hi touches the row from bottom to top
+func overlaps(lo, hi, bottom, top float64) bool {
+	return lo <= top && hi >= bottom
+}
+
+func bounds(candles []*arango.Candle) (high, low float64) {
+	high, low = math.Inf(-1), math.Inf(1)
+	for _, c := range candles {
+		high = math.Max(high, c.High)
+		low = math.Min(low, c.Low)
+	}
+	return high, low
+}
+
+// renderPrice shows enough decimals for cheap coins to be readable
+func renderPrice(p float64) string {
+	switch {
+	case p >= 1:
+		return fmt.Sprintf("%.2f", p)
+	case p >= 0.01:
+		return fmt.Sprintf("%.4f", p)
+	default:
+		return fmt.Sprintf("%.8f", p)
+	}
+}
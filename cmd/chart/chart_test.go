@@ -0,0 +1,85 @@
+package chart
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want time.Duration
+	}{
+		{"7d", time.Hour * 24 * 7},
+		{"2w", time.Hour * 24 * 14},
+		{"24h", time.Hour * 24},
+		{"90m", time.Minute * 90},
+		{"1.5D", time.Hour * 36},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.raw)
+		if err != nil {
+			t.Error(tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.raw, tt.want, got)
+		}
+	}
+	for _, raw := range []string{"", "d", "-3d", "forever"} {
+		_, err := ParseRange(raw)
+		if err == nil {
+			t.Errorf("expected %q to fail", raw)
+		}
+	}
+}
+
+func TestClampInterval(t *testing.T) {
+	tests := []struct {
+		rng      time.Duration
+		interval time.Duration
+		want     time.Duration
+	}{
+		{time.Hour * 24, time.Hour, time.Hour},
+		{time.Hour * 6, time.Second, minInterval},
+		{time.Hour * 24, time.Minute * 30, time.Minute * 36},
+		{time.Hour * 24 * 30, time.Hour, time.Hour * 18},
+		{time.Hour * 24 * 30, time.Hour * 24, time.Hour * 24},
+	}
+	for _, tt := range tests {
+		got := ClampInterval(tt.rng, tt.interval)
+		if got != tt.want {
+			t.Errorf("%s over %s: expected %s, got %s", tt.interval, tt.rng, tt.want, got)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	candles := []*arango.Candle{
+		{Open: 100, High: 110, Low: 90, Close: 105},
+		{Open: 105, High: 130, Low: 100, Close: 125},
+		{Open: 125, High: 126, Low: 80, Close: 85},
+	}
+	spark := Sparkline(candles)
+	if spark != "▄█▁" {
+		t.Error("unexpected sparkline", spark)
+	}
+	chart := RenderCandles(candles, 5)
+	rows := strings.Split(chart, "\n")
+	if len(rows) != 5 {
+		t.Fatal("expected 5 rows, got", len(rows), chart)
+	}
+	// the falling candle spans from the top to the bottom
+	for _, row := range rows {
+		if len([]rune(row)) != 3 {
+			t.Errorf("expected every row to reach the last candle: %q", row)
+		}
+	}
+	ren := Render("ETH", "7d", candles, spark)
+	if !strings.Contains(ren, "ETH  7d  $85.00  -15.00%") || !strings.Contains(ren, "high $130.00  low $80.00") {
+		t.Error("unexpected render", ren)
+	}
+}
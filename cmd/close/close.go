@@ -2,11 +2,12 @@ package close
 
 import (
 	"fmt"
-	"strconv"
+	"math"
 
 	"github.com/evan-forbes/chip/arango"
 	"github.com/evan-forbes/chip/cmd/posts"
 	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -25,6 +26,15 @@ OR
 
 // close position 1 if it reaches $25,000 in value
 !chip close -p 1 -l 25000
+
+// close position 1 if it falls 10% from its highest value
+!chip close -p 1 --trail 10%
+
+// close position 1 if it falls $500 from its highest value
+!chip close -p 1 -t 500
+
+// close half of position 2, the rest stays open
+!chip close -p 2 --fraction 0.5
 `
 
 // Flags returns the flags for the close command
@@ -48,6 +58,18 @@ func Flags() []cli.Flag {
 			Value:   0,
 			Usage:   "set the lower value in USD in which the position should close",
 		},
+		&cli.StringFlag{
+			Name:    "trail",
+			Aliases: []string{"t"},
+			Value:   "",
+			Usage:   "close the position once it falls this far from its highest value, in USD or as a percent like 10%",
+		},
+		&cli.Float64Flag{
+			Name:    "fraction",
+			Aliases: []string{"f"},
+			Value:   1,
+			Usage:   "close only part of the position, like 0.5 for half",
+		},
 	}
 }
 
@@ -57,8 +79,21 @@ func Close(ctx *cli.Context) error {
 	if !valid {
 		ctx.Println("no user detected, set CHIP_USERNAME")
 	}
+	// check the trail before asking which position to close
+	if raw := ctx.String("trail"); raw != "" {
+		_, _, err := trade.ParseTrail(raw)
+		if err != nil {
+			ctx.Println(fmt.Sprintf("meat bag, I don't understand the trail %s, try something like 10%% or 500", raw))
+			return nil
+		}
+	}
+	frac := ctx.Float64("fraction")
+	if frac <= 0 || frac > 1 {
+		ctx.Println("meat bag, the fraction (-f) has to be more than 0 and at most 1")
+		return nil
+	}
 	// fetch open positions
-	sesh, err := arango.NewSesh(ctx.Context, "cookie")
+	sesh, err := arango.Open(ctx.Context, config.Current())
 	if err != nil {
 		return errors.Wrap(err, "failure to fetch open positions")
 	}
@@ -71,23 +106,57 @@ func Close(ctx *cli.Context) error {
 		return nil
 	}
 
-	p, err := ensureInput(ctx, sesh, pos)
+	// the position is shown and closed at the same prices
+	prices := arango.NewSnapshotFrom(sesh, config.Current())
+	p, err := posts.Select(ctx, prices, pos)
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
 	if err != nil {
 		return errors.Wrap(err, "failure to close order")
 	}
 	if p == nil {
 		return nil
 	}
-	update, err := ensureUpLow(ctx, sesh, p)
+	update, open, err := ensureUpLow(ctx, sesh, prices, p)
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
 	if err != nil {
 		return errors.Wrap(err, "failure to update high or low limit on position")
 	}
+	if update && !open {
+		ctx.Println("meat bag, position already closed")
+		return nil
+	}
 	if update {
+		if stop := p.CloseCond.TrailStop(); stop > 0 {
+			ctx.Println(fmt.Sprintf("position updated, it will be closed if its value falls below $%.2f", stop))
+			return nil
+		}
 		ctx.Println("position updated")
 		return nil
 	}
+	if frac < 1 {
+		paid, err := p.CloseFraction(sesh, prices, frac)
+		if arango.IsBadPrice(err) {
+			ctx.Println(trade.BadPriceMessage(err))
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failure to partially close position")
+		}
+		ctx.Println(fmt.Sprintf("closed %.0f%% of the position, %.3f %s has been added to your balance", frac*100, paid, p.Collat))
+		return nil
+	}
 	// close the position
-	err = p.Close(sesh, false)
+	err = p.Close(sesh, prices, false)
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
 	if err != nil {
 		ctx.Println("could not close position!", err)
 		return errors.Wrap(err, "failure to close position")
@@ -96,42 +165,60 @@ func Close(ctx *cli.Context) error {
 	return nil
 }
 
-func ensureInput(ctx *cli.Context, sesh *arango.Sesh, pos []*trade.Position) (*trade.Position, error) {
-	p := ctx.Int("position")
-	if p > 0 && p <= len(pos) {
-		return pos[p-1], nil
-	}
-	// render
-	ren, err := posts.Render(sesh, pos)
-	if err != nil {
-		return nil, errors.Wrap(err, "failure to render positions")
-	}
-	// show the render and ask for input
-	ctx.Println(ren)
-	rawinput, err := ctx.Input("please select a position (enter a number)")
-	if err != nil {
-		return nil, errors.Wrap(err, "failure to close position: no input")
-	}
-	// check input
-	input, err := strconv.ParseInt(rawinput, 10, 64)
-	if err != nil {
-		ctx.Println(fmt.Sprintf("aborting: could not parse input: %s, please enter a number next time", rawinput))
-		return nil, nil
-	}
-	p = int(input)
-	if p > 0 && p <= len(pos) {
-		return pos[p-1], nil
-	}
-	ctx.Println("aborting: invalid selection, please select a position number")
-	return nil, nil
-}
-
-func ensureUpLow(ctx *cli.Context, sesh *arango.Sesh, p *trade.Position) (bool, error) {
+// ensureUpLow sets the close conditions given by the flags, if any, reporting
+// whether there were any to set and whether the position was still open. The
+// conditions are set on the stored position inside a transaction, so that a
+// position closed in the meantime isn't reopened.
+func ensureUpLow(ctx *cli.Context, sesh arango.Store, prices arango.PriceOracle, p *trade.Position) (update, open bool, err error) {
 	up := ctx.Float64("upper")
 	low := ctx.Float64("lower")
-	if up == 0 && low == 0 {
-		return false, nil
-	}
-	p.CloseCond = &trade.CloseCondition{Upper: up, Lower: low}
-	return true, sesh.Update("positions", p.Key, p)
+	rawTrail := ctx.String("trail")
+	if up == 0 && low == 0 && rawTrail == "" {
+		return false, false, nil
+	}
+	var trail, high float64
+	var pct bool
+	if rawTrail != "" {
+		trail, pct, err = trade.ParseTrail(rawTrail)
+		if err != nil {
+			return false, false, err
+		}
+		// the trail starts from the highest value the position has had
+		high, err = trade.HighWater(sesh, p.Key)
+		if err != nil {
+			return false, false, err
+		}
+		val, err := p.Value(prices)
+		if err != nil {
+			return false, false, err
+		}
+		high = math.Max(high, val.Value)
+	}
+	err = sesh.Atomic([]string{"positions"}, func(tx arango.Store) error {
+		var alive []trade.Position
+		err := tx.Find("positions", arango.Match{"_key": p.Key, "alive": true}, &alive)
+		if err != nil || len(alive) == 0 {
+			return err
+		}
+		open = true
+		curr := alive[0]
+		// conditions that aren't given are kept
+		cond := curr.CloseCond
+		if cond == nil {
+			cond = &trade.CloseCondition{}
+		}
+		if up != 0 {
+			cond.Upper = up
+		}
+		if low != 0 {
+			cond.Lower = low
+		}
+		if rawTrail != "" {
+			cond.Trail, cond.TrailPct, cond.High = trail, pct, high
+		}
+		curr.CloseCond = cond
+		p.CloseCond = cond
+		return tx.Update("positions", p.Key, &curr)
+	})
+	return true, open, err
 }
@@ -6,6 +6,8 @@ import (
 
 	"github.com/evan-forbes/chip/arango"
 	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -19,6 +21,11 @@ func Flags() []cli.Flag {
 			Value:   false,
 			Usage:   "see everyone's portfolio",
 		},
+		&cli.StringFlag{
+			Name:  "history",
+			Value: "",
+			Usage: "see how your portfolio did over a range, like 7d or 30d",
+		},
 	}
 }
 
@@ -27,7 +34,7 @@ func Flags() []cli.Flag {
 func Folio(ctx *cli.Context) error {
 	const errMsg = "failure to display portfolio"
 	// fetch the users current balance
-	sesh, err := arango.NewSesh(ctx.Context, "cookie")
+	sesh, err := arango.Open(ctx.Context, config.Current())
 	if err != nil {
 		return errors.Wrap(err, errMsg)
 	}
@@ -40,22 +47,38 @@ func Folio(ctx *cli.Context) error {
 		ctx.Println("no user detected")
 		return nil
 	}
-	ren, err := getStringFolio(sesh, user)
+	if raw := ctx.String("history"); raw != "" {
+		return showHistory(ctx, sesh, user, raw)
+	}
+	ren, err := getStringFolio(sesh, arango.NewSnapshotFrom(sesh, config.Current()), user)
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	// send to user
 	ctx.Println(ren)
 	return posts.Posts(ctx)
 }
 
 // show all combines each user's total and positions
-func showAll(ctx *cli.Context, sesh *arango.Sesh) error {
+func showAll(ctx *cli.Context, sesh arango.Store) error {
 	// fetch all users
-	users, err := arango.AllUsers(sesh)
+	users, err := sesh.AllUsers()
 	if err != nil {
 		return err
 	}
 	fmt.Println(users)
+	// price everyone against the same snapshot
+	prices := arango.NewSnapshotFrom(sesh, config.Current())
 	for _, u := range users {
-		folRend, err := getStringFolio(sesh, u)
+		folRend, err := getStringFolio(sesh, prices, u)
+		if arango.IsBadPrice(err) {
+			ctx.Println(trade.BadPriceMessage(err))
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -69,7 +92,11 @@ func showAll(ctx *cli.Context, sesh *arango.Sesh) error {
 			continue
 		}
 		// render
-		posRend, err := posts.Render(sesh, pos)
+		posRend, err := posts.Render(prices, pos)
+		if arango.IsBadPrice(err) {
+			ctx.Println(trade.BadPriceMessage(err))
+			return nil
+		}
 		if err != nil {
 			return errors.Wrap(err, "failure to render positions")
 		}
@@ -79,16 +106,16 @@ func showAll(ctx *cli.Context, sesh *arango.Sesh) error {
 	return nil
 }
 
-func getStringFolio(sesh *arango.Sesh, user string) (string, error) {
+func getStringFolio(sesh arango.Store, prices arango.PriceOracle, user string) (string, error) {
 	const errMsg = "failure to get portfolio for user"
-	bal, err := arango.LatestBalance(sesh, user)
+	bal, err := sesh.LatestBalance(user)
 	if err != nil {
 		return "", errors.Wrap(err, errMsg)
 	}
 	// clean the local copy of the balance
 	bal.Clean(nil)
 	// lookup prices for the balance
-	err = bal.LookupPrices(sesh)
+	err = bal.LookupPrices(prices)
 	if err != nil {
 		return "", errors.Wrap(err, errMsg)
 	}
@@ -99,6 +126,16 @@ func getStringFolio(sesh *arango.Sesh, user string) (string, error) {
 	return ren, nil
 }
 
+// Worth is the value of everything user owns in USD, their balance plus their
+// open positions
+func Worth(sesh arango.Store, prices arango.PriceOracle, user string) (float64, error) {
+	val, err := Value(sesh, prices, user)
+	if err != nil {
+		return 0, err
+	}
+	return val.Total, nil
+}
+
 // detectUser attempts to identify the user based on the context
 func detectUser(ctx *cli.Context) (string, bool) {
 	var user string
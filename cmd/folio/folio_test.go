@@ -1,17 +1,21 @@
 package folio
 
 import (
-	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/evan-forbes/chip/arango"
 )
 
 func TestRender(t *testing.T) {
-	sesh, err := arango.NewSesh(context.Background(), "cookie")
-	if err != nil {
-		t.Error(err)
+	sesh := arango.NewMem()
+	for symbol, price := range map[string]float64{"ETH": 400, "BTC": 11000} {
+		err := sesh.CreateDoc("stamps", arango.Stamp{Symbol: symbol, Price: price, Cap: 1})
+		if err != nil {
+			t.Error(err)
+		}
 	}
 	bal := &arango.Balance{
 		User: "test",
@@ -22,11 +26,65 @@ func TestRender(t *testing.T) {
 		},
 	}
 	bal.Clean(nil)
-	err = bal.LookupPrices(sesh)
+	err := bal.LookupPrices(arango.NewSnapshot(sesh))
+	if err != nil {
+		t.Error(err)
+	}
+	total, err := bal.CalcTotal()
 	if err != nil {
 		t.Error(err)
 	}
-	bal.CalcTotal()
+	if total != 1112000 {
+		t.Error("unexpected total", total)
+	}
 	ren := bal.Render()
 	fmt.Println(ren)
+
+	bal.Reserve("ETH", 10)
+	ren = bal.Render()
+	if !strings.Contains(ren, "20.000 available") || !strings.Contains(ren, "10.000 reserved") {
+		t.Error("expected the reserved ETH to be shown", ren)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	sesh := arango.NewMem()
+	err := sesh.CreateDoc("users", map[string]string{"_key": "test", "channel_id": "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sesh.CreateDoc("balances", &arango.Balance{User: "test", Balances: map[string]float64{"ETH": 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// the value of the portfolio follows the price of eth
+	for i, price := range []float64{100, 200, 150} {
+		err := sesh.CreateDoc("stamps", arango.Stamp{Symbol: "ETH", Price: price, Cap: 1, Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Record(sesh, arango.NewSnapshot(sesh), now.Add(time.Duration(i-2)*time.Hour*24))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	vals, err := History(sesh, "test", now.Add(-time.Hour*36))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 2 || vals[0].Total != 2000 || vals[1].Spot != 1500 {
+		t.Fatal("expected the last two valuations", vals)
+	}
+	vals, err = History(sesh, "test", now.Add(-time.Hour*24*7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ren, err := RenderHistory("test", "7d", vals, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ren, "+50.00%") || !strings.Contains(ren, "24h -25.00%") || strings.Contains(ren, "7d +") {
+		t.Error("expected the change and the 24h return, but not the 7d return", ren)
+	}
 }
@@ -0,0 +1,179 @@
+package folio
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/evan-forbes/chip/analyze"
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/chart"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Valuation is what a user owned in USD at a tick, stored in the valuations
+// collection
+type Valuation struct {
+	Key  string    `json:"_key,omitempty"`
+	User string    `json:"user"`
+	Time time.Time `json:"time"`
+	// Spot is the value of the user's balance
+	Spot float64 `json:"spot"`
+	// Positions is the value of the user's open positions
+	Positions float64 `json:"positions"`
+	Total     float64 `json:"total"`
+}
+
+// Value values everything user owns at the current prices
+func Value(sesh arango.Store, prices arango.PriceOracle, user string) (*Valuation, error) {
+	const errMsg = "failure to value portfolio"
+	bal, err := sesh.LatestBalance(user)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	bal.Clean(nil)
+	err = bal.LookupPrices(prices)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	spot, err := bal.CalcTotal()
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	pos, err := posts.Open(sesh, user)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	out := &Valuation{User: user, Time: time.Now().Round(time.Second), Spot: spot}
+	for _, p := range pos {
+		val, err := p.Value(prices)
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		out.Positions += val.Value
+	}
+	out.Total = out.Spot + out.Positions
+	return out, nil
+}
+
+// Record saves the valuation of every user with a balance at now. Users that
+// can't be valued are skipped until the next tick.
+func Record(sesh arango.Store, prices arango.PriceOracle, now time.Time) error {
+	users, err := sesh.AllUsers()
+	if err != nil {
+		return errors.Wrap(err, "failure to record valuations")
+	}
+	var vals []*Valuation
+	for _, user := range users {
+		val, err := Value(sesh, prices, user)
+		if err != nil {
+			log.Println("skipped valuation of", user, err)
+			continue
+		}
+		val.Time = now.Round(time.Second)
+		vals = append(vals, val)
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	err = sesh.CreateDocs("valuations", vals)
+	return errors.Wrap(err, "failure to record valuations")
+}
+
+// History fetches the valuations of user recorded since start, oldest first
+func History(sesh arango.Store, user string, start time.Time) ([]*Valuation, error) {
+	// Record rounds to the second, so the newest can be just ahead of now
+	iter, err := sesh.Valuations(user, start, time.Now().Add(time.Second))
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch valuations")
+	}
+	defer iter.Close()
+	var out []*Valuation
+	for {
+		var v Valuation
+		more, err := iter.Next(&v)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to fetch valuations")
+		}
+		if !more {
+			break
+		}
+		out = append(out, &v)
+	}
+	return out, nil
+}
+
+// periods are the returns shown along with the history, when it covers them
+var periods = []struct {
+	name string
+	dur  time.Duration
+}{
+	{"24h", time.Hour * 24},
+	{"7d", time.Hour * 24 * 7},
+	{"30d", time.Hour * 24 * 30},
+	{"90d", time.Hour * 24 * 90},
+}
+
+// RenderHistory charts the valuations, which cover rng, and lists the returns
+// over each period that they cover
+func RenderHistory(user, rng string, vals []*Valuation, interval time.Duration) (string, error) {
+	if len(vals) == 0 {
+		return "", errors.New("no valuations to render")
+	}
+	sm, err := arango.NewSampler(vals[0].Time, interval)
+	if err != nil {
+		return "", err
+	}
+	points := make([]analyze.Point, 0, len(vals))
+	for _, v := range vals {
+		sm.AddCandle(&arango.Candle{
+			First: v.Time,
+			Last:  v.Time,
+			Open:  v.Total,
+			High:  v.Total,
+			Low:   v.Total,
+			Close: v.Total,
+		})
+		points = append(points, analyze.Point{Time: v.Time, Value: v.Total})
+	}
+	candles := sm.Candles()
+	var rets []string
+	last := vals[len(vals)-1].Time
+	for _, p := range periods {
+		if vals[0].Time.After(last.Add(-p.dur)) {
+			break
+		}
+		rets = append(rets, fmt.Sprintf("%s %+.2f%%", p.name, analyze.ReturnOver(points, p.dur)*100))
+	}
+	out := chart.Render("@"+user, rng, candles, chart.Sparkline(candles))
+	if len(rets) == 0 {
+		return out, nil
+	}
+	return fmt.Sprintf("%s\nreturns: %s", out, strings.Join(rets, "  ")), nil
+}
+
+// showHistory charts how the user's portfolio did over the range raw
+func showHistory(ctx *cli.Context, sesh arango.Store, user, raw string) error {
+	rng, err := chart.ParseRange(raw)
+	if err != nil {
+		ctx.Println(fmt.Sprintf("meat bag, I don't understand the range %s, try something like 7d or 30d", raw))
+		return nil
+	}
+	vals, err := History(sesh, user, time.Now().Add(-rng))
+	if err != nil {
+		return errors.Wrap(err, "failure to display portfolio history")
+	}
+	if len(vals) == 0 {
+		ctx.Println(fmt.Sprintf("meat bag, I haven't valued your portfolio over the last %s yet", raw))
+		return nil
+	}
+	ren, err := RenderHistory(user, raw, vals, chart.FitInterval(rng))
+	if err != nil {
+		return errors.Wrap(err, "failure to display portfolio history")
+	}
+	ctx.Println(ren)
+	return nil
+}
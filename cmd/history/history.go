@@ -0,0 +1,452 @@
+package history
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/chart"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// list your latest fills and closed positions
+!chip history
+
+// see the next page
+!chip history -p 2
+
+// only eth trades from the last week
+!chip history -a eth --from 7d --kind trade
+
+// only positions closed in january
+!chip history --kind position --from 2021-01-01 --to 2021-02-01
+
+// export everything to a spreadsheet (only when running chip locally)
+chip history --format csv -o history.csv
+`
+
+// PageSize is how many entries are shown at once, which keeps the list
+// readable in a discord message
+const PageSize = 10
+
+// Kinds of entries besides the kinds of order that trades were filled as.
+// KindTrade and KindPosition are only used to filter.
+const (
+	KindTrade       = "trade"
+	KindPosition    = "position"
+	KindLiquidation = "liquidation"
+)
+
+// Flags returns the flags for the history command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "asset",
+			Aliases: []string{"a"},
+			Value:   "",
+			Usage:   "only show entries that bought, sold or were collateralized by this asset",
+		},
+		&cli.StringFlag{
+			Name:  "from",
+			Value: "",
+			Usage: "only show entries since a date like 2021-01-01, or a range like 7d",
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Value: "",
+			Usage: "only show entries before a date like 2021-02-01, or a range like 1d",
+		},
+		&cli.StringFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "only show trades, positions, or a kind like market, limit, stop or liquidation",
+		},
+		&cli.IntFlag{
+			Name:    "page",
+			Aliases: []string{"p"},
+			Value:   1,
+			Usage:   "which page of entries to show",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   "",
+			Usage:   "export every matching entry as csv or json instead (local only)",
+		},
+		&cli.StringFlag{
+			Name:    "out",
+			Aliases: []string{"o"},
+			Value:   "",
+			Usage:   "file to export to (default chip-history.csv or chip-history.json)",
+		},
+	}
+}
+
+// Entry is a trade that was filled or a position that was closed
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Kind is the kind of order a trade was filled as, or position or
+	// liquidation
+	Kind       string  `json:"kind"`
+	Key        string  `json:"key"`
+	Sell       string  `json:"sell"`
+	Buy        string  `json:"buy"`
+	SellAmount float64 `json:"sell_amount"`
+	BuyAmount  float64 `json:"buy_amount"`
+	Price      float64 `json:"price"`
+	Fee        float64 `json:"fee,omitempty"`
+	FeeAsset   string  `json:"fee_asset,omitempty"`
+	// Leverage, Long, Collat, PaidIn and PaidOut describe closed positions.
+	// PaidIn and PaidOut are the collateral put into the position and paid
+	// back out of it.
+	Leverage int     `json:"leverage,omitempty"`
+	Long     bool    `json:"long,omitempty"`
+	Collat   string  `json:"collateral,omitempty"`
+	PaidIn   float64 `json:"paid_in,omitempty"`
+	PaidOut  float64 `json:"paid_out,omitempty"`
+}
+
+// Filter selects entries. Zero fields match everything.
+type Filter struct {
+	Asset string
+	From  time.Time
+	To    time.Time
+	Kind  string
+}
+
+// Match checks if e is selected by the filter
+func (f Filter) Match(e *Entry) bool {
+	if f.Asset != "" && e.Sell != f.Asset && e.Buy != f.Asset && e.Collat != f.Asset {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	switch f.Kind {
+	case "":
+		return true
+	case KindTrade:
+		return e.Leverage == 0
+	case KindPosition:
+		return e.Kind == KindPosition || e.Kind == KindLiquidation
+	}
+	return e.Kind == f.Kind
+}
+
+// History shows the user's fills and closed positions, or exports them
+func History(ctx *cli.Context) error {
+	const errMsg = "failure to show history"
+	user, valid := posts.DetectUser(ctx)
+	if !valid {
+		ctx.Println("no user detected, set CHIP_USERNAME")
+		return nil
+	}
+	filter, msg := parseFilter(ctx, time.Now())
+	if msg != "" {
+		ctx.Println(msg)
+		return nil
+	}
+	format := strings.ToLower(ctx.String("format"))
+	if format != "" && format != "csv" && format != "json" {
+		ctx.Println(fmt.Sprintf("meat bag, I can only export csv or json, not %s", format))
+		return nil
+	}
+	if format != "" && ctx.Slug != nil {
+		ctx.Println("meat bag, exports can only be written when running chip locally")
+		return nil
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	entries, err := Load(sesh, user, filter)
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if format != "" {
+		path := ctx.String("out")
+		if path == "" {
+			path = "chip-history." + format
+		}
+		err = export(path, format, entries)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		ctx.Println(fmt.Sprintf("wrote %d entries to %s", len(entries), path))
+		return nil
+	}
+	if len(entries) == 0 {
+		ctx.Println("meat bag, you have no history that matches")
+		return nil
+	}
+	ctx.Println(Render(entries, ctx.Int("page")))
+	return nil
+}
+
+// parseFilter reads the filter flags, returning a message for the user if
+// any of them are invalid
+func parseFilter(ctx *cli.Context, now time.Time) (Filter, string) {
+	f := Filter{
+		Asset: strings.ToUpper(ctx.String("asset")),
+		Kind:  strings.ToLower(ctx.String("kind")),
+	}
+	for _, flag := range []struct {
+		name string
+		out  *time.Time
+	}{
+		{"from", &f.From},
+		{"to", &f.To},
+	} {
+		raw := ctx.String(flag.name)
+		if raw == "" {
+			continue
+		}
+		t, err := ParseTime(raw, now)
+		if err != nil {
+			return f, fmt.Sprintf("meat bag, I don't understand the date %s, try something like 2021-01-01 or 7d", raw)
+		}
+		*flag.out = t
+	}
+	return f, ""
+}
+
+// ParseTime parses a date like 2021-01-01, or a range like 7d that is taken
+// to mean that long before now
+func ParseTime(raw string, now time.Time) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	d, err := chart.ParseRange(raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
+
+// Load fetches the user's fills and closed positions that match filter, newest
+// first
+func Load(sesh arango.Store, user string, filter Filter) ([]*Entry, error) {
+	const errMsg = "failure to load history"
+	var out []*Entry
+	var trades []*trade.Limit
+	err := sesh.Find("trades", arango.Match{"user": user}, &trades)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	for _, t := range trades {
+		e := fromTrade(t)
+		if filter.Match(e) {
+			out = append(out, e)
+		}
+	}
+	var closed []*trade.Position
+	err = sesh.Find("positions", arango.Match{"user": user, "alive": false}, &closed)
+	if err != nil {
+		return nil, errors.Wrap(err, errMsg)
+	}
+	for _, p := range closed {
+		e, err := fromPosition(sesh, p)
+		if err != nil {
+			return nil, errors.Wrap(err, errMsg)
+		}
+		if filter.Match(e) {
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Time.After(out[j].Time)
+	})
+	return out, nil
+}
+
+func fromTrade(t *trade.Limit) *Entry {
+	kind := t.Filled
+	// trades from before their kind was recorded
+	if kind == "" {
+		kind = t.Kind()
+	}
+	return &Entry{
+		Time:       t.ExecTime,
+		Kind:       kind,
+		Key:        t.Key,
+		Sell:       t.Sell,
+		Buy:        t.Buy,
+		SellAmount: t.SellAmount,
+		BuyAmount:  t.BuyAmount,
+		Price:      t.Price,
+		Fee:        t.Fee,
+		FeeAsset:   t.FeeAsset,
+	}
+}
+
+func fromPosition(sesh arango.Store, p *trade.Position) (*Entry, error) {
+	e := &Entry{
+		Time:       p.End,
+		Kind:       KindPosition,
+		Key:        p.Key,
+		Sell:       p.Sell,
+		Buy:        p.Buy,
+		SellAmount: p.SellAmount,
+		BuyAmount:  p.BuyAmount,
+		Price:      p.Price,
+		Fee:        p.Fee,
+		FeeAsset:   p.FeeAsset,
+		Leverage:   p.Leverage,
+		Long:       p.Long,
+		Collat:     p.Collat,
+	}
+	if p.Liquidated {
+		e.Kind = KindLiquidation
+	}
+	events, err := trade.Events(sesh, p.Key)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	for _, ev := range events {
+		if ev.Kind == trade.EventOpen {
+			opened = true
+		}
+		if ev.Amount > 0 {
+			e.PaidIn += ev.Amount
+		} else {
+			e.PaidOut -= ev.Amount
+		}
+	}
+	// positions from before they were recorded opening
+	if !opened {
+		e.PaidIn += p.CollAmount + p.Fee
+	}
+	return e, nil
+}
+
+// Render returns one page of entries
+func Render(entries []*Entry, page int) string {
+	pages := (len(entries) + PageSize - 1) / PageSize
+	if page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * PageSize
+	end := start + PageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	var buf bytes.Buffer
+	twr := tabwriter.NewWriter(&buf, 1, 4, 4, ' ', 0)
+	for i, e := range entries[start:end] {
+		fmt.Fprintf(twr, "- %d )\t%s\t%s\t", start+i+1, e.Time.Format("2006-01-02 15:04"), e.Kind)
+		if e.Leverage == 0 {
+			fmt.Fprintf(twr, "%.3f %s -> %.3f %s\t@ %.3f", e.SellAmount, e.Sell, e.BuyAmount, e.Buy, e.Price)
+		} else {
+			dir := "long"
+			if !e.Long {
+				dir = "short"
+			}
+			fmt.Fprintf(twr, "%dx %s %s/%s\t%.3f -> %.3f %s", e.Leverage, dir, e.Buy, e.Sell, e.PaidIn, e.PaidOut, e.Collat)
+		}
+		fmt.Fprintf(twr, "\tkey: %s\n", e.Key)
+	}
+	err := twr.Flush()
+	if err != nil {
+		fmt.Println("failure to render history", err)
+	}
+	if pages > 1 {
+		fmt.Fprintf(&buf, "page %d of %d", page, pages)
+		if page < pages {
+			fmt.Fprintf(&buf, ", see the next with -p %d", page+1)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// export writes entries to the file at path as csv or json
+func export(path, format string, entries []*Entry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "failure to create export")
+	}
+	defer f.Close()
+	if format == "json" {
+		err = WriteJSON(f, entries)
+	} else {
+		err = WriteCSV(f, entries)
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(f.Close(), "failure to write export")
+}
+
+// WriteJSON writes entries as an indented json array
+func WriteJSON(w io.Writer, entries []*Entry) error {
+	if entries == nil {
+		entries = []*Entry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(entries), "failure to write json")
+}
+
+var csvHeader = []string{
+	"time", "kind", "key", "sell", "buy", "sell_amount", "buy_amount", "price",
+	"fee", "fee_asset", "leverage", "long", "collateral", "paid_in", "paid_out",
+}
+
+// WriteCSV writes entries as csv with a header row
+func WriteCSV(w io.Writer, entries []*Entry) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return errors.Wrap(err, "failure to write csv")
+	}
+	float := func(x float64) string {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	for _, e := range entries {
+		err := cw.Write([]string{
+			e.Time.Format(time.RFC3339),
+			e.Kind,
+			e.Key,
+			e.Sell,
+			e.Buy,
+			float(e.SellAmount),
+			float(e.BuyAmount),
+			float(e.Price),
+			float(e.Fee),
+			e.FeeAsset,
+			strconv.Itoa(e.Leverage),
+			strconv.FormatBool(e.Long),
+			e.Collat,
+			float(e.PaidIn),
+			float(e.PaidOut),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failure to write csv")
+		}
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "failure to write csv")
+}
@@ -0,0 +1,112 @@
+package history
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+)
+
+func TestHistory(t *testing.T) {
+	now := time.Now().Round(time.Second)
+	m := arango.NewMem()
+	docs := []struct {
+		col string
+		doc interface{}
+	}{
+		{"trades", trade.Limit{Key: "1", User: "zkFART", Sell: "USDC", Buy: "ETH", SellAmount: 1000, BuyAmount: 5, Price: 200, Filled: "market", ExecTime: now.Add(-time.Hour * 72)}},
+		{"trades", trade.Limit{Key: "2", User: "zkFART", Sell: "ETH", Buy: "BTC", SellAmount: 5, BuyAmount: 0.1, Price: 50, ExecTime: now.Add(-time.Hour * 48)}},
+		{"trades", trade.Limit{Key: "3", User: "degen", Sell: "USDC", Buy: "ETH", SellAmount: 1, BuyAmount: 1, Price: 1, ExecTime: now}},
+		{"positions", trade.Position{Limit: trade.Limit{Key: "4", User: "zkFART", Sell: "USDC", Buy: "ETH", Collat: "USDC", CollAmount: 100, Leverage: 2, Long: true}, End: now.Add(-time.Hour * 24)}},
+		{"post_events", trade.PosEvent{Position: "4", Kind: trade.EventOpen, Amount: 100}},
+		{"post_events", trade.PosEvent{Position: "4", Kind: trade.EventClose, Amount: -120}},
+		{"positions", trade.Position{Limit: trade.Limit{Key: "5", User: "zkFART", Sell: "USDC", Buy: "BTC", Collat: "USDC", CollAmount: 50, Leverage: 5}, End: now.Add(-time.Hour), Liquidated: true}},
+		// open positions aren't history yet
+		{"positions", trade.Position{Limit: trade.Limit{Key: "6", User: "zkFART", Sell: "USDC", Buy: "BTC", Collat: "USDC", Leverage: 2}, Alive: true}},
+	}
+	for _, d := range docs {
+		err := m.CreateDoc(d.col, d.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter Filter
+		keys   string
+	}{
+		{"everything newest first", Filter{}, "5 4 2 1"},
+		{"by asset", Filter{Asset: "BTC"}, "5 2"},
+		{"collateral counts as an asset", Filter{Asset: "USDC"}, "5 4 1"},
+		{"trades", Filter{Kind: KindTrade}, "2 1"},
+		{"positions", Filter{Kind: KindPosition}, "5 4"},
+		{"exact kinds", Filter{Kind: "market"}, "1"},
+		{"liquidations", Filter{Kind: KindLiquidation}, "5"},
+		{"date range", Filter{From: now.Add(-time.Hour * 50), To: now.Add(-time.Hour * 2)}, "4 2"},
+	}
+	for _, tt := range tests {
+		entries, err := Load(m, "zkFART", tt.filter)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if got := strings.Join(keys, " "); got != tt.keys {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.keys, got)
+		}
+	}
+
+	entries, err := Load(m, "zkFART", Filter{Kind: KindPosition})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// position 5 was opened before opening was recorded
+	if entries[1].PaidIn != 100 || entries[1].PaidOut != 120 || entries[0].PaidIn != 50 || entries[0].PaidOut != 0 {
+		t.Error("unexpected collateral paid in and out", entries[0], entries[1])
+	}
+
+	var buf bytes.Buffer
+	err = WriteCSV(&buf, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "time" || rows[1][1] != KindLiquidation || rows[2][14] != "120" {
+		t.Error("unexpected csv", rows)
+	}
+	buf.Reset()
+	err = WriteJSON(&buf, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []Entry
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil || len(decoded) != 2 || decoded[1].PaidOut != 120 {
+		t.Error("unexpected json", buf.String(), err)
+	}
+}
+
+func TestRenderPages(t *testing.T) {
+	var entries []*Entry
+	for i := 0; i < PageSize+3; i++ {
+		entries = append(entries, &Entry{Kind: "limit", Sell: "USDC", Buy: "ETH", Key: "k"})
+	}
+	first := Render(entries, 1)
+	if strings.Count(first, "key: k") != PageSize || !strings.Contains(first, "page 1 of 2, see the next with -p 2") {
+		t.Error("unexpected first page", first)
+	}
+	last := Render(entries, 5)
+	if strings.Count(last, "key: k") != 3 || !strings.Contains(last, "- 13 )") || strings.Contains(last, "see the next") {
+		t.Error("expected pages past the end to show the last one", last)
+	}
+}
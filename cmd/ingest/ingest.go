@@ -0,0 +1,275 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// fetch the latest prices of the top 300 coins once
+chip ingest
+
+// fetch the top 100 coins every 15 minutes
+chip ingest -n 100 -e 15m
+
+// save the raw api response so that it can be replayed offline
+chip ingest -r listings.json
+
+// write prices from a saved response instead of calling the api
+chip ingest -f listings.json
+`
+
+// Flags returns the flags for the ingest command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "limit",
+			Aliases: []string{"n"},
+			Value:   0,
+			Usage:   "number of top coins to ingest (default from config)",
+		},
+		&cli.DurationFlag{
+			Name:    "every",
+			Aliases: []string{"e"},
+			Value:   0,
+			Usage:   "keep ingesting on this interval instead of only once",
+		},
+		&cli.StringFlag{
+			Name:    "fixture",
+			Aliases: []string{"f"},
+			Value:   "",
+			Usage:   "read listings from a recorded response file instead of the api",
+		},
+		&cli.StringFlag{
+			Name:    "record",
+			Aliases: []string{"r"},
+			Value:   "",
+			Usage:   "save the raw api response to this file",
+		},
+	}
+}
+
+// Ingest writes the latest coin listings to the stamps collection
+func Ingest(ctx *cli.Context) error {
+	if ctx.Slug != nil {
+		ctx.Println("meat bag, price ingestion can only be run by my operator")
+		return nil
+	}
+	cfg := config.Current()
+	sesh, err := arango.Open(ctx.Context, cfg)
+	if err != nil {
+		return errors.Wrap(err, "failure to ingest prices")
+	}
+	limit := ctx.Int("limit")
+	if limit <= 0 {
+		limit = cfg.IngestLimit
+	}
+	var src Source
+	if path := ctx.String("fixture"); path != "" {
+		src = Fixture(path)
+	} else {
+		client := NewClient(cfg)
+		client.Record = ctx.String("record")
+		src = client
+	}
+	every := ctx.Duration("every")
+	for {
+		n, err := Run(ctx.Context, sesh, src, limit)
+		if err != nil {
+			if every == 0 {
+				return err
+			}
+			// keep going, the next tick might work
+			log.Println(err)
+		} else {
+			ctx.Println(fmt.Sprintf("ingested %d stamps", n))
+		}
+		if every == 0 {
+			return nil
+		}
+		select {
+		case <-time.After(every):
+		case <-ctx.Context.Done():
+			return nil
+		}
+	}
+}
+
+// Run fetches the top limit coins from src and writes them as stamps in bulk,
+// returning the number of stamps written
+func Run(ctx context.Context, sesh arango.Store, src Source, limit int) (int, error) {
+	stamps, err := src.Listings(ctx, limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "failure to ingest prices")
+	}
+	if len(stamps) == 0 {
+		return 0, errors.New("failure to ingest prices: no listings returned")
+	}
+	err = sesh.CreateDocs("stamps", stamps)
+	if err != nil {
+		return 0, errors.Wrap(err, "failure to write stamps")
+	}
+	return len(stamps), nil
+}
+
+// Source provides the latest coin listings
+type Source interface {
+	// Listings fetches the top limit coins by market cap
+	Listings(ctx context.Context, limit int) ([]*arango.Stamp, error)
+}
+
+// Client fetches listings from a CoinMarketCap compatible api
+type Client struct {
+	BaseURL string
+	Key     string
+	HTTP    *http.Client
+	// Record is where the raw body of each response is saved, if anywhere, so
+	// it can be replayed with a Fixture
+	Record string
+}
+
+// NewClient creates a Client for the api described by cfg
+func NewClient(cfg *config.Config) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(cfg.CMCEndpoint, "/"),
+		Key:     cfg.CMCSecret,
+		HTTP:    &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// Listings fetches the top limit coins by market cap
+func (c *Client) Listings(ctx context.Context, limit int) ([]*arango.Stamp, error) {
+	query := url.Values{}
+	query.Set("start", "1")
+	query.Set("limit", fmt.Sprint(limit))
+	query.Set("convert", "USD")
+	req, err := http.NewRequest("GET", c.BaseURL+"/v1/cryptocurrency/listings/latest?"+query.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to request listings")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-CMC_PRO_API_KEY", c.Key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to request listings")
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to read listings")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failure to request listings: %s: %s", resp.Status, raw)
+	}
+	if c.Record != "" {
+		err = ioutil.WriteFile(c.Record, raw, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to record listings")
+		}
+	}
+	return parseListings(raw)
+}
+
+// Fixture replays a response recorded by a Client
+type Fixture string
+
+// Listings reads the top limit coins from the recorded response
+func (f Fixture) Listings(ctx context.Context, limit int) ([]*arango.Stamp, error) {
+	raw, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to read fixture")
+	}
+	stamps, err := parseListings(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(stamps) > limit {
+		stamps = stamps[:limit]
+	}
+	return stamps, nil
+}
+
+// listings is the body of a listings/latest response
+type listings struct {
+	Status struct {
+		Timestamp    time.Time `json:"timestamp"`
+		ErrorCode    int       `json:"error_code"`
+		ErrorMessage string    `json:"error_message"`
+	} `json:"status"`
+	Data []struct {
+		Name              string   `json:"name"`
+		Symbol            string   `json:"symbol"`
+		CirculatingSupply float64  `json:"circulating_supply"`
+		TotalSupply       float64  `json:"total_supply"`
+		MaxSupply         *float64 `json:"max_supply"`
+		Quote             struct {
+			USD struct {
+				Price       float64   `json:"price"`
+				Volume      float64   `json:"volume_24h"`
+				MarketCap   float64   `json:"market_cap"`
+				LastUpdated time.Time `json:"last_updated"`
+				// Bid and Ask aren't part of CoinMarketCap's api, but are
+				// used if a compatible source provides them
+				Bid float64 `json:"bid"`
+				Ask float64 `json:"ask"`
+			} `json:"USD"`
+		} `json:"quote"`
+	} `json:"data"`
+}
+
+// parseListings normalizes a listings response into stamps. Coins without a
+// market cap are skipped, as are repeated symbols, keeping the higher ranked
+// coin.
+func parseListings(raw []byte) ([]*arango.Stamp, error) {
+	var resp listings
+	err := json.Unmarshal(raw, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to parse listings")
+	}
+	if resp.Status.ErrorCode != 0 {
+		return nil, errors.Errorf("failure to fetch listings: %d %s", resp.Status.ErrorCode, resp.Status.ErrorMessage)
+	}
+	seen := make(map[string]bool)
+	var out []*arango.Stamp
+	for _, coin := range resp.Data {
+		symbol := strings.ToUpper(coin.Symbol)
+		usd := coin.Quote.USD
+		if seen[symbol] || usd.MarketCap <= 0 || usd.Price <= 0 {
+			continue
+		}
+		seen[symbol] = true
+		stamp := &arango.Stamp{
+			Name:              coin.Name,
+			Symbol:            symbol,
+			Cap:               usd.MarketCap,
+			CirculatingSupply: coin.CirculatingSupply,
+			TotalSupply:       coin.TotalSupply,
+			Price:             usd.Price,
+			Volume:            usd.Volume,
+			Time:              usd.LastUpdated,
+			Bid:               usd.Bid,
+			Ask:               usd.Ask,
+		}
+		if coin.MaxSupply != nil {
+			stamp.MaxSupply = *coin.MaxSupply
+		}
+		if stamp.Time.IsZero() {
+			stamp.Time = resp.Status.Timestamp
+		}
+		out = append(out, stamp)
+	}
+	return out, nil
+}
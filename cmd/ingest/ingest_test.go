@@ -0,0 +1,123 @@
+package ingest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+)
+
+const fixture = "testdata/listings.json"
+
+// standIn serves the fixture like the listings/latest endpoint would
+func standIn(t *testing.T) *httptest.Server {
+	raw, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/cryptocurrency/listings/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-CMC_PRO_API_KEY") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": {"error_code": 1002, "error_message": "API key missing."}}`))
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("limit") != "300" || q.Get("convert") != "USD" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		w.Write(raw)
+	}))
+}
+
+func TestClient(t *testing.T) {
+	srv := standIn(t)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.Default()
+	cfg.CMCEndpoint = srv.URL + "/"
+	cfg.CMCSecret = "secret"
+	client := NewClient(cfg)
+	client.Record = filepath.Join(dir, "listings.json")
+
+	sesh := arango.NewMem()
+	n, err := Run(context.Background(), sesh, client, cfg.IngestLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("expected 3 stamps to be written, got", n)
+	}
+	price, err := sesh.LatestPrice("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price != 385.12 {
+		t.Error("expected the higher ranked ETH to be kept, got", price)
+	}
+	var stamps []arango.Stamp
+	err = sesh.Find("stamps", arango.Match{"symbol": "ETH"}, &stamps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 1 {
+		t.Fatal("expected a single ETH stamp, got", len(stamps))
+	}
+	eth := stamps[0]
+	if eth.MaxSupply != 0 || !eth.Time.Equal(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("ETH was not normalized: %+v", eth)
+	}
+	exists, _ := sesh.AssetExists("BOO")
+	if exists {
+		t.Error("a coin without a market cap was ingested")
+	}
+
+	// the recorded response replays the same stamps
+	replayed, err := Fixture(client.Record).Listings(context.Background(), cfg.IngestLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != n {
+		t.Error("expected the recording to replay", n, "stamps, got", len(replayed))
+	}
+
+	client.Key = "wrong"
+	_, err = Run(context.Background(), sesh, client, cfg.IngestLimit)
+	if err == nil {
+		t.Error("expected a rejected key to fail")
+	}
+}
+
+func TestFixture(t *testing.T) {
+	sesh := arango.NewMem()
+	n, err := Run(context.Background(), sesh, Fixture(fixture), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("expected the limit to be respected, got", n)
+	}
+	count, _ := sesh.CountStamps()
+	if count != 2 {
+		t.Error("expected 2 stamps, got", count)
+	}
+	_, err = Run(context.Background(), sesh, Fixture("testdata/missing.json"), 2)
+	if err == nil {
+		t.Error("expected a missing fixture to fail")
+	}
+}
@@ -0,0 +1,183 @@
+package leaderboard
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evan-forbes/chip/analyze"
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/folio"
+	"github.com/evan-forbes/chip/cmd/stats"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// rank everyone by their return over the last week
+!chip leaderboard
+
+// rank everyone by their return over the last day
+!chip leaderboard -w 24h
+
+// rank everyone by what they own, with returns since they began
+!chip leaderboard -w all -b value
+
+// Note: players can also be ranked by pnl, sharpe, sortino, drawdown or winrate
+`
+
+// Flags returns the flags for the leaderboard command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "window",
+			Aliases: []string{"w"},
+			Value:   "7d",
+			Usage:   "how far back returns are measured, like 24h, 7d or all",
+		},
+		&cli.StringFlag{
+			Name:    "by",
+			Aliases: []string{"b"},
+			Value:   "return",
+			Usage:   "what players are ranked by, value or one of " + strings.Join(analyze.Metrics, ", "),
+		},
+	}
+}
+
+// Row is a player's place on the leaderboard
+type Row struct {
+	Place int
+	// Value is what the player currently owns in USD
+	Value float64
+	*analyze.Stats
+}
+
+// Leaderboard ranks every player
+func Leaderboard(ctx *cli.Context) error {
+	const errMsg = "failure to show leaderboard"
+	window, err := stats.ParseWindow(ctx.String("window"))
+	if err != nil {
+		ctx.Println(fmt.Sprintf("meat bag, I don't understand the window %s, try 24h, 7d or all", ctx.String("window")))
+		return nil
+	}
+	by := strings.ToLower(ctx.String("by"))
+	if !valid(by) {
+		ctx.Println(fmt.Sprintf("meat bag, I can't rank anyone by %s, try value or one of %s", by, strings.Join(analyze.Metrics, ", ")))
+		return nil
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	rows, skipped, err := Board(sesh, arango.NewSnapshotFrom(sesh, config.Current()), window, by, time.Now())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if len(rows) == 0 && len(skipped) == 0 {
+		ctx.Println("nobody is playing yet, meat bag")
+		return nil
+	}
+	ctx.Println(Render(rows, skipped, ctx.String("window"), by))
+	return nil
+}
+
+// Board values every player with a balance and ranks them by, which is
+// either value or one of analyze.Metrics measured over window. A zero window
+// measures since each player began. Players that can't be priced or analyzed
+// are left off the board and returned in skipped, along with why.
+func Board(sesh arango.Store, prices arango.PriceOracle, window time.Duration, by string, now time.Time) (rows []*Row, skipped []string, err error) {
+	users, err := sesh.AllUsers()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failure to fetch users")
+	}
+	skip := func(user string, err error) {
+		log.Println("leaving user off the leaderboard", user, err)
+		skipped = append(skipped, fmt.Sprintf("%s: %v", user, errors.Cause(err)))
+	}
+	for _, user := range users {
+		val, err := folio.Worth(sesh, prices, user)
+		if arango.IsBadPrice(err) {
+			skip(user, err)
+			continue
+		}
+		// users without a balance aren't playing
+		if err != nil {
+			log.Println("leaving user off the leaderboard", user, err)
+			continue
+		}
+		st, err := analyze.Analyze(sesh, prices, user, window, now)
+		if err != nil {
+			skip(user, err)
+			continue
+		}
+		rows = append(rows, &Row{Value: val, Stats: st})
+	}
+	if by == "value" {
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].Value > rows[j].Value
+		})
+	} else {
+		ranked := make([]*analyze.Stats, len(rows))
+		byStats := make(map[*analyze.Stats]*Row, len(rows))
+		for i, r := range rows {
+			ranked[i] = r.Stats
+			byStats[r.Stats] = r
+		}
+		err = analyze.Rank(ranked, by)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, st := range ranked {
+			rows[i] = byStats[st]
+		}
+	}
+	for i, r := range rows {
+		r.Place = i + 1
+	}
+	return rows, skipped, nil
+}
+
+// Render returns a compact table of the ranked players, followed by the
+// players that were skipped
+func Render(rows []*Row, skipped []string, window, by string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "leaderboard by %s over %s\n", by, window)
+	twr := tabwriter.NewWriter(&buf, 1, 4, 4, ' ', 0)
+	for _, r := range rows {
+		fmt.Fprintf(twr, "- %d )\t%s\t$%.2f\t%+.2f%%", r.Place, r.User, r.Value, r.Return*100)
+		if by != "value" && by != "return" {
+			metric, _ := r.Metric(by)
+			if by == "drawdown" {
+				metric = -metric
+			}
+			fmt.Fprintf(twr, "\t%s %.2f", by, metric)
+		}
+		fmt.Fprintln(twr)
+	}
+	err := twr.Flush()
+	if err != nil {
+		fmt.Println("failure to render leaderboard", err)
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&buf, "left off until they can be valued:\n%s\n", strings.Join(skipped, "\n"))
+	}
+	return buf.String()
+}
+
+// valid checks that players can be ranked by
+func valid(by string) bool {
+	if by == "value" {
+		return true
+	}
+	for _, m := range analyze.Metrics {
+		if m == by {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package leaderboard
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/folio"
+)
+
+func TestBoard(t *testing.T) {
+	now := time.Now()
+	m := arango.NewMem()
+	stamps := []arango.Stamp{
+		{Symbol: "USDC", Price: 1, Time: now.Add(-time.Hour * 48)},
+		{Symbol: "ETH", Price: 100, Time: now.Add(-time.Hour * 48)},
+		{Symbol: "ETH", Price: 150, Time: now.Add(-time.Minute)},
+	}
+	for _, s := range stamps {
+		s.Cap = 1
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// whale has more, but degen did better, and nobody knows what fxc is worth
+	balances := map[string]map[string]float64{
+		"whale":     {"USDC": 10000},
+		"degen":     {"ETH": 10},
+		"lurker":    nil,
+		"bagholder": {"FXC": 5},
+	}
+	for user, bal := range balances {
+		err := m.CreateDoc("users", map[string]string{"_key": user, "channel_id": "local"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bal == nil {
+			continue
+		}
+		err = m.CreateDoc("balances", arango.Balance{User: user, Balances: bal, Timestamp: now.Add(-time.Hour * 48)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the returns are measured from the first valuations
+	err := m.CreateDocs("valuations", []*folio.Valuation{
+		{User: "whale", Time: now.Add(-time.Hour * 48), Total: 10000},
+		{User: "degen", Time: now.Add(-time.Hour * 48), Total: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		by    string
+		users []string
+	}{
+		{"return", []string{"degen", "whale"}},
+		{"value", []string{"whale", "degen"}},
+	}
+	for _, tt := range tests {
+		rows, skipped, err := Board(m, arango.NewSnapshot(m), 0, tt.by, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(skipped) != 1 || !strings.HasPrefix(skipped[0], "bagholder") {
+			t.Errorf("by %s: expected the player without a price to be skipped, got %v", tt.by, skipped)
+		}
+		if len(rows) != len(tt.users) {
+			t.Fatalf("by %s: expected %d players, got %d", tt.by, len(tt.users), len(rows))
+		}
+		for i, user := range tt.users {
+			if rows[i].User != user || rows[i].Place != i+1 {
+				t.Errorf("by %s: expected %s in place %d, got %s", tt.by, user, i+1, rows[i].User)
+			}
+		}
+		out := Render(rows, skipped, "all", tt.by)
+		if tt.by == "return" && !strings.Contains(out, "+50.00%") {
+			t.Error("expected degen's return to be rendered", out)
+		}
+		if !strings.Contains(out, "bagholder") {
+			t.Error("expected the skipped player to be rendered", out)
+		}
+	}
+}
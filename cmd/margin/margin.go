@@ -0,0 +1,147 @@
+package margin
+
+import (
+	"fmt"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const AddUsageText = ` // Note: the entry price and size of the position stay the same, only its leverage changes
+// add 500 USDC of collateral to position 1
+!chip addmargin -p 1 -a 500
+
+// pick the position from a list
+!chip addmargin -a 500
+`
+
+const ReduceUsageText = ` // Note: the entry price and size of the position stay the same, only its leverage changes
+// take 500 USDC of collateral out of position 1
+!chip reduce -p 1 -a 500
+
+// pick the position from a list
+!chip reduce -a 500
+`
+
+// Flags returns the flags for the addmargin and reduce commands
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "position",
+			Aliases: []string{"p"},
+			Value:   0,
+			Usage:   "select which position to resize",
+		},
+		&cli.Float64Flag{
+			Name:    "amount",
+			Aliases: []string{"a"},
+			Value:   0,
+			Usage:   "amount of collateral to add or take out",
+		},
+	}
+}
+
+// Resize adds collateral to, or takes it out of, an open position
+func Resize(add bool) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		const errMsg = "failure to resize position"
+		user, valid := posts.DetectUser(ctx)
+		if !valid {
+			ctx.Println("no user detected, set CHIP_USERNAME")
+			return nil
+		}
+		amount := ctx.Float64("amount")
+		if amount <= 0 {
+			ctx.Println("meat bag, please specify a positive amount of collateral with -a")
+			return nil
+		}
+		sesh, err := arango.Open(ctx.Context, config.Current())
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		pos, err := posts.Open(sesh, user)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		if len(pos) == 0 {
+			ctx.Println("beloved meat bag, you do not have any open positions")
+			return nil
+		}
+		// the position is shown and resized at the same prices
+		prices := arango.NewSnapshotFrom(sesh, config.Current())
+		p, err := posts.Select(ctx, prices, pos)
+		if arango.IsBadPrice(err) {
+			ctx.Println(trade.BadPriceMessage(err))
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		if p == nil {
+			return nil
+		}
+		if add {
+			bal, err := sesh.LatestBalance(user)
+			if err != nil {
+				return errors.Wrap(err, errMsg)
+			}
+			if avail := bal.Available(p.Collat); avail < amount {
+				ctx.Println(fmt.Sprintf("beloved meat bag, you only have %.3f %s available", avail, p.Collat))
+				return nil
+			}
+		} else {
+			val, err := p.Value(prices)
+			if arango.IsBadPrice(err) {
+				ctx.Println(trade.BadPriceMessage(err))
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, errMsg)
+			}
+			collPrice, err := prices.Price(p.Collat)
+			if err != nil {
+				return errors.Wrap(err, errMsg)
+			}
+			if curr := val.Value / collPrice; amount >= curr {
+				ctx.Println(fmt.Sprintf("meat bag, the position is only worth %.3f %s, use !chip close to close it", curr, p.Collat))
+				return nil
+			}
+			if amount >= p.CollAmount {
+				ctx.Println(fmt.Sprintf("meat bag, the position only has %.3f %s of collateral, use !chip close to take its gains", p.CollAmount, p.Collat))
+				return nil
+			}
+			err = p.CheckReduce(prices, amount)
+			if arango.IsBadPrice(err) {
+				ctx.Println(trade.BadPriceMessage(err))
+				return nil
+			}
+			if err != nil {
+				ctx.Println(fmt.Sprintf("meat bag, %v", err))
+				return nil
+			}
+			amount = -amount
+		}
+		err = p.Resize(sesh, prices, amount)
+		if arango.IsBadPrice(err) {
+			ctx.Println(trade.BadPriceMessage(err))
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		ctx.Println(fmt.Sprintf(
+			"position resized: %.3f %s of collateral at %.2fx leverage with liquidation at %.3f %s/%s",
+			p.CollAmount,
+			p.Collat,
+			p.EffectiveLeverage(),
+			p.LiqPrice,
+			p.Buy,
+			p.Sell,
+		))
+		return nil
+	}
+}
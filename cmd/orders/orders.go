@@ -0,0 +1,125 @@
+package orders
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Orders lists the user's orders that haven't been executed yet
+func Orders(ctx *cli.Context) error {
+	// detected user
+	user, valid := posts.DetectUser(ctx)
+	if !valid {
+		ctx.Println("no user detected, set CHIP_USERNAME")
+		return nil
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch open orders")
+	}
+	ords, err := Open(sesh, user)
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch open orders")
+	}
+	if len(ords) == 0 {
+		ctx.Println("no open orders")
+		return nil
+	}
+	ctx.Println(Render(ords))
+	return nil
+}
+
+// Open fetches the user's limit and market orders that haven't been executed
+// yet, oldest first
+func Open(sesh arango.Store, user string) ([]*trade.Limit, error) {
+	var out []*trade.Limit
+	for _, col := range []string{"pending", "limits"} {
+		var lims []*trade.Limit
+		err := sesh.Find(col, arango.Match{"user": user}, &lims)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to fetch user's open orders")
+		}
+		out = append(out, lims...)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].CreateTime.Before(out[j].CreateTime)
+	})
+	return out, nil
+}
+
+// ByKey fetches the order that hasn't been executed yet stored under key, or
+// nil if there is none
+func ByKey(sesh arango.Store, key string) (*trade.Limit, error) {
+	for _, col := range []string{"pending", "limits"} {
+		var lims []*trade.Limit
+		err := sesh.Find(col, arango.Match{"_key": key}, &lims)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure to fetch order")
+		}
+		if len(lims) > 0 {
+			return lims[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// Render returns a formatted string that describes the user's orders
+func Render(ords []*trade.Limit) string {
+	const templ = `{{ range $i, $o := .}}
+- {{ inc $i }} )	{{$o.Kind}}{{ if $o.Group }} (oco){{end}}	{{ dir $o }}	{{$o.Buy}}	{{$o.Sell}}	{{ price $o }}	Size: {{$o.SellAmount}} {{ collat $o }}	key: {{$o.Key}}{{ with $o.Bracket }}	closes at ${{ printf "%.2f" .Upper }} / ${{ printf "%.2f" .Lower }}{{end}}{{end}}`
+	funcMap := template.FuncMap{
+		"inc": func(i int) int {
+			return i + 1
+		},
+		"dir": func(o *trade.Limit) string {
+			switch {
+			case o.Leverage == 0:
+				return "trade"
+			case o.Long:
+				return fmt.Sprintf("%dx long", o.Leverage)
+			default:
+				return fmt.Sprintf("%dx short", o.Leverage)
+			}
+		},
+		"price": func(o *trade.Limit) string {
+			switch {
+			case o.Type == trade.StopLimit:
+				return fmt.Sprintf("@ %.3f floor %.3f", o.Trigger, o.Floor)
+			case o.Type != "":
+				return fmt.Sprintf("@ %.3f", o.Trigger)
+			}
+			if o.Price == 0 {
+				return "@ market"
+			}
+			return fmt.Sprintf("@ %.3f", o.Price)
+		},
+		"collat": func(o *trade.Limit) string {
+			if o.Collat == "" {
+				return o.Sell
+			}
+			return o.Collat
+		},
+	}
+	var buf bytes.Buffer
+	twr := tabwriter.NewWriter(&buf, 1, 4, 8, ' ', 0)
+	t := template.Must(template.New("orders").Funcs(funcMap).Parse(templ))
+	err := t.Execute(twr, ords)
+	if err != nil {
+		fmt.Println("error in template exec:", err)
+	}
+	err = twr.Flush()
+	if err != nil {
+		fmt.Println("failure to render orders", err)
+	}
+	return buf.String()
+}
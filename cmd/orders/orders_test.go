@@ -0,0 +1,70 @@
+package orders
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/trade"
+)
+
+func TestOpen(t *testing.T) {
+	sesh := arango.NewMem()
+	now := time.Now().Round(time.Second)
+	err := sesh.CreateDoc("balances", &arango.Balance{User: "zkFART", Balances: map[string]float64{"USDC": 1000, "ETH": 5}, Timestamp: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lims := []trade.Limit{
+		{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 1000, Price: 400, Leverage: 2, Long: true, CreateTime: now.Add(-time.Hour)},
+		{Sell: "ETH", Buy: "BTC", User: "zkFART", SellAmount: 5, CreateTime: now},
+		{Sell: "USDC", Buy: "ETH", User: "boo", SellAmount: 50, CreateTime: now},
+	}
+	for i := range lims {
+		var err error
+		if lims[i].Price > 0 {
+			err = lims[i].Insert(sesh)
+		} else {
+			err = lims[i].InsertMarket(sesh)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ords, err := Open(sesh, "zkFART")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ords) != 2 {
+		t.Fatal("expected 2 orders, got", len(ords))
+	}
+	if ords[0].Kind() != "limit" || ords[1].Kind() != "market" {
+		t.Error("expected the oldest order first", ords[0], ords[1])
+	}
+	ren := Render(ords)
+	if !strings.Contains(ren, "2x long") || !strings.Contains(ren, "@ market") || !strings.Contains(ren, "key: "+ords[1].Key) {
+		t.Error("unexpected render", ren)
+	}
+
+	o, err := ByKey(sesh, ords[1].Key)
+	if err != nil || o == nil || o.Buy != "BTC" {
+		t.Fatal("expected to find the market order by key", o, err)
+	}
+	err = o.Cancel(sesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.Cancel(sesh)
+	if err == nil {
+		t.Error("expected cancelling twice to fail")
+	}
+	o, err = ByKey(sesh, ords[1].Key)
+	if err != nil || o != nil {
+		t.Error("expected the cancelled order to be gone", o, err)
+	}
+	ords, _ = Open(sesh, "zkFART")
+	if len(ords) != 1 {
+		t.Error("expected 1 order left, got", len(ords))
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"html/template"
 	"os"
+	"strconv"
 	"text/tabwriter"
 
 	"github.com/evan-forbes/chip/arango"
 	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -20,7 +22,7 @@ func Posts(ctx *cli.Context) error {
 		ctx.Println("no user detected, set CHIP_USERNAME")
 	}
 	// fetch open positions
-	sesh, err := arango.NewSesh(ctx.Context, "cookie")
+	sesh, err := arango.Open(ctx.Context, config.Current())
 	if err != nil {
 		return errors.Wrap(err, "failure to fetch open positions")
 	}
@@ -33,7 +35,11 @@ func Posts(ctx *cli.Context) error {
 		return nil
 	}
 	// render
-	ren, err := Render(sesh, pos)
+	ren, err := Render(arango.NewSnapshotFrom(sesh, config.Current()), pos)
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
 	if err != nil {
 		return errors.Wrap(err, "failure to render positions")
 	}
@@ -41,19 +47,9 @@ func Posts(ctx *cli.Context) error {
 	return nil
 }
 
-func Open(sesh *arango.Sesh, user string) ([]*trade.Position, error) {
-	const query = `
-	let out = (
-		for p in positions
-			filter p.alive == true
-			filter p.user == "%s"
-			sort p._key desc
-			return p
-	)
-	return out
-	`
+func Open(sesh arango.Store, user string) ([]*trade.Position, error) {
 	var pos []*trade.Position
-	err := sesh.Execute(fmt.Sprintf(query, user), &pos)
+	err := sesh.Find("positions", arango.Match{"alive": true, "user": user}, &pos)
 	if err != nil {
 		return nil, errors.Wrap(err, "failure to fetch user's open positions")
 	}
@@ -76,9 +72,9 @@ func DetectUser(ctx *cli.Context) (string, bool) {
 }
 
 // Render returns a formatted string that descibes the user's positions
-func Render(sesh *arango.Sesh, posts []*trade.Position) (string, error) {
+func Render(prices arango.PriceOracle, posts []*trade.Position) (string, error) {
 	const templ = `{{ range $i, $p := .}}
-- {{ inc $i }} )	${{with $cv := $p.CurrValue}}{{printf "%.3f" $cv}}{{end}}	{{$p.Leverage}}x	{{$p.Dir}}	{{$p.Buy}}	{{$p.Sell}}	Size: {{$p.CollAmount}} {{$p.Collat}}{{end}}`
+- {{ inc $i }} )	${{with $cv := $p.CurrValue}}{{printf "%.3f" $cv}}{{end}}	{{printf "%.3g" $p.EffectiveLeverage}}x	{{$p.Dir}}	{{$p.Buy}}	{{$p.Sell}}	Size: {{$p.CollAmount}} {{$p.Collat}}{{ if $p.Funding }}	Funding: {{printf "%.3f" $p.Funding}} {{$p.Collat}}{{end}}{{end}}`
 	funcMap := template.FuncMap{
 		// The name "inc" is what the function will be called in the template text.
 		"inc": func(i int) int {
@@ -87,7 +83,7 @@ func Render(sesh *arango.Sesh, posts []*trade.Position) (string, error) {
 	}
 	for _, p := range posts {
 		p.SetDir()
-		posVal, err := p.Value(sesh)
+		posVal, err := p.Value(prices)
 		if err != nil {
 			return "", errors.Wrap(err, "failure to calc position value")
 		}
@@ -108,3 +104,35 @@ func Render(sesh *arango.Sesh, posts []*trade.Position) (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// Select returns the position picked with the position flag, or asks the user
+// to pick one. Returns nil if no valid position was picked.
+func Select(ctx *cli.Context, prices arango.PriceOracle, pos []*trade.Position) (*trade.Position, error) {
+	p := ctx.Int("position")
+	if p > 0 && p <= len(pos) {
+		return pos[p-1], nil
+	}
+	// render
+	ren, err := Render(prices, pos)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to render positions")
+	}
+	// show the render and ask for input
+	ctx.Println(ren)
+	rawinput, err := ctx.Input("please select a position (enter a number)")
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to select position: no input")
+	}
+	// check input
+	input, err := strconv.ParseInt(rawinput, 10, 64)
+	if err != nil {
+		ctx.Println(fmt.Sprintf("aborting: could not parse input: %s, please enter a number next time", rawinput))
+		return nil, nil
+	}
+	p = int(input)
+	if p > 0 && p <= len(pos) {
+		return pos[p-1], nil
+	}
+	ctx.Println("aborting: invalid selection, please select a position number")
+	return nil, nil
+}
@@ -0,0 +1,413 @@
+package stamps
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/chart"
+	"github.com/evan-forbes/chip/cmd/folio"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const CompactUsageText = `
+// keep a week of raw prices, hourly candles up to 90 days, and daily after that.
+// portfolio valuations are thinned to one an hour and one a day the same way
+chip stamps compact
+
+// keep only a day of raw prices and archive them somewhere else
+chip stamps compact --hourly 1d --archive /mnt/backup/chip
+
+// safe to run again after being interrupted, it picks up where it stopped
+chip stamps compact -b 5000
+`
+
+const (
+	hourSpan = "1h"
+	daySpan  = "1d"
+	day      = time.Hour * 24
+)
+
+// CompactFlags returns the flags for the stamps compact command
+func CompactFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "hourly",
+			Value: "7d",
+			Usage: "stamps older than this are compacted into hourly candles",
+		},
+		&cli.StringFlag{
+			Name:  "daily",
+			Value: "90d",
+			Usage: "history older than this is kept as daily candles",
+		},
+		&cli.StringFlag{
+			Name:  "archive",
+			Value: DefaultArchive(),
+			Usage: "directory the raw stamps are exported to before being deleted",
+		},
+		&cli.IntFlag{
+			Name:    "batch",
+			Aliases: []string{"b"},
+			Value:   1000,
+			Usage:   "number of stamps deleted at a time",
+		},
+	}
+}
+
+// DefaultArchive is the directory raw stamps are exported to if no other is given
+func DefaultArchive() string {
+	return filepath.Join(filepath.Dir(config.DefaultPath()), "archive")
+}
+
+// CompactCmd downsamples, archives and deletes old stamps
+func CompactCmd(ctx *cli.Context) error {
+	const errMsg = "failure to compact stamps"
+	if ctx.Slug != nil {
+		ctx.Println("meat bag, stamp compaction can only be run by my operator")
+		return nil
+	}
+	hourly, err := chart.ParseRange(ctx.String("hourly"))
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	daily, err := chart.ParseRange(ctx.String("daily"))
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if daily < hourly {
+		return errors.Errorf("%s: --daily must be at least as long as --hourly", errMsg)
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	now := time.Now()
+	opts := Options{
+		Hourly:  now.Add(-hourly),
+		Daily:   now.Add(-daily).Truncate(day),
+		Archive: ctx.String("archive"),
+		Batch:   ctx.Int("batch"),
+	}
+	prog, err := Compact(sesh, opts, func(p Progress) {
+		ctx.Println(p.String())
+	})
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	ctx.Println(fmt.Sprintf("done: %s", prog.String()))
+	return nil
+}
+
+// Options describes what Compact keeps
+type Options struct {
+	// Hourly is the time before which stamps are compacted into hourly candles
+	// and valuations are thinned to one an hour
+	Hourly time.Time
+	// Daily is the time before which history is kept as daily candles and
+	// valuations are thinned to one a day
+	Daily time.Time
+	// Archive is the directory raw stamps are exported to
+	Archive string
+	// Batch is the number of stamps or candles deleted in each transaction
+	Batch int
+}
+
+// Progress counts what Compact has done so far
+type Progress struct {
+	// Total is the number of stamps there were when compaction started
+	Total int
+	// Stamps is the number of stamps archived and deleted
+	Stamps int
+	// Candles is the number of hourly candles merged into daily ones
+	Candles int
+	// Valuations is the number of valuations deleted while thinning
+	Valuations int
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("compacted %d/%d stamps, merged %d hourly candles, thinned %d valuations", p.Stamps, p.Total, p.Candles, p.Valuations)
+}
+
+// Compact archives the stamps from before opts.Hourly, folds them into hourly
+// or daily candles, and deletes them, one batch at a time. Hourly candles from
+// before opts.Daily are then merged into daily candles. Each batch is its own
+// transaction, so an interrupted compaction resumes by running it again. A
+// batch can be archived more than once if it was interrupted before being
+// deleted, so readers of the archive should ignore repeated keys. Finally the
+// valuations of every user are thinned to match the candles.
+func Compact(sesh arango.Store, opts Options, report func(Progress)) (Progress, error) {
+	var prog Progress
+	if opts.Batch <= 0 {
+		return prog, errors.New("batch size must be positive")
+	}
+	total, err := sesh.CountStamps()
+	if err != nil {
+		return prog, errors.Wrap(err, "failure to count stamps")
+	}
+	prog.Total = total
+	for {
+		old, keys, err := sesh.ExportStamps(opts.Hourly, opts.Batch)
+		if err != nil {
+			return prog, err
+		}
+		if len(old) == 0 {
+			break
+		}
+		err = archive(opts.Archive, old)
+		if err != nil {
+			return prog, err
+		}
+		candles := make(map[string]*arango.Candle)
+		for _, s := range old {
+			if s.Price <= 0 {
+				continue
+			}
+			span, length := hourSpan, time.Hour
+			if s.Time.Before(opts.Daily) {
+				span, length = daySpan, day
+			}
+			c := &arango.Candle{
+				Symbol: s.Symbol,
+				Span:   span,
+				Start:  s.Time.Truncate(length),
+				First:  s.Time,
+				Last:   s.Time,
+				Open:   s.Price,
+				High:   s.Price,
+				Low:    s.Price,
+				Close:  s.Price,
+			}
+			c.Key = arango.CandleKey(c.Symbol, c.Span, c.Start)
+			if curr, has := candles[c.Key]; has {
+				curr.Merge(c)
+				continue
+			}
+			candles[c.Key] = c
+		}
+		err = sesh.Atomic([]string{"stamps", "candles"}, func(tx arango.Store) error {
+			for _, c := range candles {
+				err := upsert(tx, c)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.RemoveStamps(keys)
+		})
+		if err != nil {
+			return prog, errors.Wrap(err, "failure to compact batch of stamps")
+		}
+		prog.Stamps += len(old)
+		report(prog)
+	}
+	err = rollup(sesh, opts, &prog, report)
+	if err != nil {
+		return prog, err
+	}
+	err = thin(sesh, opts, &prog, report)
+	return prog, err
+}
+
+// rollup merges the hourly candles from before opts.Daily into daily candles
+func rollup(sesh arango.Store, opts Options, prog *Progress, report func(Progress)) error {
+	iter, err := sesh.Iter("candles", arango.Match{"span": hourSpan})
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch hourly candles")
+	}
+	defer iter.Close()
+	var batch []*arango.Candle
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := sesh.Atomic([]string{"candles"}, func(tx arango.Store) error {
+			for _, hourly := range batch {
+				daily := *hourly
+				daily.Span = daySpan
+				daily.Start = hourly.Start.Truncate(day)
+				daily.Key = arango.CandleKey(daily.Symbol, daily.Span, daily.Start)
+				err := upsert(tx, &daily)
+				if err != nil {
+					return err
+				}
+				err = tx.RemoveDoc("candles", hourly.Key)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failure to merge hourly candles")
+		}
+		prog.Candles += len(batch)
+		batch = batch[:0]
+		report(*prog)
+		return nil
+	}
+	for {
+		var c arango.Candle
+		more, err := iter.Next(&c)
+		if err != nil {
+			return errors.Wrap(err, "failure to fetch hourly candles")
+		}
+		if !more {
+			break
+		}
+		if !c.Start.Before(opts.Daily) {
+			continue
+		}
+		batch = append(batch, &c)
+		if len(batch) >= opts.Batch {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// thin keeps only the last valuation of each user in every hour before
+// opts.Hourly, or every day before opts.Daily, so the portfolio history is
+// kept at the same resolution as the candles. Valuations are not archived, as
+// they can't be charted at a finer resolution than the prices behind them.
+func thin(sesh arango.Store, opts Options, prog *Progress, report func(Progress)) error {
+	users, err := sesh.AllUsers()
+	if err != nil {
+		return errors.Wrap(err, "failure to thin valuations")
+	}
+	var batch []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := sesh.Atomic([]string{"valuations"}, func(tx arango.Store) error {
+			for _, key := range batch {
+				err := tx.RemoveDoc("valuations", key)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failure to thin valuations")
+		}
+		prog.Valuations += len(batch)
+		batch = batch[:0]
+		report(*prog)
+		return nil
+	}
+	for _, user := range users {
+		iter, err := sesh.Valuations(user, time.Unix(0, 0), opts.Hourly)
+		if err != nil {
+			return errors.Wrap(err, "failure to thin valuations")
+		}
+		var prev *folio.Valuation
+		var prevStart time.Time
+		for {
+			var v folio.Valuation
+			more, err := iter.Next(&v)
+			if err != nil {
+				iter.Close()
+				return errors.Wrap(err, "failure to thin valuations")
+			}
+			if !more {
+				break
+			}
+			length := time.Hour
+			if v.Time.Before(opts.Daily) {
+				length = day
+			}
+			start := v.Time.Truncate(length)
+			// a later valuation in the same span replaces the previous one
+			if prev != nil && start.Equal(prevStart) {
+				batch = append(batch, prev.Key)
+			}
+			prev, prevStart = &v, start
+			if len(batch) >= opts.Batch {
+				err = flush()
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+		iter.Close()
+	}
+	return flush()
+}
+
+// upsert merges c into the candle stored under its key, creating it if needed
+func upsert(tx arango.Store, c *arango.Candle) error {
+	var found []*arango.Candle
+	err := tx.Find("candles", arango.Match{"_key": c.Key}, &found)
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch candle")
+	}
+	if len(found) == 0 {
+		return tx.CreateDoc("candles", c)
+	}
+	curr := found[0]
+	curr.Merge(c)
+	return tx.Update("candles", c.Key, curr)
+}
+
+// archive appends stamps to gzipped json lines files in dir, one file for each
+// day the stamps were recorded. Each call adds a gzip member to the end of the
+// file, which is read back as a single stream.
+func archive(dir string, stamps []*arango.Stamp) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failure to create archive directory")
+	}
+	byDay := make(map[string][]*arango.Stamp)
+	var days []string
+	for _, s := range stamps {
+		name := fmt.Sprintf("stamps-%s.jsonl.gz", s.Time.UTC().Format("2006-01-02"))
+		if _, has := byDay[name]; !has {
+			days = append(days, name)
+		}
+		byDay[name] = append(byDay[name], s)
+	}
+	for _, name := range days {
+		err = appendArchive(filepath.Join(dir, name), byDay[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendArchive(path string, stamps []*arango.Stamp) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failure to open archive %s", path)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	for _, s := range stamps {
+		err = enc.Encode(s)
+		if err != nil {
+			return errors.Wrapf(err, "failure to write archive %s", path)
+		}
+	}
+	err = gz.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failure to write archive %s", path)
+	}
+	// the stamps are deleted next, so make sure they are on disk first
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "failure to write archive %s", path)
+	}
+	return f.Close()
+}
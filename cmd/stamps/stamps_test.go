@@ -0,0 +1,249 @@
+package stamps
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/folio"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := arango.NewMem()
+	now := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+	// a price every 15 minutes for the last 10 days
+	var prices []*arango.Stamp
+	for tm := now.Add(-day * 10); tm.Before(now); tm = tm.Add(time.Minute * 15) {
+		prices = append(prices, &arango.Stamp{Symbol: "ETH", Price: float64(tm.Hour() + 1), Cap: 1, Time: tm})
+	}
+	err = m.CreateDocs("stamps", prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Hourly:  now.Add(-day * 2),
+		Daily:   now.Add(-day * 5).Truncate(day),
+		Archive: dir,
+		Batch:   100,
+	}
+	var reports int
+	prog, err := Compact(m, opts, func(Progress) { reports++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Total != len(prices) || prog.Stamps != 8*24*4 || prog.Candles != 0 {
+		t.Errorf("unexpected progress %+v", prog)
+	}
+	if reports < 8*24*4/100 {
+		t.Error("expected progress after every batch, got", reports)
+	}
+	count, _ := m.CountStamps()
+	if count != 2*24*4 {
+		t.Error("expected 2 days of raw stamps to be kept, got", count)
+	}
+
+	var hourly, daily []*arango.Candle
+	m.Find("candles", arango.Match{"span": hourSpan}, &hourly)
+	m.Find("candles", arango.Match{"span": daySpan}, &daily)
+	// from midnight 5 days ago is hourly, anything before is daily
+	if len(hourly) != 3*24+12 || len(daily) != 5 {
+		t.Fatalf("expected 84 hourly and 5 daily candles, got %d and %d", len(hourly), len(daily))
+	}
+	for _, c := range daily {
+		// the first day only starts at noon
+		if c.First.Hour() != 0 {
+			continue
+		}
+		if c.Open != 1 || c.Close != 24 || c.High != 24 || c.Low != 1 {
+			t.Errorf("unexpected daily candle %+v", c)
+		}
+	}
+
+	// hourly candles are merged into daily ones once they get old enough
+	opts.Daily = now.Add(-day * 3).Truncate(day)
+	prog, err = Compact(m, opts, func(Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Stamps != 0 || prog.Candles != 2*24 {
+		t.Errorf("expected only 48 hourly candles to be merged, got %+v", prog)
+	}
+	m.Find("candles", arango.Match{"span": hourSpan}, &hourly)
+	m.Find("candles", arango.Match{"span": daySpan}, &daily)
+	if len(hourly) != 36 || len(daily) != 7 {
+		t.Fatalf("expected 36 hourly and 7 daily candles, got %d and %d", len(hourly), len(daily))
+	}
+	for _, c := range daily[:2] {
+		if c.Open != 1 || c.Close != 24 || c.High != 24 || c.Low != 1 {
+			t.Errorf("unexpected merged daily candle %+v", c)
+		}
+	}
+
+	// running it again does nothing
+	again, err := Compact(m, opts, func(Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Stamps != 0 || again.Candles != 0 {
+		t.Errorf("expected nothing left to compact, got %+v", again)
+	}
+
+	// the charts still cover the compacted history
+	candles, err := arango.PriceHistory(m, "ETH", now.Add(-day*10), now, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 10 {
+		t.Error("expected 10 daily candles of history, got", len(candles))
+	}
+
+	// every compacted stamp was archived
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if len(files) != 9 {
+		t.Fatal("expected an archive for each of 9 days, got", len(files))
+	}
+	var archived int
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scan := bufio.NewScanner(gz)
+		for scan.Scan() {
+			var s arango.Stamp
+			err = json.Unmarshal(scan.Bytes(), &s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archived++
+		}
+		f.Close()
+	}
+	if archived != 8*24*4 {
+		t.Errorf("expected %d archived stamps, got %d", 8*24*4, archived)
+	}
+}
+
+func TestCompactOutOfOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := arango.NewMem()
+	now := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+	// recent stamps were ingested before a backfill of old ones, so key order
+	// no longer matches time order
+	for i := 0; i < 3; i++ {
+		err = m.CreateDoc("stamps", &arango.Stamp{Symbol: "ETH", Price: 1, Time: now.Add(-time.Hour * time.Duration(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		err = m.CreateDoc("stamps", &arango.Stamp{Symbol: "ETH", Price: 1, Time: now.Add(-day*4 - time.Hour*time.Duration(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{
+		Hourly:  now.Add(-day * 2),
+		Daily:   now.Add(-day * 5),
+		Archive: dir,
+		Batch:   2,
+	}
+	prog, err := Compact(m, opts, func(Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Stamps != 5 {
+		t.Errorf("expected all 5 old stamps to be compacted, got %+v", prog)
+	}
+	count, _ := m.CountStamps()
+	if count != 3 {
+		t.Error("expected the 3 recent stamps to be kept, got", count)
+	}
+}
+
+func TestCompactValuations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := arango.NewMem()
+	err = m.CreateDoc("users", map[string]string{"_key": "test", "channel_id": "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+	// a valuation every 15 minutes for the last 10 days
+	var vals []*folio.Valuation
+	for tm := now.Add(-day * 10); tm.Before(now); tm = tm.Add(time.Minute * 15) {
+		vals = append(vals, &folio.Valuation{User: "test", Time: tm, Total: float64(tm.Minute())})
+	}
+	err = m.CreateDocs("valuations", vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Hourly:  now.Add(-day * 2),
+		Daily:   now.Add(-day * 5).Truncate(day),
+		Archive: dir,
+		Batch:   100,
+	}
+	prog, err := Compact(m, opts, func(Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 days of raw valuations, 84 hourly and 5 daily ones are kept
+	kept := 2*24*4 + 3*24 + 12 + 5
+	if prog.Valuations != len(vals)-kept {
+		t.Errorf("expected %d valuations to be thinned, got %+v", len(vals)-kept, prog)
+	}
+	iter, err := m.Valuations("test", time.Unix(0, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []*folio.Valuation
+	err = arango.ReadAll(iter, &left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != kept {
+		t.Fatalf("expected %d valuations to be kept, got %d", kept, len(left))
+	}
+	for _, v := range left {
+		// the last valuation of each hour or day is the one kept
+		if v.Time.Before(opts.Hourly) && v.Total != 45 {
+			t.Error("expected the last valuation of the span to be kept, got", v.Time)
+		}
+	}
+
+	// thinning again has nothing left to do
+	prog, err = Compact(m, opts, func(Progress) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Valuations != 0 {
+		t.Errorf("expected nothing more to be thinned, got %+v", prog)
+	}
+}
@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/evan-forbes/chip/analyze"
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/chart"
+	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const UsageText = `
+// see how you traded over the last 30 days
+!chip stats
+
+// see how another meat bag traded over the last week
+!chip stats @zkFART -w 7d
+
+// see all of your history
+!chip stats -w all
+`
+
+// Flags returns the flags for the stats command
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "window",
+			Aliases: []string{"w"},
+			Value:   "30d",
+			Usage:   "how far back to look, like 24h, 7d or all",
+		},
+	}
+}
+
+// Stats shows the trading stats of the user, or of the user given as an
+// argument
+func Stats(ctx *cli.Context) error {
+	const errMsg = "failure to show stats"
+	user := strings.TrimPrefix(ctx.Args().First(), "@")
+	if user == "" {
+		var valid bool
+		user, valid = posts.DetectUser(ctx)
+		if !valid {
+			ctx.Println("no user detected, set CHIP_USERNAME")
+			return nil
+		}
+	}
+	window, err := ParseWindow(ctx.String("window"))
+	if err != nil {
+		ctx.Println(fmt.Sprintf("meat bag, I don't understand the window %s, try something like 24h, 7d or all", ctx.String("window")))
+		return nil
+	}
+	sesh, err := arango.Open(ctx.Context, config.Current())
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	users, err := sesh.AllUsers()
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	if !contains(users, user) {
+		ctx.Println(fmt.Sprintf("meat bag, I don't know anyone called %s", user))
+		return nil
+	}
+	st, err := analyze.Analyze(sesh, arango.NewSnapshotFrom(sesh, config.Current()), user, window, time.Now())
+	if arango.IsBadPrice(err) {
+		ctx.Println(trade.BadPriceMessage(err))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, errMsg)
+	}
+	ctx.Println(st.Render())
+	return nil
+}
+
+// ParseWindow parses a window like 7d, or all for no window at all
+func ParseWindow(raw string) (time.Duration, error) {
+	if strings.EqualFold(strings.TrimSpace(raw), "all") {
+		return 0, nil
+	}
+	return chart.ParseRange(raw)
+}
+
+func contains(list []string, item string) bool {
+	for _, x := range list {
+		if x == item {
+			return true
+		}
+	}
+	return false
+}
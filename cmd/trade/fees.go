@@ -0,0 +1,35 @@
+package trade
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/pkg/errors"
+)
+
+// costs returns the fee rate and slippage of an order worth size USD trading
+// sell for buy. Maker orders wait for their price, so they don't slip.
+func costs(prices arango.PriceOracle, sell, buy string, size float64, maker bool) (rate, slip float64, err error) {
+	fees := prices.FeesFor(buy, sell)
+	if maker {
+		return fees.Maker, 0, nil
+	}
+	// the less liquid side of the trade moves the most
+	for _, symbol := range []string{sell, buy} {
+		s, err := prices.Slippage(symbol, size)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "failure to calculate slippage")
+		}
+		slip = math.Max(slip, s)
+	}
+	return fees.Taker, slip, nil
+}
+
+// renderCosts describes the fee and slippage paid by an executed order
+func (l *Limit) renderCosts() string {
+	if l.Fee == 0 && l.Slippage == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (fee: %.6f %s, slippage: %.3f%%)", l.Fee, l.FeeAsset, l.Slippage*100)
+}
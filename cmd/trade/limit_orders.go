@@ -2,7 +2,6 @@ package trade
 
 import (
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/evan-forbes/chip/arango"
@@ -11,28 +10,49 @@ import (
 )
 
 // CheckLimits fetches all limit orders of a given grouping, either pending
-// (market orders) or limits (limit orders)
-func CheckLimits(srv *disc.Server, sesh *arango.Sesh) error {
-	const query = `
-	let out = (
-		for l in limits
-			return l
-	)
-	return out
-	`
+// (market orders) or limits (limit orders). Orders that can't be priced are
+// skipped until the next tick.
+func CheckLimits(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle) error {
 	errMsg := "failure check limits"
-	var limits []Limit
-	err := sesh.Execute(query, &limits)
+	iter, err := sesh.Iter("limits", nil)
 	if err != nil {
 		return errors.Wrap(err, errMsg)
 	}
-	for _, lim := range limits {
-		ready, err := lim.IsReady(sesh)
+	defer iter.Close()
+	skips := make(skipped)
+	defer skips.notify(srv, sesh)
+	for {
+		var lim Limit
+		more, err := iter.Next(&lim)
 		if err != nil {
 			return errors.Wrap(err, errMsg)
 		}
+		if !more {
+			break
+		}
+		armed := lim.Triggered
+		ready, err := lim.IsReady(prices)
+		if arango.IsBadPrice(err) {
+			skips.add(lim.User, "limit order "+lim.Key, err)
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		// remember stop-limit orders that were triggered, in case they can't
+		// be filled yet
+		if lim.Triggered && !armed {
+			err = lim.arm(sesh)
+			if err != nil {
+				return errors.Wrap(err, errMsg)
+			}
+		}
 		if ready {
-			err := lim.Execute(srv, sesh)
+			err := lim.Execute(srv, sesh, prices)
+			if arango.IsBadPrice(err) {
+				skips.add(lim.User, "limit order "+lim.Key, err)
+				continue
+			}
 			if err != nil {
 				return errors.Wrap(err, errMsg)
 			}
@@ -41,23 +61,31 @@ func CheckLimits(srv *disc.Server, sesh *arango.Sesh) error {
 	return nil
 }
 
-func ExecuteMarketOrders(srv *disc.Server, sesh *arango.Sesh) error {
-	const query = `
-	let out = (
-		for l in pending
-			return l
-	)
-	return out
-	`
+// ExecuteMarketOrders executes every pending market order. Orders that can't
+// be priced are left pending until the next tick.
+func ExecuteMarketOrders(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle) error {
 	errMsg := "failure execute market orders"
-	// connect to the db
-	var limits []Limit
-	err := sesh.Execute(query, &limits)
+	iter, err := sesh.Iter("pending", nil)
 	if err != nil {
 		return errors.Wrap(err, errMsg)
 	}
-	for _, lim := range limits {
-		err := lim.Execute(srv, sesh)
+	defer iter.Close()
+	skips := make(skipped)
+	defer skips.notify(srv, sesh)
+	for {
+		var lim Limit
+		more, err := iter.Next(&lim)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		if !more {
+			break
+		}
+		err = lim.Execute(srv, sesh, prices)
+		if arango.IsBadPrice(err) {
+			skips.add(lim.User, "market order "+lim.Key, err)
+			continue
+		}
 		if err != nil {
 			return errors.Wrap(err, errMsg)
 		}
@@ -80,70 +108,281 @@ type Limit struct {
 	ExecTime   time.Time `json:"exec_time,omitempty"` // time when the order was executed
 	Leverage   int       `json:"leverage"`
 	Long       bool      `json:"long"`
-	liqPrice   float64   // price at which position is worthless
+	// Type is set for stop and take-profit orders, see stops.go
+	Type string `json:"type,omitempty"`
+	// Trigger is the price of the sold asset, in the bought asset, at which a
+	// stop or take-profit order is triggered
+	Trigger float64 `json:"trigger,omitempty"`
+	// Floor is the lowest price of the sold asset, in the bought asset, that a
+	// triggered stop-limit order is executed at
+	Floor float64 `json:"floor,omitempty"`
+	// Triggered is set once a stop-limit order's stop has been hit
+	Triggered bool `json:"triggered,omitempty"`
+	// Group is shared by one-cancels-other orders, executing one of them
+	// removes the rest
+	Group string `json:"group,omitempty"`
+	// Bracket becomes the close condition of the position opened by a levered
+	// order
+	Bracket *CloseCondition `json:"bracket,omitempty"`
+	// Fee is the trading fee paid when the order was executed, in FeeAsset,
+	// which is the bought asset of a trade or the collateral of a position
+	Fee      float64 `json:"fee,omitempty"`
+	FeeAsset string  `json:"fee_asset,omitempty"`
+	// Slippage is the fraction the price moved against a market order
+	Slippage float64 `json:"slippage,omitempty"`
+	// Value is the worth in USD of what an executed trade sold
+	Value float64 `json:"value,omitempty"`
+	// Filled is the kind of order that was executed, since executing a market
+	// order sets its price
+	Filled   string  `json:"filled,omitempty"`
+	liqPrice float64 // price at which position is worthless
 }
 
 // Insert adds the limit to the database for potential execution
-func (l *Limit) Insert(sesh *arango.Sesh) error {
+func (l *Limit) Insert(sesh arango.Store) error {
 	return sesh.CreateDoc("limits", l)
 }
 
 // InsertMarket adds the limit to database to be executed upon the next price
 // update
-func (l *Limit) InsertMarket(sesh *arango.Sesh) error {
+func (l *Limit) InsertMarket(sesh arango.Store) error {
 	return sesh.CreateDoc("pending", l)
 }
 
-// Execute assumes the limit order is valid and changes the user's balance
-// accordingly, being followed by deleting the limit order from the database
-func (l *Limit) Execute(srv *disc.Server, sesh *arango.Sesh) error {
-	// get the user's balance
-	bal, err := arango.LatestBalance(sesh, l.User)
+// Place reserves the funds needed by the order and inserts it for execution,
+// returning false if the user doesn't have enough available
+func (l *Limit) Place(sesh arango.Store) (bool, error) {
+	return PlaceGroup(sesh, l)
+}
+
+// PlaceGroup places orders that sell the same funds as a one-cancels-other
+// group. The funds are only reserved once, since only one of the orders can be
+// executed.
+func PlaceGroup(sesh arango.Store, lims ...*Limit) (bool, error) {
+	if len(lims) == 0 {
+		return false, nil
+	}
+	first := lims[0]
+	if len(lims) > 1 {
+		group := fmt.Sprintf("%s-%d", first.User, time.Now().UnixNano())
+		for _, l := range lims {
+			l.Group = group
+		}
+	}
+	placed := false
+	err := sesh.Atomic([]string{"balances", "limits", "pending"}, func(tx arango.Store) error {
+		bal, err := tx.LatestBalance(first.User)
+		if err != nil {
+			return err
+		}
+		asset, amount := first.reserved()
+		if !bal.Reserve(asset, amount) {
+			return nil
+		}
+		bal.Timestamp = time.Now().Round(time.Second)
+		err = tx.CreateDoc("balances", bal)
+		if err != nil {
+			return err
+		}
+		for _, l := range lims {
+			err = tx.CreateDoc(l.col(), l)
+			if err != nil {
+				return err
+			}
+		}
+		placed = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failure to place order")
+	}
+	return placed, nil
+}
+
+// Cancel removes the order, and the rest of its group, before it gets
+// executed, releasing its funds
+func (l *Limit) Cancel(sesh arango.Store) error {
+	err := sesh.Atomic([]string{"balances", "limits", "pending"}, func(tx arango.Store) error {
+		err := tx.RemoveDoc(l.col(), l.Key)
+		if err != nil {
+			return err
+		}
+		err = l.removeSiblings(tx)
+		if err != nil {
+			return err
+		}
+		return l.release(tx)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failure to cancel order %s", l.Key)
+	}
+	return nil
+}
+
+// reserved returns the asset and amount locked while the order is open
+func (l *Limit) reserved() (string, float64) {
+	if l.Collat != "" {
+		return l.Collat, l.SellAmount
+	}
+	return l.Sell, l.SellAmount
+}
+
+// release unlocks the funds reserved by the order in a new balance entry
+func (l *Limit) release(sesh arango.Store) error {
+	bal, err := sesh.LatestBalance(l.User)
 	if err != nil {
-		return errors.Wrap(err, "could not execute limit order")
+		return err
+	}
+	asset, _ := l.reserved()
+	// orders placed before funds were reserved have nothing to release
+	if bal.Reserved[asset] == 0 {
+		return nil
+	}
+	bal.Release(l.reserved())
+	bal.Timestamp = time.Now().Round(time.Second)
+	return sesh.CreateDoc("balances", bal)
+}
+
+// removeSiblings removes the other orders in the order's group. Their funds
+// were reserved once for the whole group, so nothing is released.
+func (l *Limit) removeSiblings(sesh arango.Store) error {
+	if l.Group == "" {
+		return nil
+	}
+	for _, col := range []string{"limits", "pending"} {
+		var sibs []Limit
+		err := sesh.Find(col, arango.Match{"group": l.Group}, &sibs)
+		if err != nil {
+			return errors.Wrap(err, "failure to fetch grouped orders")
+		}
+		for _, sib := range sibs {
+			if sib.Key == l.Key {
+				continue
+			}
+			err = sesh.RemoveDoc(col, sib.Key)
+			if err != nil {
+				return errors.Wrap(err, "failure to remove grouped order")
+			}
+		}
+	}
+	return nil
+}
+
+// Kind describes how the order gets executed
+func (l *Limit) Kind() string {
+	if l.Type != "" {
+		return l.Type
+	}
+	if l.Price == 0 {
+		return "market"
+	}
+	return "limit"
+}
+
+// orderCols are the collections written to when an order is executed
+var orderCols = []string{"balances", "trades", "positions", "post_events", "limits", "pending"}
+
+// col returns the collection the order waits in before execution
+func (l *Limit) col() string {
+	// stop orders wait for their trigger like limit orders
+	if l.Price == 0 && l.Type == "" {
+		return "pending"
 	}
+	return "limits"
+}
+
+// Execute assumes the limit order is valid and changes the user's balance
+// accordingly, being followed by deleting the limit order from the database.
+// All of the changes are made in a single transaction, so a failure part way
+// through never leaves funds spent twice or lost.
+func (l *Limit) Execute(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle) error {
 	// get the user's channel id to write to
-	id, err := arango.UserChanID(sesh, l.User)
+	id, err := sesh.UserChanID(l.User)
 	if err != nil {
 		return errors.Wrap(err, "failure to find user during limit order execution")
 	}
+	var msg string
+	err = sesh.Atomic(orderCols, func(tx arango.Store) error {
+		msg, err = l.execute(tx, prices)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failure to execute limit order")
+	}
+	// the order was removed before it could be executed
+	if msg == "" {
+		return nil
+	}
+	// notify the user once the changes are committed
+	return srv.Message(id, msg)
+}
+
+// execute makes the changes described by the order, returning the message to
+// send to the user, or nothing if the order no longer exists or can't be
+// filled yet
+func (l *Limit) execute(sesh arango.Store, prices arango.PriceOracle) (string, error) {
+	// grouped orders can be removed by a sibling executed earlier in the tick
+	var curr []Limit
+	err := sesh.Find(l.col(), arango.Match{"_key": l.Key}, &curr)
+	if err != nil {
+		return "", errors.Wrap(err, "could not execute limit order")
+	}
+	if len(curr) == 0 {
+		return "", nil
+	}
+	l.Filled = l.Kind()
+	// get the user's balance
+	bal, err := sesh.LatestBalance(l.User)
+	if err != nil {
+		return "", errors.Wrap(err, "could not execute limit order")
+	}
+	// the funds reserved for this order are about to be used
+	bal.Release(l.reserved())
 
 	// check that the user has enough collateral or amount to sell
 	if l.Collat != "" {
-		collBal, has := bal.Balances[l.Collat]
-		if collBal < l.SellAmount || !has {
+		if bal.Available(l.Collat) < l.SellAmount {
 			errMsg := fmt.Sprintf("meat bag, failed to execute your limit order %s: you do not have enough %s", l.Key, l.Collat)
-			srv.Message(id, errMsg)
 			// remove the limit order
-			return sesh.RemoveDoc("limits", l.Key)
+			return errMsg, l.drop(sesh, bal)
 		}
 	} else {
 		// check the user's sell balance
-		sellBal, has := bal.Balances[l.Sell]
-		if sellBal < l.SellAmount || !has {
+		if bal.Available(l.Sell) < l.SellAmount {
 			errMsg := fmt.Sprintf("meat bag, failed to execute your limit order: you do not have enough %s", l.Sell)
-			srv.Message(id, errMsg)
 			// remove the limit order
-			return sesh.RemoveDoc("limits", l.Key)
+			return errMsg, l.drop(sesh, bal)
 		}
 		l.Collat = l.Sell
 	}
 	switch {
+	// stop and take-profit orders are executed at market once triggered
+	case l.Type != "":
+		err = l.executeMarketTrade(sesh, prices, bal)
 	// limit should be executed at market
 	case l.Price > 0 && l.Leverage == 0:
-		err = l.executeTrade(sesh, bal)
+		err = l.executeTrade(sesh, prices, bal)
 	// limit order should be executed at market prices
 	case l.Price == 0 && l.Leverage > 0:
-		err = l.executeMarketLevered(sesh, bal)
+		err = l.executeMarketLevered(sesh, prices, bal)
 	// limit order is not levered
 	case l.Price == 0 && l.Leverage == 0:
-		err = l.executeMarketTrade(sesh, bal)
+		err = l.executeMarketTrade(sesh, prices, bal)
 	// limit order is levered
 	case l.Price > 0 && l.Leverage > 0:
-		err = l.executeLevered(sesh, bal)
+		err = l.executeLevered(sesh, prices, bal)
+	}
+	// nothing has been written yet, so the order is left to wait
+	if err == errBelowFloor {
+		return "", nil
 	}
 	if err != nil {
-		return errors.Wrap(err, "failure to execute limit order")
+		return "", err
+	}
+	// the rest of a one-cancels-other group can't be executed anymore
+	err = l.removeSiblings(sesh)
+	if err != nil {
+		return "", err
 	}
 
 	// set the time of execution
@@ -153,28 +392,49 @@ func (l *Limit) Execute(srv *disc.Server, sesh *arango.Sesh) error {
 	bal.Timestamp = time.Now().Round(time.Second)
 	err = sesh.CreateDoc("balances", bal)
 	if err != nil {
-		return errors.Wrap(err, "failure to execute limit order")
+		return "", errors.Wrap(err, "failure to update balance")
 	}
 
-	// notify the user and exit
 	if l.Leverage != 0 {
-		return srv.Message(id, l.renderLevered())
+		return l.renderLevered(), nil
+	}
+	return l.renderTrade(), nil
+}
+
+// drop removes an order that can't be executed, saving bal with the order's
+// funds released
+func (l *Limit) drop(sesh arango.Store, bal *arango.Balance) error {
+	bal.Timestamp = time.Now().Round(time.Second)
+	err := sesh.CreateDoc("balances", bal)
+	if err != nil {
+		return errors.Wrap(err, "failure to update balance")
+	}
+	err = l.removeSiblings(sesh)
+	if err != nil {
+		return err
 	}
-	return srv.Message(id, l.renderTrade())
+	return sesh.RemoveDoc(l.col(), l.Key)
 }
 
 // executeTrade alters a users balances according to limit order. It assumes the
 // order is ready to be executed and is valid. Uses the buy price in the limit,
 // not the current buy price
-func (l *Limit) executeTrade(sesh *arango.Sesh, bal *arango.Balance) error {
-	// check that there is enough asset to sell
-	sellPrice, err := arango.FetchLatestPrice(sesh, l.Sell)
+func (l *Limit) executeTrade(sesh arango.Store, prices arango.PriceOracle, bal *arango.Balance) error {
+	// the asset is sold at its bid
+	sellPrice, _, err := prices.Quote(l.Sell)
 	if err != nil {
 		return err
 	}
 	buyPrice := l.Price
 	sellCost := sellPrice * l.SellAmount
-	l.BuyAmount = sellCost / buyPrice
+	// limit orders pay the maker fee out of what they buy
+	rate, _, err := costs(prices, l.Sell, l.Buy, sellCost, true)
+	if err != nil {
+		return err
+	}
+	bought := sellCost / buyPrice
+	l.Fee, l.FeeAsset, l.Value = bought*rate, l.Buy, sellCost
+	l.BuyAmount = bought - l.Fee
 
 	// adjust balances
 	bal.Balances[l.Sell] = bal.Balances[l.Sell] - l.SellAmount
@@ -202,19 +462,32 @@ func (l *Limit) executeTrade(sesh *arango.Sesh, bal *arango.Balance) error {
 // executeMarketTrade alters a users balances according to limit order. It assumes the
 // order is ready to be executed and is valid. Uses the buy price in the limit,
 // not the current buy price
-func (l *Limit) executeMarketTrade(sesh *arango.Sesh, bal *arango.Balance) error {
-	// check that there is enough asset to sell
-	sellPrice, err := arango.FetchLatestPrice(sesh, l.Sell)
+func (l *Limit) executeMarketTrade(sesh arango.Store, prices arango.PriceOracle, bal *arango.Balance) error {
+	// setting the price below changes where the order appears to wait
+	col := l.col()
+	// sell at the bid and buy at the ask
+	sellPrice, _, err := prices.Quote(l.Sell)
 	if err != nil {
 		return err
 	}
-	buyPrice, err := arango.FetchLatestPrice(sesh, l.Buy)
+	_, buyPrice, err := prices.Quote(l.Buy)
 	if err != nil {
 		return err
 	}
 	sellCost := sellPrice * l.SellAmount
-	l.BuyAmount = sellCost / buyPrice
-	l.Price = buyPrice / sellPrice
+	// market orders slip and pay the taker fee out of what they buy
+	rate, slip, err := costs(prices, l.Sell, l.Buy, sellCost, false)
+	if err != nil {
+		return err
+	}
+	fillPrice := buyPrice * (1 + slip)
+	if l.Type == StopLimit && sellPrice/fillPrice < l.Floor {
+		return errBelowFloor
+	}
+	bought := sellCost / fillPrice
+	l.Fee, l.FeeAsset, l.Slippage, l.Value = bought*rate, l.Buy, slip, sellCost
+	l.BuyAmount = bought - l.Fee
+	l.Price = fillPrice / sellPrice
 
 	// adjust balances
 	bal.Balances[l.Sell] = bal.Balances[l.Sell] - l.SellAmount
@@ -225,46 +498,59 @@ func (l *Limit) executeMarketTrade(sesh *arango.Sesh, bal *arango.Balance) error
 
 	err = sesh.CreateDoc("trades", l)
 	if err != nil {
-		log.Println(errors.Wrap(err, "failure to insert executed trade"))
+		return errors.Wrap(err, "failure to insert executed trade")
 	}
 
 	// remove the old limit order
-	err = sesh.RemoveDoc("pending", l.Key)
+	err = sesh.RemoveDoc(col, l.Key)
 	if err != nil {
 		return errors.Wrap(err, "failure to remove executed limit order")
 	}
 
-	return err
+	return nil
 }
 
-func (l *Limit) executeLevered(sesh *arango.Sesh, bal *arango.Balance) error {
+func (l *Limit) executeLevered(sesh arango.Store, prices arango.PriceOracle, bal *arango.Balance) error {
 	// // check that there is enough asset to sell
-	// sellPrice, err := arango.FetchLatestPrice(sesh, l.Sell)
+	// sellPrice, err := sesh.LatestPrice(l.Sell)
 	// if err != nil {
 	// 	return err
 	// }
-	// buyPrice, err := arango.FetchLatestPrice(sesh, l.Buy)
+	// buyPrice, err := sesh.LatestPrice(l.Buy)
 	// if err != nil {
 	// 	return err
 	// }
 	l.BuyAmount = l.SellAmount / l.Price
 	bal.Balances[l.Collat] = bal.Balances[l.Collat] - l.CollAmount
+	// limit orders pay the maker fee on the whole position out of the collateral
+	rate, _, err := costs(prices, l.Sell, l.Buy, 0, true)
+	if err != nil {
+		return err
+	}
+	l.Fee, l.FeeAsset = l.CollAmount*float64(l.Leverage)*rate, l.Collat
 	// add position to positions using current price
 	//
 	post := &Position{
-		Limit: *l,
-		Start: time.Now().Round(time.Second),
-		Alive: true,
+		Limit:     *l,
+		Start:     time.Now().Round(time.Second),
+		Alive:     true,
+		CloseCond: l.Bracket,
 	}
+	post.CollAmount = l.CollAmount - l.Fee
+	post.SellAmount = post.CollAmount
 
 	lp := post.LiquidationPrice()
 	l.liqPrice = lp
 	post.LiqPrice = lp
 
-	err := sesh.CreateDoc("positions", post)
+	err = sesh.CreateDoc("positions", post)
 	if err != nil {
 		return errors.Wrap(err, "failure to insert limit postion")
 	}
+	err = post.record(sesh, prices, PosEvent{Kind: EventOpen, Amount: l.CollAmount})
+	if err != nil {
+		return err
+	}
 
 	// remove the old limit order
 	err = sesh.RemoveDoc("limits", l.Key)
@@ -274,26 +560,50 @@ func (l *Limit) executeLevered(sesh *arango.Sesh, bal *arango.Balance) error {
 	return nil
 }
 
-func (l *Limit) executeMarketLevered(sesh *arango.Sesh, bal *arango.Balance) error {
-	// check that there is enough asset to sell
-	sellPrice, err := arango.FetchLatestPrice(sesh, l.Sell)
+func (l *Limit) executeMarketLevered(sesh arango.Store, prices arango.PriceOracle, bal *arango.Balance) error {
+	// longs buy the asset at its ask, shorts sell it at its bid
+	sellBid, sellAsk, err := prices.Quote(l.Sell)
 	if err != nil {
 		return err
 	}
-	buyPrice, err := arango.FetchLatestPrice(sesh, l.Buy)
+	buyBid, buyAsk, err := prices.Quote(l.Buy)
+	if err != nil {
+		return err
+	}
+	sellPrice, buyPrice := sellBid, buyAsk
+	if !l.Long {
+		sellPrice, buyPrice = sellAsk, buyBid
+	}
+	collPrice, err := prices.Price(l.Collat)
 	if err != nil {
 		return err
 	}
+	// market orders slip against the direction of the position and pay the
+	// taker fee on the whole position out of the collateral
+	size := l.CollAmount * collPrice * float64(l.Leverage)
+	rate, slip, err := costs(prices, l.Sell, l.Buy, size, false)
+	if err != nil {
+		return err
+	}
+	if l.Long {
+		buyPrice *= 1 + slip
+	} else {
+		buyPrice *= 1 - slip
+	}
 	l.BuyAmount = (sellPrice * l.SellAmount) / buyPrice
 	l.Price = buyPrice / sellPrice
+	l.Fee, l.FeeAsset, l.Slippage = l.CollAmount*float64(l.Leverage)*rate, l.Collat, slip
 	bal.Balances[l.Collat] = bal.Balances[l.Collat] - l.CollAmount
 	// add position to positions using current price
 	//
 	post := &Position{
-		Limit: *l,
-		Start: time.Now().Round(time.Second),
-		Alive: true,
+		Limit:     *l,
+		Start:     time.Now().Round(time.Second),
+		Alive:     true,
+		CloseCond: l.Bracket,
 	}
+	post.CollAmount = l.CollAmount - l.Fee
+	post.SellAmount = post.CollAmount
 	lp := post.LiquidationPrice()
 	l.liqPrice = lp
 	post.LiqPrice = lp
@@ -301,6 +611,10 @@ func (l *Limit) executeMarketLevered(sesh *arango.Sesh, bal *arango.Balance) err
 	if err != nil {
 		return errors.Wrap(err, "failure to insert market post")
 	}
+	err = post.record(sesh, prices, PosEvent{Kind: EventOpen, Amount: l.CollAmount})
+	if err != nil {
+		return err
+	}
 	// remove the old limit order
 	err = sesh.RemoveDoc("pending", l.Key)
 	if err != nil {
@@ -311,37 +625,39 @@ func (l *Limit) executeMarketLevered(sesh *arango.Sesh, bal *arango.Balance) err
 }
 
 // IsReady checks to see if the limit is valid
-func (l *Limit) IsReady(sesh *arango.Sesh) (bool, error) {
-	// lookup the price of the assets
-	sellPrice, err := arango.FetchLatestPrice(sesh, l.Sell)
-	if err != nil {
-		return false, errors.Wrap(err, "could not check limit validity")
+func (l *Limit) IsReady(prices arango.PriceOracle) (bool, error) {
+	if l.Type != "" {
+		return l.isTriggered(prices)
+	}
+	// buys are filled at the ask and sells at the bid, so a limit between the
+	// two waits either way
+	if l.Long {
+		ask, err := askPrice(prices, l.Buy, l.Sell)
+		if err != nil {
+			return false, errors.Wrap(err, "could not check limit validity")
+		}
+		return ask <= l.Price, nil
 	}
-	buyPrice, err := arango.FetchLatestPrice(sesh, l.Buy)
+	bid, err := bidPrice(prices, l.Buy, l.Sell)
 	if err != nil {
 		return false, errors.Wrap(err, "could not check limit validity")
 	}
-	currPrice := buyPrice / sellPrice
-	switch {
-	case l.Long && currPrice < l.Price:
-		return true, nil
-	case l.Long && currPrice > l.Price:
-		return false, nil
-	case !l.Long && currPrice < l.Price:
-		return false, nil
-	case !l.Long && currPrice > l.Price:
-		return true, nil
-	}
-	return false, nil
+	return bid >= l.Price, nil
 }
 
 func (l *Limit) renderTrade() string {
+	kind := "limit"
+	if l.Type != "" {
+		kind = l.Type
+	}
 	return fmt.Sprintf(
-		"limit order has been executed: bought %.3f %s using %.3f %s",
+		"%s order has been executed: bought %.3f %s using %.3f %s%s",
+		kind,
 		l.BuyAmount,
 		l.Buy,
 		l.SellAmount,
 		l.Sell,
+		l.renderCosts(),
 	)
 }
 
@@ -350,7 +666,7 @@ func (l *Limit) renderLevered() string {
 	if l.Long {
 		dir = "long"
 	}
-	return fmt.Sprintf(
+	msg := fmt.Sprintf(
 		"position has been opended: %d x %s on %s relative to %s using %.2f %s as collateral. Liquidation at %.3f %s/%s",
 		l.Leverage,
 		dir,
@@ -362,4 +678,9 @@ func (l *Limit) renderLevered() string {
 		l.Buy,
 		l.Sell,
 	)
+	msg += l.renderCosts()
+	if l.Bracket != nil {
+		msg += fmt.Sprintf(". It will be closed once it's worth $%.2f or $%.2f", l.Bracket.Upper, l.Bracket.Lower)
+	}
+	return msg
 }
@@ -0,0 +1,96 @@
+package trade
+
+import (
+	"math"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+)
+
+// Margins are the margin requirements of levered positions, each a fraction of
+// the position's notional value
+type Margins struct {
+	Maintenance float64
+	Call        float64
+	Fee         float64
+}
+
+// CurrentMargins returns the margin requirements that are configured
+func CurrentMargins() Margins {
+	cfg := config.Current()
+	return Margins{
+		Maintenance: cfg.MaintenanceMargin,
+		Call:        cfg.MarginCall,
+		Fee:         cfg.LiquidationFee,
+	}
+}
+
+// Margin states of a position
+const (
+	MarginOK = iota
+	MarginCalled
+	MarginLiquidate
+)
+
+// Status checks a position's margin ratio against the requirements
+func (m Margins) Status(ratio float64) int {
+	switch {
+	case ratio <= m.Maintenance:
+		return MarginLiquidate
+	case ratio <= m.Call:
+		return MarginCalled
+	}
+	return MarginOK
+}
+
+// Notional is the current size of the position in USD, its collateral times
+// its leverage, moved by the price it could be closed at since it was opened
+func (p *Position) Notional(prices arango.PriceOracle) (float64, error) {
+	price, err := p.exitPrice(prices)
+	if err != nil {
+		return 0, errors.Wrap(err, "failure to check notional value")
+	}
+	collPrice, err := prices.Price(p.Collat)
+	if err != nil {
+		return 0, errors.Wrap(err, "failure to check notional value")
+	}
+	return p.CollAmount * collPrice * p.EffectiveLeverage() * price / p.Price, nil
+}
+
+// MarginRatio is the value of the position as a fraction of its notional
+// value, given its value val in USD
+func (p *Position) MarginRatio(prices arango.PriceOracle, val float64) (float64, error) {
+	notional, err := p.Notional(prices)
+	if err != nil {
+		return 0, err
+	}
+	if notional <= 0 {
+		return 0, nil
+	}
+	return val / notional, nil
+}
+
+// liquidationPrice is the price at which the value of the position falls to
+// maint of its notional value, leaving out funding. A long with no more than
+// its collateral at stake can't be liquidated, which is a price of 0.
+func (p *Position) liquidationPrice(maint float64) float64 {
+	lev := p.EffectiveLeverage()
+	if p.Long {
+		return math.Max(p.Price*(lev-1)/(lev*(1-maint)), 0)
+	}
+	return p.Price * (lev + 1) / (lev * (1 + maint))
+}
+
+// liquidationFee is taken out of what is left of the position, val in USD,
+// when it's liquidated
+func (m Margins) liquidationFee(notional, val float64) float64 {
+	fee := notional * m.Fee
+	if fee > val {
+		fee = val
+	}
+	if fee < 0 {
+		return 0
+	}
+	return fee
+}
@@ -2,50 +2,98 @@ package trade
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2/disc"
 )
 
-// UpdatePositions checks for liquidations and updates the historic value of each position
-func UpdatePositions(srv *disc.Server, sesh *arango.Sesh) error {
-	const query = `
-	let out = (
-		for p in positions
-			filter p.alive == true
-			return p
-	)
-	return out
-	`
-	var ps []Position
-	err := sesh.Execute(query, &ps)
+// UpdatePositions checks for liquidations and updates the historic value of
+// each position. Positions that can't be priced are neither liquidated nor
+// closed until the next tick.
+func UpdatePositions(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle) error {
+	rate := config.Current().BorrowRate
+	margins := CurrentMargins()
+	iter, err := sesh.Iter("positions", arango.Match{"alive": true})
 	if err != nil {
 		return errors.Wrap(err, "failure to fetch positions")
 	}
-	for _, p := range ps {
-		val, err := p.Value(sesh)
+	defer iter.Close()
+	skips := make(skipped)
+	defer skips.notify(srv, sesh)
+	for {
+		var p Position
+		more, err := iter.Next(&p)
+		if err != nil {
+			return errors.Wrap(err, "failure to fetch positions")
+		}
+		if !more {
+			break
+		}
+		// charge for the borrowed funds before valuing the position
+		p.Accrue(rate, time.Now().Round(time.Second))
+		val, err := p.Value(prices)
+		if arango.IsBadPrice(err) {
+			skips.add(p.User, "position "+p.Key, err)
+			continue
+		}
 		if err != nil {
 			return errors.Wrap(err, "failure to calculate value of position")
 		}
-		// liquidate position if needed
-		if val.Value <= 0 {
-			return p.Liquidate(srv, sesh)
+		// liquidate the position once it falls to the maintenance margin
+		ratio, err := p.MarginRatio(prices, val.Value)
+		if arango.IsBadPrice(err) {
+			skips.add(p.User, "position "+p.Key, err)
+			continue
 		}
+		if err != nil {
+			return errors.Wrap(err, "failure to calculate margin of position")
+		}
+		status := margins.Status(ratio)
+		if status == MarginLiquidate {
+			err = p.Liquidate(srv, sesh, prices)
+			if err != nil {
+				return errors.Wrap(err, "failure to liquidate position")
+			}
+			continue
+		}
+		// warn the owner once each time the position gets close
+		call := status == MarginCalled && !p.MarginCalled
+		p.MarginCalled = status == MarginCalled
 		// add the value to the records
 		err = sesh.CreateDoc("post_val", val)
 		if err != nil {
 			return errors.Wrap(err, "failure to add position historical value")
 		}
+		// raise the high-water value of a trailing stop
+		p.trackHigh(val.Value)
+		err = p.saveTick(sesh)
+		if err != nil {
+			return errors.Wrap(err, "failure to update position")
+		}
+		if call {
+			err = p.marginCall(srv, sesh, ratio, margins)
+			if err != nil {
+				return err
+			}
+		}
 		// check if this position should be closed
-		crossed, u, err := p.Check(sesh, val.Value)
+		crossed, u, err := p.Check(sesh, prices, val.Value)
+		if arango.IsBadPrice(err) {
+			skips.add(p.User, "position "+p.Key, err)
+			continue
+		}
 		if err != nil {
 			return errors.Wrap(err, "failure to update position: could not check for close condidtion")
 		}
 		if crossed {
 			// notify user
-			id, err := arango.UserChanID(sesh, p.User)
+			id, err := sesh.UserChanID(p.User)
 			if err != nil {
 				return errors.Wrap(err, "failure to find user id")
 			}
@@ -63,55 +111,92 @@ type Position struct {
 	LiqPrice   float64         `json:"liquidation_price"`
 	Liquidated bool            `json:"liquidated"`
 	CloseCond  *CloseCondition `json:"close_condition,omitempty"`
-	Dir        string
-	CurrValue  float64
+	// Funding is the borrowing cost accrued so far, in the collateral
+	Funding float64 `json:"funding,omitempty"`
+	// FundedAt is when Funding was last accrued
+	FundedAt time.Time `json:"funded_at,omitempty"`
+	// Effective is the leverage of the position once margin has been added or
+	// taken out, its notional over its collateral. 0 until then.
+	Effective float64 `json:"effective_leverage,omitempty"`
+	// MarginCalled is set while the owner has been warned that the position
+	// is close to being liquidated
+	MarginCalled bool `json:"margin_called,omitempty"`
+	Dir          string
+	CurrValue    float64
 	Limit
+	paidOut float64 // collateral returned to the user when it was closed
 }
 
-// Close ends a position and solidifies gains or losses
-func (p *Position) Close(sesh *arango.Sesh, liquidated bool) error {
+// closeCols are the collections written to when a position is closed
+var closeCols = []string{"positions", "balances", "post_events"}
+
+// Close ends a position and solidifies gains or losses. The position and the
+// user's balance are updated in a single transaction.
+func (p *Position) Close(sesh arango.Store, prices arango.PriceOracle, liquidated bool) error {
+	return sesh.Atomic(closeCols, func(tx arango.Store) error {
+		return p.close(tx, prices, liquidated)
+	})
+}
+
+func (p *Position) close(sesh arango.Store, prices arango.PriceOracle, liquidated bool) error {
+	// make sure the position wasn't already closed elsewhere, and pay out what
+	// is stored rather than what was read before the transaction
+	err := p.reload(sesh)
+	if err != nil {
+		return errors.Wrap(err, "failure to close position")
+	}
+	// the tick may not have saved the funding accrued so far
+	p.Accrue(config.Current().BorrowRate, time.Now().Round(time.Second))
 	p.Alive = false
 	p.End = time.Now().Round(time.Second)
 	p.Liquidated = liquidated
-	pos, err := sesh.GetCol("positions")
+	err = sesh.Update("positions", p.Key, p)
 	if err != nil {
 		return errors.Wrap(err, "failure to close position:")
 	}
-	_, err = pos.UpdateDocument(sesh.Ctx, p.Key, p)
-	if err != nil {
-		return errors.Wrap(err, "failure to close position:")
-	}
-	if liquidated {
-		return nil
-	}
 	// add the leftover/gains to the user's balance
 	// calculate the current value
 	errMsg := fmt.Sprintf("!!!!!failure to add closed position value to user!!!!!! %s %s", p.User, p.Key)
-	val, err := p.Value(sesh)
+	val, err := p.Value(prices)
 	if err != nil {
 		return errors.Wrap(err, errMsg)
 	}
 	// add that to the user's balance
-	collPrice, err := arango.FetchLatestPrice(sesh, p.Collat)
+	collPrice, err := prices.Price(p.Collat)
 	if err != nil {
 		return errors.Wrap(err, errMsg)
 	}
-	award := val.Value / collPrice
-	err = arango.UpdateBalance(sesh, p.User, p.Collat, award)
-	if err != nil {
-		return errors.Wrap(err, errMsg)
+	ev := PosEvent{Kind: EventClose, Value: val.Value}
+	left := val.Value
+	// a liquidated position pays the liquidation fee out of what is left
+	if liquidated {
+		notional, err := p.Notional(prices)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		ev.Kind = EventLiquidation
+		ev.Fee = CurrentMargins().liquidationFee(notional, val.Value)
+		left -= ev.Fee
 	}
-	return nil
+	if left > 0 {
+		p.paidOut = left / collPrice
+		err = arango.UpdateBalance(sesh, p.User, p.Collat, p.paidOut)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+	}
+	ev.Amount = -p.paidOut
+	return p.record(sesh, prices, ev)
 }
 
 // Liquidate closes the user's position and notifies them
-func (p *Position) Liquidate(srv *disc.Server, sesh *arango.Sesh) error {
-	err := p.Close(sesh, true)
+func (p *Position) Liquidate(srv *disc.Server, sesh arango.Store, prices arango.PriceOracle) error {
+	err := p.Close(sesh, prices, true)
 	if err != nil {
 		return errors.Wrap(err, "failure to close position")
 	}
 	// notify user
-	id, err := arango.UserChanID(sesh, p.User)
+	id, err := sesh.UserChanID(p.User)
 	if err != nil {
 		return errors.Wrap(err, "failure to find user id")
 	}
@@ -120,51 +205,83 @@ func (p *Position) Liquidate(srv *disc.Server, sesh *arango.Sesh) error {
 }
 
 // Value calculates the current worth of the position in USD
-func (p *Position) Value(sesh *arango.Sesh) (PosVal, error) {
+func (p *Position) Value(prices arango.PriceOracle) (PosVal, error) {
 	var out PosVal
-	// get fresh price data
-	buyPrice, err := arango.FetchLatestPrice(sesh, p.Buy)
+	// get fresh price data, valuing the position at what closing it would get
+	currPrice, err := p.exitPrice(prices)
 	if err != nil {
 		return out, errors.Wrap(err, "failure to check value of coin")
 	}
-	sellPrice, err := arango.FetchLatestPrice(sesh, p.Sell)
+	collPrice, err := prices.Price(p.Collat)
 	if err != nil {
 		return out, errors.Wrap(err, "failure to check value of coin")
 	}
-	// get the collateral's price if it's different from the selling asset
-	var collPrice float64
-	if p.Collat != p.Sell {
-		collPrice, err = arango.FetchLatestPrice(sesh, p.Collat)
-		if err != nil {
-			return out, errors.Wrap(err, "failure to check value of coin")
-		}
-	} else {
-		collPrice = sellPrice
-	}
 
 	// find the percent change of the starting price
-	currPrice := buyPrice / sellPrice
 	percChange := (currPrice - p.Price) / p.Price
 	dir := 1.0
 	if !p.Long {
 		dir = -1.0
 	}
-	delta := percChange * float64(p.Leverage) * dir
+	delta := percChange * p.EffectiveLeverage() * dir
+	funding := p.Funding * collPrice
 	out = PosVal{
 		Time:     time.Now().Round(time.Second),
-		Value:    (p.CollAmount * collPrice) + (delta * p.CollAmount * collPrice),
+		Value:    (p.CollAmount * collPrice) + (delta * p.CollAmount * collPrice) - funding,
+		Funding:  funding,
 		Position: p.Key,
 	}
 	return out, nil
 }
 
+// EffectiveLeverage is the leverage the position has now, which differs from
+// the leverage it was opened with once margin is added or taken out
+func (p *Position) EffectiveLeverage() float64 {
+	if p.Effective > 0 {
+		return p.Effective
+	}
+	return float64(p.Leverage)
+}
+
+// year is the period the borrow rate is charged over
+const year = time.Hour * 24 * 365
+
+// Accrue adds the cost of borrowing since the last accrual at the yearly rate
+// to the position's Funding. Only the borrowed part of the position, its
+// collateral times its leverage minus one, is charged.
+func (p *Position) Accrue(rate float64, now time.Time) {
+	last := p.FundedAt
+	if last.IsZero() {
+		last = p.Start
+	}
+	p.FundedAt = now
+	// positions from before funding existed start accruing now
+	lev := p.EffectiveLeverage()
+	if last.IsZero() || !now.After(last) || lev <= 1 {
+		return
+	}
+	borrowed := p.CollAmount * (lev - 1)
+	p.Funding += borrowed * rate * float64(now.Sub(last)) / float64(year)
+}
+
+// LiquidationPrice is the price at which the position falls to the
+// maintenance margin and is liquidated, leaving out funding
 func (p *Position) LiquidationPrice() float64 {
-	neededD := 1 / float64(p.Leverage)
-	dir := float64(-1)
-	if p.Long {
-		dir = 1
+	return p.liquidationPrice(config.Current().MaintenanceMargin)
+}
+
+// marginCall warns the owner that the position is close to being liquidated
+func (p *Position) marginCall(srv *disc.Server, sesh arango.Store, ratio float64, margins Margins) error {
+	id, err := sesh.UserChanID(p.User)
+	if err != nil {
+		return errors.Wrap(err, "failure to find user id")
 	}
-	return p.Price - (dir * neededD * p.Price)
+	return srv.Message(id, fmt.Sprintf(
+		"meat bag, position %s is down to %.1f%% margin and will be liquidated at %.1f%%. add collateral with !chip addmargin or close it with !chip close",
+		p.Key,
+		ratio*100,
+		margins.Maintenance*100,
+	))
 }
 
 func (p *Position) liquidationMessage() string {
@@ -173,23 +290,126 @@ func (p *Position) liquidationMessage() string {
 		l = "short"
 	}
 	const message = `
-	beloved meat bag, it is my burden to inform you that your favorite position, %s, %d x %s on %s relative to %s using %s as collateral, has reached the liquidation price and therefore met its fatefull end.
+	beloved meat bag, it is my burden to inform you that your favorite position, %s, %d x %s on %s relative to %s using %s as collateral, has reached the maintenance margin and therefore met its fatefull end. After the liquidation fee, %.3f %s has been returned to your balance.
 	`
-	return fmt.Sprintf(message, p.Key, p.Leverage, l, p.Buy, p.Sell, p.Collat)
+	return fmt.Sprintf(message, p.Key, p.Leverage, l, p.Buy, p.Sell, p.Collat, p.paidOut, p.Collat)
 }
 
 type CloseCondition struct {
 	Upper float64 `json:"upper"`
 	Lower float64 `json:"lower"`
+	// Trail is how far the value can fall from its high before the position
+	// is closed, either in USD or, if TrailPct is set, as a fraction of the high
+	Trail    float64 `json:"trail,omitempty"`
+	TrailPct bool    `json:"trail_pct,omitempty"`
+	// High is the highest value of the position since the trail was set
+	High float64 `json:"high,omitempty"`
+}
+
+// TrailStop is the value at which a trailing stop closes the position, or 0
+// if there is no trailing stop
+func (c *CloseCondition) TrailStop() float64 {
+	if c.Trail <= 0 {
+		return 0
+	}
+	if c.TrailPct {
+		return c.High * (1 - c.Trail)
+	}
+	return c.High - c.Trail
+}
+
+// ParseTrail parses a trailing distance given either as a percent, like 10%,
+// or in USD, like 500
+func ParseTrail(raw string) (trail float64, pct bool, err error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasSuffix(raw, "%") {
+		pct = true
+		raw = strings.TrimSpace(strings.TrimSuffix(raw, "%"))
+	}
+	trail, err = strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid trailing distance %s", raw)
+	}
+	if pct {
+		trail = trail / 100
+	}
+	if trail <= 0 || (pct && trail >= 1) {
+		return 0, false, errors.Errorf("invalid trailing distance %s", raw)
+	}
+	return trail, pct, nil
+}
+
+// HighWater finds the highest value of the position in its post_val history
+func HighWater(sesh arango.Store, key string) (float64, error) {
+	iter, err := sesh.Iter("post_val", arango.Match{"position": key})
+	if err != nil {
+		return 0, errors.Wrap(err, "failure to fetch position history")
+	}
+	defer iter.Close()
+	var high float64
+	for {
+		var val PosVal
+		more, err := iter.Next(&val)
+		if err != nil {
+			return 0, errors.Wrap(err, "failure to fetch position history")
+		}
+		if !more {
+			break
+		}
+		high = math.Max(high, val.Value)
+	}
+	return high, nil
+}
+
+// trackHigh raises the high-water value of the position's trailing stop
+func (p *Position) trackHigh(val float64) {
+	if p.CloseCond == nil || p.CloseCond.Trail <= 0 || val <= p.CloseCond.High {
+		return
+	}
+	p.CloseCond.High = val
+}
+
+// reload replaces p with the stored position, failing if it has been closed,
+// so that changes made since p was read aren't lost or paid out twice
+func (p *Position) reload(sesh arango.Store) error {
+	var open []Position
+	err := sesh.Find("positions", arango.Match{"_key": p.Key, "alive": true}, &open)
+	if err != nil {
+		return errors.Wrap(err, "failure to fetch position")
+	}
+	if len(open) == 0 {
+		return errors.Errorf("%s is not open", p.Key)
+	}
+	*p = open[0]
+	return nil
+}
+
+// saveTick saves what changes every tick, the accrued funding and the trailing
+// stop. Only a position that is still open is changed, so a position closed
+// in the meantime isn't reopened.
+func (p *Position) saveTick(sesh arango.Store) error {
+	return sesh.Atomic([]string{"positions"}, func(tx arango.Store) error {
+		var open []Position
+		err := tx.Find("positions", arango.Match{"_key": p.Key, "alive": true}, &open)
+		if err != nil || len(open) == 0 {
+			return err
+		}
+		curr := open[0]
+		curr.CloseCond = p.CloseCond
+		curr.Funding = p.Funding
+		curr.FundedAt = p.FundedAt
+		curr.MarginCalled = p.MarginCalled
+		return tx.Update("positions", p.Key, &curr)
+	})
 }
 
-func (p *Position) Check(sesh *arango.Sesh, val float64) (closed bool, upper string, err error) {
+func (p *Position) Check(sesh arango.Store, prices arango.PriceOracle, val float64) (closed bool, upper string, err error) {
 	if p.CloseCond == nil {
 		return false, "", nil
 	}
 	// did the value cross the lower condition
 	if val < p.CloseCond.Lower && p.CloseCond.Lower > 0 {
-		err = p.Close(sesh, false)
+		err = p.Close(sesh, prices, false)
 		if err != nil {
 			return false, "", errors.Wrap(err, "failure to update position")
 		}
@@ -197,13 +417,22 @@ func (p *Position) Check(sesh *arango.Sesh, val float64) (closed bool, upper str
 	}
 
 	// did the value cross the upper condition
-	if val > p.CloseCond.Upper && p.CloseCond.Lower > 0 {
-		err = p.Close(sesh, false)
+	if val > p.CloseCond.Upper && p.CloseCond.Upper > 0 {
+		err = p.Close(sesh, prices, false)
 		if err != nil {
 			return false, "", errors.Wrap(err, "failure to update position")
 		}
 		return true, "upper", nil
 	}
+
+	// did the value fall too far from its high
+	if stop := p.CloseCond.TrailStop(); stop > 0 && val <= stop {
+		err = p.Close(sesh, prices, false)
+		if err != nil {
+			return false, "", errors.Wrap(err, "failure to update position")
+		}
+		return true, "trailing", nil
+	}
 	return false, "", nil
 }
 
@@ -212,6 +441,9 @@ type PosVal struct {
 	Time     time.Time `json:"time"`
 	Value    float64   `json:"value"` // value in USD
 	Position string    `json:"position"`
+	// Funding is the borrowing cost accrued so far in USD, already taken out
+	// of Value
+	Funding float64 `json:"funding,omitempty"`
 }
 
 type PosRender struct {
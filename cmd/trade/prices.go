@@ -0,0 +1,113 @@
+package trade
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2/disc"
+)
+
+// askPrice is the price of buying base with quote, the ask of base over the
+// bid of quote
+func askPrice(prices arango.PriceOracle, base, quote string) (float64, error) {
+	_, ask, err := prices.Quote(base)
+	if err != nil {
+		return 0, err
+	}
+	bid, _, err := prices.Quote(quote)
+	if err != nil {
+		return 0, err
+	}
+	return ask / bid, nil
+}
+
+// bidPrice is the price of selling base for quote, the bid of base over the
+// ask of quote
+func bidPrice(prices arango.PriceOracle, base, quote string) (float64, error) {
+	bid, _, err := prices.Quote(base)
+	if err != nil {
+		return 0, err
+	}
+	_, ask, err := prices.Quote(quote)
+	if err != nil {
+		return 0, err
+	}
+	return bid / ask, nil
+}
+
+// BadPriceMessage tells a user that a command couldn't be priced because of
+// err, a bad price
+func BadPriceMessage(err error) string {
+	return fmt.Sprintf("meat bag, I can't trust my prices right now, try again later (%v)", errors.Cause(err))
+}
+
+// Prefetch loads the price of every asset used by a pending order, limit order
+// or open position into prices using a single query, so that the whole tick is
+// priced against the same snapshot
+func Prefetch(sesh arango.Store, prices *arango.Snapshot) error {
+	const errMsg = "failure to prefetch prices"
+	sources := []struct {
+		col   string
+		match arango.Match
+	}{
+		{"pending", nil},
+		{"limits", nil},
+		{"positions", arango.Match{"alive": true}},
+	}
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, src := range sources {
+		iter, err := sesh.Iter(src.col, src.match)
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		// positions embed their limit, so every source decodes into one
+		var lims []Limit
+		err = arango.ReadAll(iter, &lims)
+		iter.Close()
+		if err != nil {
+			return errors.Wrap(err, errMsg)
+		}
+		for _, l := range lims {
+			for _, symbol := range []string{l.Buy, l.Sell, l.Collat} {
+				if symbol != "" && !seen[symbol] {
+					seen[symbol] = true
+					symbols = append(symbols, symbol)
+				}
+			}
+		}
+	}
+	return prices.Load(symbols...)
+}
+
+// skipped collects, per user, the orders and positions that could not be
+// priced during a tick
+type skipped map[string][]string
+
+// add records that what was skipped because of err, logging it for the operator
+func (s skipped) add(user, what string, err error) {
+	log.Printf("skipped %s of %s: %v", what, user, err)
+	s[user] = append(s[user], fmt.Sprintf("%s: %v", what, errors.Cause(err)))
+}
+
+// notify tells each user what was skipped in a single message
+func (s skipped) notify(srv *disc.Server, sesh arango.Store) {
+	if srv == nil {
+		return
+	}
+	for user, items := range s {
+		id, err := sesh.UserChanID(user)
+		if err != nil {
+			log.Println("failure to notify user of skipped orders", user, err)
+			continue
+		}
+		msg := "meat bag, I could not get trustworthy prices, so the following were skipped and will be retried:\n" + strings.Join(items, "\n")
+		err = srv.Message(id, msg)
+		if err != nil {
+			log.Println("failure to notify user of skipped orders", user, err)
+		}
+	}
+}
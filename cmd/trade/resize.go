@@ -0,0 +1,245 @@
+package trade
+
+import (
+	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
+	"github.com/pkg/errors"
+)
+
+// Kinds of position events
+const (
+	EventOpen        = "open"
+	EventClose       = "close"
+	EventLiquidation = "liquidation"
+	EventPartial     = "partial close"
+	EventAddMargin   = "add margin"
+	EventReduce      = "reduce"
+)
+
+// PosEvent records a change made to a position in the post_events collection
+type PosEvent struct {
+	Position string    `json:"position"`
+	User     string    `json:"user"`
+	Kind     string    `json:"kind"`
+	Time     time.Time `json:"time"`
+	// Amount is the collateral put into the position, negative when it is
+	// paid out to the user's balance
+	Amount float64 `json:"amount"`
+	// Value is the value of the position in USD before the change
+	Value float64 `json:"value"`
+	// Fee is the liquidation fee taken out of the position in USD
+	Fee float64 `json:"fee,omitempty"`
+	// CollPrice is the USD price of the collateral at the time
+	CollPrice float64 `json:"coll_price,omitempty"`
+	// CollAmount, Price and LiqPrice describe the position after the change
+	CollAmount float64 `json:"coll_amount"`
+	Price      float64 `json:"price"`
+	LiqPrice   float64 `json:"liquidation_price"`
+}
+
+// resizeCols are the collections written to when a position is resized
+var resizeCols = []string{"positions", "balances", "post_events"}
+
+// record saves ev, filled in with the current state of the position
+func (p *Position) record(sesh arango.Store, prices arango.PriceOracle, ev PosEvent) error {
+	collPrice, err := prices.Price(p.Collat)
+	if err != nil {
+		return errors.Wrap(err, "failure to record position event")
+	}
+	ev.CollPrice = collPrice
+	ev.Position = p.Key
+	ev.User = p.User
+	ev.Time = time.Now().Round(time.Second)
+	ev.CollAmount = p.CollAmount
+	ev.Price = p.Price
+	ev.LiqPrice = p.LiqPrice
+	err = sesh.CreateDoc("post_events", ev)
+	return errors.Wrap(err, "failure to record position event")
+}
+
+// Events fetches the history of a position, oldest first
+func Events(sesh arango.Store, key string) ([]PosEvent, error) {
+	iter, err := sesh.Iter("post_events", arango.Match{"position": key})
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch position events")
+	}
+	defer iter.Close()
+	var out []PosEvent
+	err = arango.ReadAll(iter, &out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failure to fetch position events")
+	}
+	return out, nil
+}
+
+// CloseFraction realizes frac of the position's value into the user's
+// collateral balance, shrinking the rest of the position by the same fraction.
+// The entry and liquidation prices don't change. A fraction of 1 or more
+// closes the whole position. Returns the amount of collateral paid out.
+func (p *Position) CloseFraction(sesh arango.Store, prices arango.PriceOracle, frac float64) (float64, error) {
+	if frac <= 0 {
+		return 0, errors.Errorf("invalid fraction %v", frac)
+	}
+	var paid float64
+	err := sesh.Atomic(resizeCols, func(tx arango.Store) error {
+		curr, err := p.current(tx, prices)
+		if err != nil {
+			return err
+		}
+		if frac >= 1 {
+			paid = curr
+			return p.close(tx, prices, false)
+		}
+		paid = curr * frac
+		err = arango.UpdateBalance(tx, p.User, p.Collat, paid)
+		if err != nil {
+			return err
+		}
+		val, err := p.Value(prices)
+		if err != nil {
+			return err
+		}
+		keep := 1 - frac
+		p.CollAmount *= keep
+		p.SellAmount *= keep
+		p.BuyAmount *= keep
+		p.Funding *= keep
+		// USD close conditions shrink along with the position
+		if c := p.CloseCond; c != nil {
+			c.Upper *= keep
+			c.Lower *= keep
+			c.High *= keep
+			if !c.TrailPct {
+				c.Trail *= keep
+			}
+		}
+		err = tx.Update("positions", p.Key, p)
+		if err != nil {
+			return errors.Wrap(err, "failure to update position")
+		}
+		return p.record(tx, prices, PosEvent{Kind: EventPartial, Amount: -paid, Value: val.Value})
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failure to partially close position %s", p.Key)
+	}
+	return paid, nil
+}
+
+// Resize adds amount of collateral from the user's balance to the position, or
+// pays it out if amount is negative. The entry price and notional value of the
+// position don't change, only its collateral, so adding margin lowers its
+// effective leverage and moves its liquidation price away from the market,
+// while reducing it does the opposite.
+func (p *Position) Resize(sesh arango.Store, prices arango.PriceOracle, amount float64) error {
+	kind := EventAddMargin
+	if amount < 0 {
+		kind = EventReduce
+	}
+	err := sesh.Atomic(resizeCols, func(tx arango.Store) error {
+		curr, err := p.current(tx, prices)
+		if err != nil {
+			return err
+		}
+		if curr+amount <= 0 {
+			return errors.Errorf("position is only worth %.3f %s", curr, p.Collat)
+		}
+		if amount < 0 {
+			err = p.CheckReduce(prices, -amount)
+			if err != nil {
+				return err
+			}
+		}
+		bal, err := tx.LatestBalance(p.User)
+		if err != nil {
+			return err
+		}
+		if bal.Available(p.Collat) < amount {
+			return errors.Errorf("not enough %s available", p.Collat)
+		}
+		err = arango.UpdateBalance(tx, p.User, p.Collat, -amount)
+		if err != nil {
+			return err
+		}
+		val, err := p.Value(prices)
+		if err != nil {
+			return err
+		}
+		notional := p.CollAmount * p.EffectiveLeverage()
+		p.CollAmount += amount
+		p.SellAmount = p.CollAmount
+		p.Effective = notional / p.CollAmount
+		p.LiqPrice = p.LiquidationPrice()
+		err = tx.Update("positions", p.Key, p)
+		if err != nil {
+			return errors.Wrap(err, "failure to update position")
+		}
+		return p.record(tx, prices, PosEvent{Kind: kind, Amount: amount, Value: val.Value})
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failure to resize position %s", p.Key)
+	}
+	return nil
+}
+
+// current replaces p with the stored position, checking that it is still open,
+// and returns its value in its collateral
+func (p *Position) current(sesh arango.Store, prices arango.PriceOracle) (float64, error) {
+	err := p.reload(sesh)
+	if err != nil {
+		return 0, err
+	}
+	val, err := p.Value(prices)
+	if err != nil {
+		return 0, err
+	}
+	collPrice, err := prices.Price(p.Collat)
+	if err != nil {
+		return 0, err
+	}
+	return val.Value / collPrice, nil
+}
+
+// CheckReduce checks that taking amount of collateral out of the position
+// leaves it within the maximum leverage and the initial margin, as if it were
+// being opened
+func (p *Position) CheckReduce(prices arango.PriceOracle, amount float64) error {
+	cfg := config.Current()
+	coll := p.CollAmount - amount
+	// gains can only be taken by closing, not by reducing
+	if coll <= 0 {
+		return errors.Errorf("position only has %.3f %s of collateral", p.CollAmount, p.Collat)
+	}
+	lev := p.CollAmount * p.EffectiveLeverage() / coll
+	// leave room for rounding
+	if max := cfg.MaxLeverage(); lev > float64(max)+1e-9 {
+		return errors.Errorf("reducing would leave the position at %.2fx leverage, more than the %dx allowed", lev, max)
+	}
+	val, err := p.Value(prices)
+	if err != nil {
+		return err
+	}
+	collPrice, err := prices.Price(p.Collat)
+	if err != nil {
+		return err
+	}
+	ratio, err := p.MarginRatio(prices, val.Value-amount*collPrice)
+	if err != nil {
+		return err
+	}
+	if ratio < cfg.InitialMargin-1e-9 {
+		return errors.Errorf("reducing would leave %.1f%% margin, less than the %.1f%% initial margin", ratio*100, cfg.InitialMargin*100)
+	}
+	return nil
+}
+
+// exitPrice is the price of the bought asset in the sold asset that the
+// position can be closed at. A long sells what it bought at the bid and a short
+// buys back what it sold at the ask.
+func (p *Position) exitPrice(prices arango.PriceOracle) (float64, error) {
+	if p.Long {
+		return bidPrice(prices, p.Buy, p.Sell)
+	}
+	return askPrice(prices, p.Buy, p.Sell)
+}
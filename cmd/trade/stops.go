@@ -0,0 +1,93 @@
+package trade
+
+import (
+	"github.com/evan-forbes/chip/arango"
+	"github.com/pkg/errors"
+)
+
+// Order types that protect spot balances. Unlike limit orders, their prices
+// are the price of the asset being sold, in the asset being bought, so a stop
+// on ETH sold for USDC is triggered when ETH drops to the stop price in USDC.
+const (
+	// Stop sells at market once the price drops to the trigger
+	Stop = "stop"
+	// StopLimit sells once the price drops to the trigger, but not below the
+	// floor
+	StopLimit = "stop-limit"
+	// TakeProfit sells at market once the price rises to the trigger
+	TakeProfit = "take-profit"
+)
+
+// errBelowFloor is returned when a triggered stop-limit order would fill below
+// its floor after slippage, and is left to wait instead
+var errBelowFloor = errors.New("fill is below the floor")
+
+// isTriggered checks if a stop or take-profit order should be executed.
+// Stop-limit orders are marked as Triggered once their stop is hit, so that
+// they can still be filled if the price falls through the floor and recovers.
+func (l *Limit) isTriggered(prices arango.PriceOracle) (bool, error) {
+	price, err := l.sellPrice(prices)
+	if err != nil {
+		return false, err
+	}
+	switch l.Type {
+	case Stop:
+		return price <= l.Trigger, nil
+	case TakeProfit:
+		return price >= l.Trigger, nil
+	case StopLimit:
+		if price <= l.Trigger {
+			l.Triggered = true
+		}
+		return l.Triggered && price >= l.Floor, nil
+	}
+	return false, errors.Errorf("unknown order type %s", l.Type)
+}
+
+// arm saves that a stop-limit order was triggered, unless the order was removed
+// in the meantime by a cancel or a sibling being executed
+func (l *Limit) arm(sesh arango.Store) error {
+	return sesh.Atomic([]string{"limits"}, func(tx arango.Store) error {
+		var curr []Limit
+		err := tx.Find("limits", arango.Match{"_key": l.Key}, &curr)
+		if err != nil || len(curr) == 0 {
+			return err
+		}
+		curr[0].Triggered = true
+		return tx.Update("limits", l.Key, &curr[0])
+	})
+}
+
+// sellPrice is the price that the asset being sold can be sold at in the asset
+// being bought
+func (l *Limit) sellPrice(prices arango.PriceOracle) (float64, error) {
+	price, err := bidPrice(prices, l.Sell, l.Buy)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not check order trigger")
+	}
+	return price, nil
+}
+
+// Protect turns l into the stop and take-profit orders described by stop, floor
+// and take, leaving it as is if none are given. When there is both a stop and
+// a take-profit, the two orders form a one-cancels-other group.
+func Protect(l Limit, stop, floor, take float64) []*Limit {
+	var out []*Limit
+	if stop > 0 {
+		s := l
+		s.Type, s.Trigger, s.Floor = Stop, stop, floor
+		if floor > 0 {
+			s.Type = StopLimit
+		}
+		out = append(out, &s)
+	}
+	if take > 0 {
+		tp := l
+		tp.Type, tp.Trigger = TakeProfit, take
+		out = append(out, &tp)
+	}
+	if len(out) == 0 {
+		out = append(out, &l)
+	}
+	return out
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -24,6 +25,9 @@ const ShortUsageText = ` // Note: price is always calculate using:  buying asset
 
 // open a limit order 4x short MKR relative to eth using DAI as collateral 
 !chip short -b mkr -s eth -c dai -sam 1000 -l 4 -p 2.05
+
+// 2x short eth at $400, closing the position once it's worth $1500 or $800
+!chip short -b eth -s usdc -sam 1000 -p 400 -l 2 -tp 1500 -st 800
 `
 
 const LongUsageText = ` // Note: price is always calculate using:  buying asset price in usd / selling asset price in usd 
@@ -38,6 +42,9 @@ const LongUsageText = ` // Note: price is always calculate using:  buying asset
 
 // open a limit order 4x long MKR relative to eth using DAI as collateral 
 !chip long -b mkr -s eth -c dai -sam 1000 -l 4 -p 1.5
+
+// 2x long eth at $200, closing the position once it's worth $1500 or $800
+!chip long -b eth -s usdc -sam 1000 -p 200 -l 2 -tp 1500 -st 800
 `
 
 const TradeUsageText = ` // Note: price is always calculate using:  buying asset price in usd / selling asset price in usd 
@@ -53,6 +60,19 @@ const TradeUsageText = ` // Note: price is always calculate using:  buying asset
 // trade all my USDC for LINK at market price
 !chip trade -b LINK -s USDC -sam -1
 !chip trade -b link -s usdc -all
+
+// Note: stop and take-profit prices are the price of the selling asset in the buying asset
+// sell 5 ETH for USDC at market if ETH drops to 300 USDC
+!chip trade -s eth -b usdc -sam 5 -st 300
+
+// same, but don't sell for less than 290 USDC
+!chip trade -s eth -b usdc -sam 5 -st 300 -f 290
+
+// sell 5 ETH for USDC at market if ETH rises to 500 USDC
+!chip trade -s eth -b usdc -sam 5 -tp 500
+
+// sell 5 ETH for USDC if it drops to 300 or rises to 500, whichever comes first
+!chip trade -s eth -b usdc -sam 5 -st 300 -tp 500
 `
 
 // Flags returns the flags needed for the trade cli sub command
@@ -100,6 +120,24 @@ func Flags() []cli.Flag {
 			Value:   false,
 			Usage:   "sets sell amount (-sam) to your current balance of the selling asset",
 		},
+		&cli.Float64Flag{
+			Name:    "stop",
+			Aliases: []string{"st"},
+			Value:   0,
+			Usage:   "sell at market once the selling asset drops to this price, or close the position once it's worth this many USD",
+		},
+		&cli.Float64Flag{
+			Name:    "floor",
+			Aliases: []string{"f"},
+			Value:   0,
+			Usage:   "turns a stop into a stop-limit that won't sell below this price",
+		},
+		&cli.Float64Flag{
+			Name:    "takeprofit",
+			Aliases: []string{"tp"},
+			Value:   0,
+			Usage:   "sell at market once the selling asset rises to this price, or close the position once it's worth this many USD",
+		},
 	}
 }
 
@@ -107,7 +145,7 @@ func Flags() []cli.Flag {
 func Trade(long, levered bool) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		// connect to the db
-		sesh, err := arango.NewSesh(ctx.Context, "cookie")
+		sesh, err := arango.Open(ctx.Context, config.Current())
 		if err != nil {
 			return err
 		}
@@ -129,11 +167,17 @@ func Trade(long, levered bool) cli.ActionFunc {
 		// checks if this order is a limit order or not
 		isLim, price := ensureLimit(ctx)
 
+		// checks for stop and take-profit orders, or a bracket on a position
+		stop, floor, take, valid := ensureTrigger(ctx, levered, isLim)
+		if !valid {
+			return nil
+		}
+
 		// make sure that an apropriate amount of leverage is being used
 		lever = ensureLeverage(ctx, lever, levered)
 
 		// ensure assets are valid/present
-		valid, err := ensureAssets(ctx, sesh, sass, bass, cass)
+		valid, err = ensureAssets(ctx, sesh, sass, bass, cass)
 		if err != nil {
 			return errors.Wrapf(err, "failure to validate assets: %s and %s: ", sass, bass)
 		}
@@ -170,14 +214,24 @@ func Trade(long, levered bool) cli.ActionFunc {
 			Leverage:   lever,
 			Long:       long,
 		}
-		if isLim {
-			err = limit.Insert(sesh)
-		} else {
-			err = limit.InsertMarket(sesh)
+		if !isLim {
+			limit.Price = 0
 		}
+		ords := []*Limit{&limit}
+		if levered && (stop > 0 || take > 0) {
+			limit.Bracket = &CloseCondition{Upper: take, Lower: stop}
+		}
+		if !levered {
+			ords = Protect(limit, stop, floor, take)
+		}
+		placed, err := PlaceGroup(sesh, ords...)
 		if err != nil {
 			return errors.Wrap(err, "failure to insert limit order")
 		}
+		if !placed {
+			ctx.Println(fmt.Sprintf("beloved meat bag, your %s is already reserved by your other orders, see !chip orders", cass))
+			return nil
+		}
 		const succMsg = `meat bag, your order has been successfully submitted, I will notify you if it gets executed.
 see !chip help if you seek further action.
 		`
@@ -196,6 +250,38 @@ func ensureLimit(ctx *cli.Context) (isLim bool, price float64) {
 	return isLim, price
 }
 
+// ensureTrigger checks for stop and take-profit prices. On spot trades they
+// create stop and take-profit orders, which can't also be limit orders. On
+// levered orders they are the USD values that close the position once it's
+// opened.
+func ensureTrigger(ctx *cli.Context, levered, isLim bool) (stop, floor, take float64, valid bool) {
+	stop = ctx.Float64("stop")
+	take = ctx.Float64("takeprofit")
+	floor = ctx.Float64("floor")
+	if stop == 0 && take == 0 && floor == 0 {
+		return 0, 0, 0, true
+	}
+	switch {
+	case stop < 0 || take < 0 || floor < 0:
+		ctx.Println("meat bag, stop, floor and take-profit prices can't be negative")
+	case stop > 0 && take > 0 && stop >= take:
+		ctx.Println("meat bag, the stop (-st) has to be below the take-profit (-tp)")
+	case levered && floor > 0:
+		ctx.Println("meat bag, a floor (-f) only works on spot trades")
+	case levered:
+		return stop, 0, take, true
+	case isLim:
+		ctx.Println("meat bag, an order can't have both a price (-p) and a stop or take-profit")
+	case stop == 0 && floor > 0:
+		ctx.Println("meat bag, a floor (-f) only works with a stop (-st)")
+	case floor > stop:
+		ctx.Println("meat bag, the floor (-f) has to be below the stop (-st)")
+	default:
+		return stop, floor, take, true
+	}
+	return 0, 0, 0, false
+}
+
 // detectUser attempts to identify the user based on the context
 func detectUser(ctx *cli.Context) (string, bool) {
 	var user string
@@ -213,21 +299,14 @@ func detectUser(ctx *cli.Context) (string, bool) {
 
 // ensureAssets validates that the assets described in the limit order are
 // indeed actual assets
-func ensureAssets(ctx *cli.Context, sesh *arango.Sesh, assets ...string) (bool, error) {
-	const query = `
-	for s in fulltext(stamps, "symbol", "%s")
-		limit 1
-		return s.market_cap > 0
-	`
+func ensureAssets(ctx *cli.Context, sesh arango.Store, assets ...string) (bool, error) {
 	for _, asset := range assets {
 		if asset == "" {
 			continue
 		}
-		var exists bool
-		err := sesh.Execute(fmt.Sprintf(query, asset), &exists)
+		exists, err := sesh.AssetExists(asset)
 		if err != nil {
-			ctx.Println(fmt.Sprintf("According to my books, asset %s does not exist. Please try again.", asset))
-			return false, nil
+			return false, err
 		}
 		if !exists {
 			ctx.Println(fmt.Sprintf("According to my books, asset %s does not exist. Please try again.", asset))
@@ -238,15 +317,15 @@ func ensureAssets(ctx *cli.Context, sesh *arango.Sesh, assets ...string) (bool,
 }
 
 // ensureSell checks to make sure that the user has enough funds
-func ensureSell(ctx *cli.Context, sesh *arango.Sesh, user, asset string, amount float64) (valid bool, amm float64, err error) {
-	var bal arango.Balance
-	err = sesh.Execute(fmt.Sprintf(arango.LatestBalanceQ, user), &bal)
+func ensureSell(ctx *cli.Context, sesh arango.Store, user, asset string, amount float64) (valid bool, amm float64, err error) {
+	bal, err := sesh.LatestBalance(user)
 	if err != nil {
 		return false, 0, err
 	}
-	currBal, has := bal.Balances[asset]
-	if !has || currBal < amount {
-		ctx.Println(fmt.Sprintf("beloved meat bag, you do not have enough %s to sell. \n current balance: %.3f", asset, currBal))
+	// funds reserved by open orders can't be sold again
+	currBal := bal.Available(asset)
+	if currBal < amount {
+		ctx.Println(fmt.Sprintf("beloved meat bag, you do not have enough %s to sell. \n available balance: %.3f (%.3f reserved by open orders)", asset, currBal, bal.Reserved[asset]))
 		return false, 0, nil
 	}
 	if ctx.Bool("all") {
@@ -284,9 +363,10 @@ func ensureLeverage(ctx *cli.Context, lever int, leveraged bool) int {
 	if !leveraged {
 		return 0
 	}
-	if lever > 5 {
-		ctx.Println("oh cute meat bag, one must walk before one can run. using the max of 5x leverage")
-		lever = 5
+	// the initial margin caps the leverage
+	if max := config.Current().MaxLeverage(); lever > max {
+		ctx.Println(fmt.Sprintf("oh cute meat bag, one must walk before one can run. using the max of %dx leverage", max))
+		lever = max
 	}
 	return lever
 }
@@ -1,9 +1,15 @@
 package trade
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/config"
 )
 
 func TestPositionValue(t *testing.T) {
@@ -39,3 +45,1091 @@ func TestPositionValue(t *testing.T) {
 	}
 	fmt.Println(out.Value)
 }
+
+// testStore creates a memory store holding prices and a user with a balance
+func testStore(t *testing.T, balances map[string]float64, prices map[string]float64) *arango.Mem {
+	m := arango.NewMem()
+	for symbol, price := range prices {
+		err := m.CreateDoc("stamps", arango.Stamp{Symbol: symbol, Price: price, Cap: 1, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.CreateDoc("users", map[string]string{"_key": "zkFART", "channel_id": "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateDoc("balances", arango.Balance{User: "zkFART", Balances: balances})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestExecuteAtomic(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	lim := Limit{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 500, CollAmount: 500}
+	err := lim.InsertMarket(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []Limit
+	m.Find("pending", nil, &pending)
+	lim = pending[0]
+
+	// a crash after executing leaves the order and the balance untouched
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		l := lim
+		_, err := l.execute(tx, arango.NewSnapshot(tx))
+		if err != nil {
+			return err
+		}
+		return errors.New("crash")
+	})
+	if err == nil {
+		t.Fatal("expected crash")
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 1000 || bal.Balances["ETH"] != 0 {
+		t.Error("balance changed by a failed execution", bal.Balances)
+	}
+	m.Find("pending", nil, &pending)
+	if len(pending) != 1 {
+		t.Error("order removed by a failed execution")
+	}
+
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := lim.execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 500 || bal.Balances["ETH"] != 2.5 {
+		t.Error("unexpected balance after execution", bal.Balances)
+	}
+	var trades []Limit
+	m.Find("pending", nil, &pending)
+	m.Find("trades", nil, &trades)
+	if len(pending) != 0 || len(trades) != 1 {
+		t.Error("order was not moved to trades", pending, trades)
+	}
+}
+
+func TestExecuteNotEnough(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 100}, map[string]float64{"USDC": 1, "ETH": 200})
+	lim := Limit{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 500, CollAmount: 500}
+	err := lim.InsertMarket(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []Limit
+	m.Find("pending", nil, &pending)
+	lim = pending[0]
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := lim.execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unfillable market order is removed from pending
+	m.Find("pending", nil, &pending)
+	if len(pending) != 0 {
+		t.Error("unfillable order was not removed")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": 200})
+	p := &Position{
+		Limit: Limit{Key: "1", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", CollAmount: 100, Price: 200, Leverage: 2, Long: true},
+		Alive: true,
+	}
+	err := m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Close(m, arango.NewSnapshot(m), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := *p
+	again.Alive = true
+	err = again.Close(m, arango.NewSnapshot(m), false)
+	if err == nil {
+		t.Error("expected closing a closed position to fail")
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 100 {
+		t.Error("expected the position to be paid out exactly once, got", bal.Balances["USDC"])
+	}
+}
+
+func TestCloseStale(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": 200})
+	p := &Position{
+		Limit: Limit{Key: "1", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", CollAmount: 1000, SellAmount: 1000, Price: 200, Leverage: 2, Long: true},
+		Alive: true,
+	}
+	err := m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half of the collateral is taken out after the position was read
+	stale := *p
+	err = p.Resize(m, arango.NewSnapshot(m), -500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stale.Close(m, arango.NewSnapshot(m), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if math.Abs(bal.Balances["USDC"]-1000) > 1e-9 {
+		t.Error("expected the stored collateral to be paid out, got", bal.Balances["USDC"])
+	}
+}
+
+func TestSkipBadPrices(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1})
+	// the ingestion stalled hours ago
+	err := m.CreateDoc("stamps", arango.Stamp{Symbol: "ETH", Price: 1, Cap: 1, Time: time.Now().Add(-time.Hour * 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := Limit{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 500, CollAmount: 500}
+	err = lim.InsertMarket(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// worthless at the stale price, so it would be liquidated
+	p := &Position{
+		Limit: Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", CollAmount: 100, Price: 200, Leverage: 2, Long: true},
+		Alive: true,
+	}
+	err = m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prices := arango.NewSnapshot(m)
+	prices.MaxAge = time.Minute * 30
+	err = ExecuteMarketOrders(nil, m, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdatePositions(nil, m, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []Limit
+	var open []Position
+	m.Find("pending", nil, &pending)
+	m.Find("positions", arango.Match{"alive": true}, &open)
+	if len(pending) != 1 || len(open) != 1 {
+		t.Error("orders were executed against a stale price", pending, open)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 1000 {
+		t.Error("balance changed by a skipped order", bal.Balances)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	newOrder := func() *Limit {
+		return &Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 600, CollAmount: 600, Price: 100}
+	}
+	first := newOrder()
+	placed, err := first.Place(m)
+	if err != nil || !placed {
+		t.Fatal("expected the first order to be placed", err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 1000 || bal.Available("USDC") != 400 {
+		t.Error("expected 600 USDC to be reserved", bal.Balances, bal.Reserved)
+	}
+	// the same funds can't back a second order
+	placed, err = newOrder().Place(m)
+	if err != nil || placed {
+		t.Fatal("expected the second order to be refused", err)
+	}
+	var lims []Limit
+	m.Find("limits", nil, &lims)
+	if len(lims) != 1 {
+		t.Fatal("expected a single order, got", len(lims))
+	}
+
+	// cancelling releases the funds
+	err = lims[0].Cancel(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	if bal.Available("USDC") != 1000 || len(bal.Reserved) != 0 {
+		t.Error("expected the reservation to be released", bal.Reserved)
+	}
+
+	// executing uses up the reservation
+	second := newOrder()
+	placed, err = second.Place(m)
+	if err != nil || !placed {
+		t.Fatal("expected the order to be placed after cancelling", err)
+	}
+	m.Find("limits", nil, &lims)
+	lim := lims[0]
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := lim.execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 400 || len(bal.Reserved) != 0 {
+		t.Error("unexpected balance after execution", bal.Balances, bal.Reserved)
+	}
+}
+
+func TestStopOrders(t *testing.T) {
+	type step struct {
+		price float64 // price of ETH in USDC
+		ready bool
+	}
+	tests := []struct {
+		name  string
+		lim   Limit
+		steps []step
+	}{
+		{
+			name:  "stop",
+			lim:   Limit{Type: Stop, Trigger: 300},
+			steps: []step{{400, false}, {301, false}, {300, true}, {250, true}},
+		},
+		{
+			name:  "take-profit",
+			lim:   Limit{Type: TakeProfit, Trigger: 500},
+			steps: []step{{400, false}, {499, false}, {500, true}, {600, true}},
+		},
+		{
+			name:  "stop-limit fills between stop and floor",
+			lim:   Limit{Type: StopLimit, Trigger: 300, Floor: 290},
+			steps: []step{{400, false}, {295, true}},
+		},
+		{
+			name:  "stop-limit waits after gapping through the floor",
+			lim:   Limit{Type: StopLimit, Trigger: 300, Floor: 290},
+			steps: []step{{400, false}, {280, false}, {285, false}, {350, true}},
+		},
+	}
+	for _, tt := range tests {
+		lim := tt.lim
+		lim.Sell, lim.Buy = "ETH", "USDC"
+		for i, s := range tt.steps {
+			m := testStore(t, nil, map[string]float64{"USDC": 1, "ETH": s.price})
+			ready, err := lim.IsReady(arango.NewSnapshot(m))
+			if err != nil {
+				t.Fatal(tt.name, err)
+			}
+			if ready != s.ready {
+				t.Errorf("%s: step %d at %.0f expected ready to be %t", tt.name, i, s.price, s.ready)
+			}
+		}
+	}
+}
+
+func TestExecuteStop(t *testing.T) {
+	m := testStore(t, map[string]float64{"ETH": 5}, map[string]float64{"USDC": 1, "ETH": 250})
+	lim := &Limit{Sell: "ETH", Buy: "USDC", Collat: "ETH", User: "zkFART", SellAmount: 5, CollAmount: 5, Type: Stop, Trigger: 300}
+	placed, err := lim.Place(m)
+	if err != nil || !placed {
+		t.Fatal("expected the stop to be placed", err)
+	}
+	var lims []Limit
+	m.Find("limits", nil, &lims)
+	if len(lims) != 1 || lims[0].Kind() != Stop {
+		t.Fatal("expected the stop to wait with the limit orders", lims)
+	}
+	stop := lims[0]
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := stop.execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["ETH"] != 0 || bal.Balances["USDC"] != 1250 || len(bal.Reserved) != 0 {
+		t.Error("unexpected balance after the stop", bal.Balances, bal.Reserved)
+	}
+	var trades []Limit
+	m.Find("limits", nil, &lims)
+	m.Find("trades", nil, &trades)
+	if len(lims) != 0 || len(trades) != 1 || trades[0].Type != Stop {
+		t.Error("stop was not moved to trades", lims, trades)
+	}
+}
+
+func TestStopLimitFloor(t *testing.T) {
+	cfg := config.Default()
+	cfg.SlippageImpact = 0.1
+	cfg.MaxSlippage = 0.05
+
+	// eth is between the stop and the floor, but without a volume the fill
+	// slips 5% to 295/1.05, below the floor
+	m := testStore(t, map[string]float64{"ETH": 5}, map[string]float64{"USDC": 1, "ETH": 295})
+	lim := &Limit{Sell: "ETH", Buy: "USDC", Collat: "ETH", User: "zkFART", SellAmount: 5, CollAmount: 5, Type: StopLimit, Trigger: 300, Floor: 290}
+	_, err := lim.Place(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := arango.NewSnapshot(m)
+	prices.Impact = cfg.SlippageFor
+	err = CheckLimits(nil, m, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lims, trades []Limit
+	m.Find("limits", nil, &lims)
+	m.Find("trades", nil, &trades)
+	if len(trades) != 0 || len(lims) != 1 || !lims[0].Triggered {
+		t.Fatal("expected the stop-limit to wait armed instead of filling below its floor", lims, trades)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["ETH"] != 5 || bal.Reserved["ETH"] != 5 {
+		t.Error("expected the funds to stay reserved", bal.Balances, bal.Reserved)
+	}
+
+	// an order removed before it is armed is left alone
+	err = m.RemoveDoc("limits", lims[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lims[0].arm(m)
+	if err != nil {
+		t.Error("expected arming a removed order to be ignored", err)
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	tests := []struct {
+		raw   string
+		trail float64
+		pct   bool
+		fail  bool
+	}{
+		{raw: "10%", trail: 0.1, pct: true},
+		{raw: "500", trail: 500},
+		{raw: "2.5 %", trail: 0.025, pct: true},
+		{raw: "100%", fail: true},
+		{raw: "-5", fail: true},
+		{raw: "ten", fail: true},
+	}
+	for _, tt := range tests {
+		trail, pct, err := ParseTrail(tt.raw)
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: unexpected error %v", tt.raw, err)
+			continue
+		}
+		if math.Abs(trail-tt.trail) > 1e-9 || pct != tt.pct {
+			t.Errorf("%s: expected %v %t, got %v %t", tt.raw, tt.trail, tt.pct, trail, pct)
+		}
+	}
+
+	m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": 200})
+	p := &Position{
+		Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 100, CollAmount: 100, Price: 200, Leverage: 2, Long: true},
+		Alive: true,
+	}
+	err := m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []float64{100, 130, 120} {
+		m.CreateDoc("post_val", PosVal{Position: "post", Value: v})
+	}
+	high, err := HighWater(m, "post")
+	if err != nil || high != 130 {
+		t.Fatal("expected a high-water value of 130, got", high, err)
+	}
+	p.CloseCond = &CloseCondition{Trail: 0.1, TrailPct: true, High: high}
+
+	// new highs raise the stop
+	p.trackHigh(150)
+	err = p.saveTick(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var posts []Position
+	m.Find("positions", nil, &posts)
+	if posts[0].CloseCond == nil || posts[0].CloseCond.High != 150 || posts[0].CloseCond.TrailStop() != 135 {
+		t.Fatal("expected the high-water value to be saved", posts[0].CloseCond)
+	}
+	prices := arango.NewSnapshot(m)
+	closed, _, err := p.Check(m, prices, 140)
+	if err != nil || closed {
+		t.Fatal("expected the position to stay open above the stop", err)
+	}
+	closed, kind, err := p.Check(m, prices, 135)
+	if err != nil || !closed || kind != "trailing" {
+		t.Fatal("expected the trailing stop to close the position", kind, err)
+	}
+}
+
+func TestOCO(t *testing.T) {
+	m := testStore(t, map[string]float64{"ETH": 5}, map[string]float64{"USDC": 1, "ETH": 550})
+	base := Limit{Sell: "ETH", Buy: "USDC", Collat: "ETH", User: "zkFART", SellAmount: 5, CollAmount: 5}
+	ords := Protect(base, 300, 0, 500)
+	if len(ords) != 2 || ords[0].Type != Stop || ords[1].Type != TakeProfit {
+		t.Fatal("expected a stop and a take-profit", ords)
+	}
+	placed, err := PlaceGroup(m, ords...)
+	if err != nil || !placed {
+		t.Fatal("expected the group to be placed", err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Reserved["ETH"] != 5 {
+		t.Error("expected the group to reserve its funds once", bal.Reserved)
+	}
+	var lims []Limit
+	m.Find("limits", nil, &lims)
+	if len(lims) != 2 || lims[0].Group == "" || lims[0].Group != lims[1].Group {
+		t.Fatal("expected two grouped orders", lims)
+	}
+	// the take-profit is hit, which removes the stop
+	var take Limit
+	for _, l := range lims {
+		if l.Type == TakeProfit {
+			take = l
+		}
+	}
+	prices := arango.NewSnapshot(m)
+	ready, err := take.IsReady(prices)
+	if err != nil || !ready {
+		t.Fatal("expected the take-profit to be ready", err)
+	}
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := take.execute(tx, prices)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Find("limits", nil, &lims)
+	if len(lims) != 0 {
+		t.Error("expected the stop to be removed", lims)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	if bal.Balances["ETH"] != 0 || bal.Balances["USDC"] != 2750 || len(bal.Reserved) != 0 {
+		t.Error("unexpected balance after the take-profit", bal.Balances, bal.Reserved)
+	}
+
+	// cancelling one order of a group cancels the rest
+	m = testStore(t, map[string]float64{"ETH": 5}, map[string]float64{"USDC": 1, "ETH": 400})
+	_, err = PlaceGroup(m, Protect(base, 300, 290, 500)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Find("limits", nil, &lims)
+	err = lims[0].Cancel(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Find("limits", nil, &lims)
+	bal, _ = m.LatestBalance("zkFART")
+	if len(lims) != 0 || len(bal.Reserved) != 0 {
+		t.Error("expected the whole group to be cancelled", lims, bal.Reserved)
+	}
+}
+
+func TestBracket(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	lim := &Limit{
+		Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1000, CollAmount: 1000, Leverage: 2, Long: true,
+		Bracket: &CloseCondition{Upper: 1500, Lower: 800},
+	}
+	placed, err := lim.Place(m)
+	if err != nil || !placed {
+		t.Fatal("expected the order to be placed", err)
+	}
+	var pending []Limit
+	m.Find("pending", nil, &pending)
+	var msg string
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		msg, err = pending[0].execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var posts []Position
+	m.Find("positions", nil, &posts)
+	if len(posts) != 1 || posts[0].CloseCond == nil || posts[0].CloseCond.Upper != 1500 || posts[0].CloseCond.Lower != 800 {
+		t.Fatal("expected the bracket to become the close condition", posts)
+	}
+	if !strings.Contains(msg, "$1500.00 or $800.00") {
+		t.Error("expected the bracket in the message", msg)
+	}
+}
+
+func TestExecuteRemoved(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	lim := Limit{Key: "gone", Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 500}
+	var msg string
+	err := m.Atomic(orderCols, func(tx arango.Store) (err error) {
+		msg, err = lim.execute(tx, arango.NewSnapshot(tx))
+		return err
+	})
+	if err != nil || msg != "" {
+		t.Error("expected an order that no longer exists to be skipped", msg, err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	if bal.Balances["USDC"] != 1000 {
+		t.Error("balance changed by a removed order", bal.Balances)
+	}
+}
+
+func TestResize(t *testing.T) {
+	newPost := func(m *arango.Mem) *Position {
+		p := &Position{
+			Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1000, CollAmount: 1000, BuyAmount: 5, Price: 200, Leverage: 2, Long: true},
+			Alive: true,
+		}
+		p.LiqPrice = p.LiquidationPrice()
+		err := m.CreateDoc("positions", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+
+	// eth is up 10%, so the 2x long is worth 1200
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 220})
+	prices := arango.NewSnapshot(m)
+	p := newPost(m)
+	paid, err := p.CloseFraction(m, prices, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ := m.LatestBalance("zkFART")
+	val, _ := p.Value(prices)
+	// liquidated at a 5% maintenance margin
+	if !near(paid, 600) || !near(bal.Balances["USDC"], 1600) || !near(val.Value, 600) || !near(p.LiqPrice, 200/1.9) {
+		t.Error("unexpected partial close", paid, bal.Balances, val.Value, p.LiqPrice)
+	}
+
+	// adding margin keeps the entry price and the 2000 USDC notional, so the
+	// leverage falls and the liquidation price moves away from the market
+	m = testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 220})
+	prices = arango.NewSnapshot(m)
+	p = newPost(m)
+	before := p.LiqPrice
+	err = p.Resize(m, prices, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	val, _ = p.Value(prices)
+	if !near(p.CollAmount, 1400) || p.Price != 200 || !near(p.EffectiveLeverage(), 2000.0/1400) || !near(val.Value, 1600) || !near(bal.Balances["USDC"], 600) {
+		t.Error("unexpected margin added", p.CollAmount, p.Price, p.EffectiveLeverage(), val.Value, bal.Balances)
+	}
+	if !near(p.LiqPrice, 200*600/(2000*0.95)) || p.LiqPrice >= before {
+		t.Error("expected adding margin to lower the liquidation price of a long", before, p.LiqPrice)
+	}
+	err = p.Resize(m, prices, -1600)
+	if err == nil {
+		t.Error("expected taking out all of the collateral to fail")
+	}
+	// reducing moves the liquidation price back towards the market
+	before = p.LiqPrice
+	err = p.Resize(m, prices, -600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ = m.LatestBalance("zkFART")
+	val, _ = p.Value(prices)
+	if !near(p.CollAmount, 800) || !near(p.EffectiveLeverage(), 2.5) || !near(val.Value, 1000) || !near(bal.Balances["USDC"], 1200) {
+		t.Error("unexpected margin taken out", p.CollAmount, p.EffectiveLeverage(), val.Value, bal.Balances)
+	}
+	if !near(p.LiqPrice, 200*1.5/(2.5*0.95)) || p.LiqPrice <= before {
+		t.Error("expected reducing to raise the liquidation price of a long", before, p.LiqPrice)
+	}
+	// gains can't be taken out by reducing
+	err = p.Resize(m, prices, -900)
+	if err == nil {
+		t.Error("expected taking out more than the collateral to fail")
+	}
+	err = p.Resize(m, prices, 5000)
+	if err == nil {
+		t.Error("expected adding more than the balance to fail")
+	}
+	err = p.Close(m, prices, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := Events(m, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	if strings.Join(kinds, ",") != "add margin,reduce,close" {
+		t.Error("unexpected position events", kinds)
+	}
+}
+
+func TestResizeStale(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	prices := arango.NewSnapshot(m)
+	p := &Position{
+		Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1000, CollAmount: 1000, Price: 200, Leverage: 2, Long: true},
+		Alive: true,
+	}
+	err := m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tick charges funding after the command read the position
+	stale := *p
+	err = m.Update("positions", "post", map[string]interface{}{"funding": 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stale.Resize(m, prices, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stale.CloseFraction(m, prices, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []Position
+	m.Find("positions", arango.Match{"_key": "post"}, &stored)
+	if len(stored) != 1 || stored[0].Funding != 50 || stored[0].CollAmount != 550 {
+		t.Error("expected the stored funding to be kept", stored)
+	}
+}
+
+func TestReduceMargin(t *testing.T) {
+	tests := []struct {
+		name   string
+		price  float64 // price of ETH, the 2x long was opened at 200
+		amount float64
+		ok     bool
+	}{
+		{"within the max leverage", 200, 600, true},
+		{"past the max leverage", 200, 700, false},
+		{"down to the last cent", 200, 999.99, false},
+		{"below the initial margin", 120, 100, false},
+	}
+	for _, tt := range tests {
+		m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": tt.price})
+		prices := arango.NewSnapshot(m)
+		p := &Position{
+			Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1000, CollAmount: 1000, Price: 200, Leverage: 2, Long: true},
+			Alive: true,
+		}
+		p.LiqPrice = p.LiquidationPrice()
+		err := m.CreateDoc("positions", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Resize(m, prices, -tt.amount)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok to be %t, got %v", tt.name, tt.ok, err)
+		}
+		if tt.ok {
+			continue
+		}
+		bal, _ := m.LatestBalance("zkFART")
+		var stored []Position
+		m.Find("positions", arango.Match{"_key": "post"}, &stored)
+		if bal.Balances["USDC"] != 0 || stored[0].CollAmount != 1000 {
+			t.Errorf("%s: expected nothing to be taken out", tt.name)
+		}
+	}
+}
+
+func TestResizeShort(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 1000}, map[string]float64{"USDC": 1, "ETH": 200})
+	prices := arango.NewSnapshot(m)
+	p := &Position{
+		Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1000, CollAmount: 1000, Price: 200, Leverage: 3},
+		Alive: true,
+	}
+	p.LiqPrice = p.LiquidationPrice()
+	err := m.CreateDoc("positions", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := p.LiqPrice
+	err = p.Resize(m, prices, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LiqPrice <= before {
+		t.Error("expected adding margin to raise the liquidation price of a short", before, p.LiqPrice)
+	}
+	before = p.LiqPrice
+	err = p.Resize(m, prices, -700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LiqPrice >= before || math.Abs(p.EffectiveLeverage()-3.75) > 1e-9 {
+		t.Error("expected reducing to lower the liquidation price of a short", before, p.LiqPrice, p.EffectiveLeverage())
+	}
+}
+
+func TestFunding(t *testing.T) {
+	m := testStore(t, nil, map[string]float64{"USDC": 1, "ETH": 200})
+	prices := arango.NewSnapshot(m)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &Position{
+		Limit: Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", CollAmount: 1000, SellAmount: 1000, Price: 200, Leverage: 5, Long: true},
+		Start: start,
+		Alive: true,
+	}
+	// 4000 USDC is borrowed for a year at 10%
+	p.Accrue(0.1, start.Add(year/2))
+	p.Accrue(0.1, start.Add(year))
+	if math.Abs(p.Funding-400) > 1e-6 {
+		t.Fatal("expected 400 USDC of funding, got", p.Funding)
+	}
+	val, err := p.Value(prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(val.Value-600) > 1e-6 || math.Abs(val.Funding-400) > 1e-6 {
+		t.Error("expected the funding to be taken out of the value", val)
+	}
+	// enough funding wipes out the margin
+	p.Accrue(0.1, start.Add(year*5/2))
+	val, _ = p.Value(prices)
+	if val.Value > 0 {
+		t.Error("expected the position to be worthless", val)
+	}
+
+	// unlevered positions and positions from before funding are free
+	flat := &Position{Limit: Limit{CollAmount: 1000, Leverage: 1}, Start: start}
+	flat.Accrue(0.1, start.Add(year))
+	old := &Position{Limit: Limit{CollAmount: 1000, Leverage: 5}}
+	old.Accrue(0.1, start.Add(year))
+	if flat.Funding != 0 || old.Funding != 0 || !old.FundedAt.Equal(start.Add(year)) {
+		t.Error("unexpected funding", flat.Funding, old.Funding, old.FundedAt)
+	}
+}
+
+func TestMargin(t *testing.T) {
+	margins := Margins{Maintenance: 0.05, Call: 0.1, Fee: 0.01}
+	tests := []struct {
+		name   string
+		long   bool
+		price  float64 // price of ETH, the position was opened at 200
+		ratio  float64
+		status int
+	}{
+		{"long opened", true, 200, 0.2, MarginOK},
+		{"long up", true, 240, 2000.0 / 6000, MarginOK},
+		{"long margin call", true, 170, 250.0 / 4250, MarginCalled},
+		{"long at the liquidation price", true, 200 * 4 / (5 * 0.95), 0.05, MarginLiquidate},
+		{"long past the liquidation price", true, 165, 125.0 / 4125, MarginLiquidate},
+		{"short opened", false, 200, 0.2, MarginOK},
+		{"short down", false, 180, 1500.0 / 4500, MarginOK},
+		{"short margin call", false, 220, 500.0 / 5500, MarginCalled},
+		{"short at the liquidation price", false, 200 * 6 / (5 * 1.05), 0.05, MarginLiquidate},
+		{"short past the liquidation price", false, 230, 250.0 / 5750, MarginLiquidate},
+	}
+	for _, tt := range tests {
+		m := testStore(t, nil, map[string]float64{"USDC": 1, "ETH": tt.price})
+		prices := arango.NewSnapshot(m)
+		p := &Position{
+			Limit: Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", CollAmount: 1000, SellAmount: 1000, Price: 200, Leverage: 5, Long: tt.long},
+			Alive: true,
+		}
+		val, err := p.Value(prices)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		ratio, err := p.MarginRatio(prices, val.Value)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if math.Abs(ratio-tt.ratio) > 1e-9 {
+			t.Errorf("%s: expected a margin ratio of %v, got %v", tt.name, tt.ratio, ratio)
+		}
+		// values that land exactly on the maintenance margin can be off by a rounding error
+		if status := margins.Status(ratio - 1e-12); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, status)
+		}
+	}
+}
+
+func TestLiquidationPayout(t *testing.T) {
+	tests := []struct {
+		name  string
+		price float64
+		paid  float64
+		fee   float64
+	}{
+		// 5% of the notional is left, 1% of it goes to the fee
+		{"at the maintenance margin", 200 * 4 / (5 * 0.95), 4000 / 0.95 * 0.04, 4000 / 0.95 * 0.01},
+		// less than the fee is left, which is all taken
+		{"gapped past the liquidation price", 161, 0, 1000 * (1 - 5*0.195)},
+		// nothing is taken from an empty position
+		{"gapped to nothing", 150, 0, 0},
+	}
+	for _, tt := range tests {
+		m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": tt.price})
+		p := &Position{
+			Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", CollAmount: 1000, SellAmount: 1000, Price: 200, Leverage: 5, Long: true},
+			Alive: true,
+		}
+		err := m.CreateDoc("positions", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Close(m, arango.NewSnapshot(m), true)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		bal, _ := m.LatestBalance("zkFART")
+		events, _ := Events(m, "post")
+		if math.Abs(bal.Balances["USDC"]-tt.paid) > 1e-6 || len(events) != 1 || math.Abs(events[0].Fee-tt.fee) > 1e-6 {
+			t.Errorf("%s: expected %v paid and a %v fee, got %v and %v", tt.name, tt.paid, tt.fee, bal.Balances["USDC"], events)
+		}
+		if !strings.Contains(p.liquidationMessage(), fmt.Sprintf("%.3f USDC", tt.paid)) {
+			t.Errorf("%s: expected the payout in the message: %s", tt.name, p.liquidationMessage())
+		}
+	}
+}
+
+func TestFees(t *testing.T) {
+	cfg := config.Default()
+	cfg.Fees = config.Fees{Maker: 0.001, Taker: 0.002}
+	cfg.AssetFees = map[string]config.Fees{"DOGE": {Maker: 0.01, Taker: 0.02}}
+	cfg.SlippageImpact = 0.1
+	cfg.MaxSlippage = 0.05
+
+	m := arango.NewMem()
+	for _, s := range []arango.Stamp{
+		{Symbol: "USDC", Price: 1, Volume: 1e12},
+		{Symbol: "ETH", Price: 200, Volume: 1e7},
+		{Symbol: "DOGE", Price: 0.01, Volume: 1e6},
+		{Symbol: "FXC", Price: 1},
+	} {
+		s.Cap, s.Time = 1, time.Now()
+		err := m.CreateDoc("stamps", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prices := arango.NewSnapshot(m)
+	prices.Fees = cfg.FeesFor
+	prices.Impact = cfg.SlippageFor
+	tests := []struct {
+		name     string
+		sell     string
+		buy      string
+		size     float64
+		maker    bool
+		rate     float64
+		slippage float64
+	}{
+		{"maker orders don't slip", "USDC", "ETH", 1e6, true, 0.001, 0},
+		{"slippage grows with the order", "USDC", "ETH", 1e5, false, 0.002, 0.001},
+		{"the less liquid side slips", "ETH", "DOGE", 1e4, false, 0.02, 0.001},
+		{"asset overrides apply to either side", "DOGE", "USDC", 0, true, 0.01, 0},
+		{"slippage is capped", "USDC", "ETH", 1e7, false, 0.002, 0.05},
+		{"unknown volumes slip the most", "USDC", "FXC", 1, false, 0.002, 0.05},
+	}
+	for _, tt := range tests {
+		rate, slip, err := costs(prices, tt.sell, tt.buy, tt.size, tt.maker)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if math.Abs(rate-tt.rate) > 1e-12 || math.Abs(slip-tt.slippage) > 1e-12 {
+			t.Errorf("%s: expected %v and %v, got %v and %v", tt.name, tt.rate, tt.slippage, rate, slip)
+		}
+	}
+
+	// a 100k market buy of eth slips 0.1% and pays 0.2% of what it buys
+	err := m.CreateDoc("users", map[string]string{"_key": "zkFART", "channel_id": "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateDoc("balances", arango.Balance{User: "zkFART", Balances: map[string]float64{"USDC": 2e5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := &Limit{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 1e5, CollAmount: 1e5}
+	_, err = lim.Place(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []Limit
+	m.Find("pending", nil, &pending)
+	var msg string
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		msg, err = pending[0].execute(tx, prices)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bought := 1e5 / (200 * 1.001)
+	var trades []Limit
+	m.Find("trades", nil, &trades)
+	if len(trades) != 1 || math.Abs(trades[0].BuyAmount-bought*0.998) > 1e-9 || math.Abs(trades[0].Fee-bought*0.002) > 1e-9 || trades[0].FeeAsset != "ETH" || trades[0].Slippage != 0.001 {
+		t.Fatal("expected the costs to be recorded on the trade", trades)
+	}
+	if !strings.Contains(msg, "slippage: 0.100%") {
+		t.Error("expected the costs in the message", msg)
+	}
+
+	// a 5x market long pays the taker fee on the whole position out of its collateral
+	lev := &Limit{Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 1e4, CollAmount: 1e4, Leverage: 5, Long: true}
+	_, err = lev.Place(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Find("pending", nil, &pending)
+	err = m.Atomic(orderCols, func(tx arango.Store) error {
+		_, err := pending[0].execute(tx, prices)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var posts []Position
+	m.Find("positions", nil, &posts)
+	if len(posts) != 1 || math.Abs(posts[0].CollAmount-(1e4-100)) > 1e-9 || math.Abs(posts[0].Price-200*1.0005) > 1e-9 {
+		t.Error("unexpected position after costs", posts)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	m := testStore(t, map[string]float64{"USDC": 2000}, map[string]float64{"USDC": 1, "ETH": 200})
+	err := m.CreateDoc("stamps", arango.Stamp{Symbol: "BTC", Price: 11000, Bid: 10990, Ask: 11010, Cap: 1, Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := arango.NewSnapshot(m)
+	prices.Spread = func(symbol string) float64 {
+		if symbol == "ETH" {
+			return 0.01
+		}
+		return 0
+	}
+	tests := []struct {
+		name  string
+		lim   Limit
+		ready bool
+	}{
+		{"buys at the mid wait for the ask", Limit{Sell: "USDC", Buy: "ETH", Price: 200, Long: true}, false},
+		{"sells at the mid wait for the bid", Limit{Sell: "USDC", Buy: "ETH", Price: 200}, false},
+		{"buys at the ask fill", Limit{Sell: "USDC", Buy: "ETH", Price: 201, Long: true}, true},
+		{"sells at the bid fill", Limit{Sell: "USDC", Buy: "ETH", Price: 199}, true},
+		{"sourced asks are used", Limit{Sell: "USDC", Buy: "BTC", Price: 11000, Long: true}, false},
+		{"sourced bids are used", Limit{Sell: "USDC", Buy: "BTC", Price: 10990}, true},
+		{"stops trigger on the bid", Limit{Sell: "ETH", Buy: "USDC", Type: Stop, Trigger: 199.5}, true},
+		{"take-profits trigger on the bid", Limit{Sell: "ETH", Buy: "USDC", Type: TakeProfit, Trigger: 200}, false},
+	}
+	for _, tt := range tests {
+		ready, err := tt.lim.IsReady(prices)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if ready != tt.ready {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.ready, ready)
+		}
+	}
+
+	// market buys fill at the ask and market shorts at the bid
+	ords := []*Limit{
+		{Sell: "USDC", Buy: "ETH", User: "zkFART", SellAmount: 1005, CollAmount: 1005},
+		{Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", SellAmount: 500, CollAmount: 500, Leverage: 2},
+	}
+	for _, lim := range ords {
+		_, err = lim.Place(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pending []Limit
+	m.Find("pending", nil, &pending)
+	for _, lim := range pending {
+		err = m.Atomic(orderCols, func(tx arango.Store) error {
+			_, err := lim.execute(tx, prices)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var trades []Limit
+	m.Find("trades", nil, &trades)
+	if len(trades) != 1 || math.Abs(trades[0].BuyAmount-5) > 1e-9 || math.Abs(trades[0].Price-201) > 1e-9 {
+		t.Error("expected the buy to fill at the ask", trades)
+	}
+	var posts []Position
+	m.Find("positions", nil, &posts)
+	if len(posts) != 1 || math.Abs(posts[0].Price-199) > 1e-9 {
+		t.Error("expected the short to open at the bid", posts)
+	}
+}
+
+func TestCloseSpread(t *testing.T) {
+	tests := []struct {
+		name string
+		long bool
+		paid float64
+	}{
+		// a 2x long opened at the mid sells at the bid, 199, losing 1% of 1000
+		{"longs close at the bid", true, 990},
+		// a 2x short buys back at the ask, 201, also losing 1% of 1000
+		{"shorts close at the ask", false, 990},
+	}
+	for _, tt := range tests {
+		m := testStore(t, map[string]float64{"USDC": 0}, map[string]float64{"USDC": 1, "ETH": 200})
+		prices := arango.NewSnapshot(m)
+		prices.Spread = func(symbol string) float64 {
+			if symbol == "ETH" {
+				return 0.01
+			}
+			return 0
+		}
+		p := &Position{
+			Limit: Limit{Key: "post", Sell: "USDC", Buy: "ETH", Collat: "USDC", User: "zkFART", CollAmount: 1000, SellAmount: 1000, Price: 200, Leverage: 2, Long: tt.long},
+			Alive: true,
+		}
+		err := m.CreateDoc("positions", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notional, err := p.Notional(prices)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		err = p.Close(m, prices, false)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		bal, _ := m.LatestBalance("zkFART")
+		if math.Abs(bal.Balances["USDC"]-tt.paid) > 1e-6 {
+			t.Errorf("%s: expected %v paid out, got %v", tt.name, tt.paid, bal.Balances["USDC"])
+		}
+		want := 2000 * 199.0 / 200
+		if !tt.long {
+			want = 2000 * 201.0 / 200
+		}
+		if math.Abs(notional-want) > 1e-6 {
+			t.Errorf("%s: expected a notional of %v, got %v", tt.name, want, notional)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Config holds the settings needed to connect chip to its database and data
+// sources. The json field names match the old arango-cmc.json creds file, so
+// that file can be used as a config file once endpoints are added to it.
+type Config struct {
+	// Store selects the backend, either "arango" or "memory"
+	Store string `json:"store"`
+	// StorePath is where the memory store is saved, if anywhere
+	StorePath  string   `json:"store_path"`
+	Endpoints  []string `json:"endpoints"`
+	Database   string   `json:"database"`
+	ArangoUser string   `json:"ARANGO_USER"`
+	ArangoPass string   `json:"ARANGO_PASS"`
+	CMCSecret  string   `json:"CMC_API_KEY"`
+	// CMCEndpoint is the base url of the CoinMarketCap compatible api that
+	// prices are ingested from
+	CMCEndpoint string `json:"cmc_endpoint"`
+	// Ingest makes the boot loop ingest prices itself on every tick, instead
+	// of waiting for another process to write them
+	Ingest bool `json:"ingest"`
+	// IngestLimit is the number of top coins that are ingested
+	IngestLimit int `json:"ingest_limit"`
+	// MaxPriceAge is how many seconds old a price can be before orders and
+	// positions are no longer executed, closed or liquidated against it
+	MaxPriceAge int `json:"max_price_age"`
+	// BorrowRate is the yearly interest charged on the borrowed part of a
+	// levered position, its collateral times its leverage minus one. The cost
+	// accrues every tick and is taken out of the position's value.
+	BorrowRate float64 `json:"borrow_rate"`
+	// InitialMargin is the smallest fraction of a position's notional value
+	// that can be put up as collateral, which caps the leverage
+	InitialMargin float64 `json:"initial_margin"`
+	// MaintenanceMargin is the fraction of a position's notional value that
+	// its value can fall to before it is liquidated
+	MaintenanceMargin float64 `json:"maintenance_margin"`
+	// MarginCall is the fraction of a position's notional value below which
+	// its owner is warned that it is close to being liquidated
+	MarginCall float64 `json:"margin_call"`
+	// LiquidationFee is the fraction of a position's notional value taken
+	// from whatever is left of it when it is liquidated
+	LiquidationFee float64 `json:"liquidation_fee"`
+	// Fees are charged on every order when it is executed
+	Fees Fees `json:"fees"`
+	// AssetFees override Fees for orders that buy or sell these assets
+	AssetFees map[string]Fees `json:"asset_fees,omitempty"`
+	// SlippageImpact is how far the price moves against a market order, as a
+	// fraction of the price for each fraction of the asset's 24 hour volume
+	// the order is worth
+	SlippageImpact float64 `json:"slippage_impact"`
+	// MaxSlippage caps the slippage of a single order, and is used for assets
+	// without a known volume
+	MaxSlippage float64 `json:"max_slippage"`
+	// Spread is the gap between the bid and the ask of an asset as a fraction
+	// of its price, used for assets whose prices are ingested without a bid and
+	// ask. Buys fill at the ask and sells at the bid.
+	Spread float64 `json:"spread"`
+	// AssetSpreads override Spread for these assets
+	AssetSpreads map[string]float64 `json:"asset_spreads,omitempty"`
+	// RoundDays is how many days each competition round lasts
+	RoundDays int `json:"round_days"`
+}
+
+// Fees are trading fees as fractions of the value of an order. Limit orders
+// are charged the maker fee, everything else the taker fee.
+type Fees struct {
+	Maker float64 `json:"maker"`
+	Taker float64 `json:"taker"`
+}
+
+// FeesFor returns the fees of an order trading symbols, using the override of
+// the first of them that has one
+func (c *Config) FeesFor(symbols ...string) Fees {
+	for _, symbol := range symbols {
+		if fees, has := c.AssetFees[symbol]; has {
+			return fees
+		}
+	}
+	return c.Fees
+}
+
+// SpreadFor returns the synthetic spread of symbol
+func (c *Config) SpreadFor(symbol string) float64 {
+	if spread, has := c.AssetSpreads[symbol]; has {
+		return spread
+	}
+	return c.Spread
+}
+
+// SlippageFor returns the fraction that an order worth size USD moves the price
+// of an asset with 24 hour volume vol in USD. Assets without a known volume
+// slip the most.
+func (c *Config) SlippageFor(size, vol float64) float64 {
+	if c.SlippageImpact <= 0 {
+		return 0
+	}
+	if vol <= 0 {
+		return c.MaxSlippage
+	}
+	slip := c.SlippageImpact * size / vol
+	if c.MaxSlippage > 0 && slip > c.MaxSlippage {
+		return c.MaxSlippage
+	}
+	return slip
+}
+
+// Default returns the settings used when nothing else is configured. There are
+// no default arangodb endpoints or credentials, see CheckArango.
+func Default() *Config {
+	return &Config{
+		Store:       "arango",
+		Database:    "cookie",
+		CMCEndpoint: "https://pro-api.coinmarketcap.com",
+		IngestLimit: 300,
+		MaxPriceAge: 1800,
+		BorrowRate:  0.1,
+		// 5x leverage at most
+		InitialMargin:     0.2,
+		MaintenanceMargin: 0.05,
+		MarginCall:        0.1,
+		LiquidationFee:    0.01,
+		Fees:              Fees{Maker: 0.0005, Taker: 0.001},
+		SlippageImpact:    0.1,
+		MaxSlippage:       0.05,
+		Spread:            0.002,
+		RoundDays:         7,
+	}
+}
+
+// DefaultPath is where the config file is looked for if no other path is given
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".chip", "config.json")
+}
+
+// Load reads the config file at path over the defaults, and then applies any
+// environment variable overrides. A missing file is not an error unless path
+// was explicitly given. An empty path falls back to CHIP_CONFIG, then
+// DefaultPath.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	explicit := true
+	if path == "" {
+		path = os.Getenv("CHIP_CONFIG")
+	}
+	if path == "" {
+		path = DefaultPath()
+		explicit = false
+	}
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+	case err != nil:
+		return nil, errors.Wrapf(err, "failure to read config file %s", path)
+	default:
+		err = json.Unmarshal(raw, cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failure to parse config file %s", path)
+		}
+	}
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+// applyEnv overrides any setting that has a corresponding environment variable
+func (c *Config) applyEnv() {
+	setString(&c.Store, "CHIP_STORE")
+	setString(&c.StorePath, "CHIP_STORE_PATH")
+	setString(&c.Database, "CHIP_DATABASE")
+	setString(&c.ArangoUser, "CHIP_ARANGO_USER")
+	setString(&c.ArangoPass, "CHIP_ARANGO_PASS")
+	setString(&c.CMCSecret, "CHIP_CMC_API_KEY")
+	setString(&c.CMCEndpoint, "CHIP_CMC_ENDPOINT")
+	if age, err := strconv.Atoi(os.Getenv("CHIP_MAX_PRICE_AGE")); err == nil {
+		c.MaxPriceAge = age
+	}
+	setFloat(&c.BorrowRate, "CHIP_BORROW_RATE")
+	setFloat(&c.InitialMargin, "CHIP_INITIAL_MARGIN")
+	setFloat(&c.MaintenanceMargin, "CHIP_MAINTENANCE_MARGIN")
+	setFloat(&c.MarginCall, "CHIP_MARGIN_CALL")
+	setFloat(&c.LiquidationFee, "CHIP_LIQUIDATION_FEE")
+	setFloat(&c.Spread, "CHIP_SPREAD")
+	if days, err := strconv.Atoi(os.Getenv("CHIP_ROUND_DAYS")); err == nil {
+		c.RoundDays = days
+	}
+	if os.Getenv("CHIP_INGEST") != "" {
+		c.Ingest = os.Getenv("CHIP_INGEST") == "true"
+	}
+	if eps := os.Getenv("CHIP_ARANGO_ENDPOINTS"); eps != "" {
+		c.Endpoints = splitList(eps)
+	}
+}
+
+func setString(field *string, env string) {
+	if val := os.Getenv(env); val != "" {
+		*field = val
+	}
+}
+
+func setFloat(field *float64, env string) {
+	if val, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil {
+		*field = val
+	}
+}
+
+func splitList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Flags returns the global flags that override the config file and environment
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the config file (default $CHIP_CONFIG or ~/.chip/config.json)",
+		},
+		&cli.StringFlag{
+			Name:  "store",
+			Usage: "storage backend to use, arango or memory",
+		},
+		&cli.StringFlag{
+			Name:  "store-path",
+			Usage: "file the memory store is saved to",
+		},
+		&cli.StringFlag{
+			Name:  "endpoints",
+			Usage: "comma separated arangodb endpoints",
+		},
+		&cli.StringFlag{
+			Name:  "database",
+			Usage: "arangodb database name",
+		},
+		&cli.StringFlag{
+			Name:  "arango-user",
+			Usage: "arangodb username",
+		},
+		&cli.StringFlag{
+			Name:  "arango-pass",
+			Usage: "arangodb password",
+		},
+		&cli.StringFlag{
+			Name:  "cmc-key",
+			Usage: "coinmarketcap api key",
+		},
+		&cli.StringFlag{
+			Name:  "cmc-endpoint",
+			Usage: "base url of the coinmarketcap compatible api",
+		},
+	}
+}
+
+// applyFlags overrides any setting whose global flag was set
+func (c *Config) applyFlags(ctx *cli.Context) {
+	if ctx.IsSet("store") {
+		c.Store = ctx.String("store")
+	}
+	if ctx.IsSet("store-path") {
+		c.StorePath = ctx.String("store-path")
+	}
+	if ctx.IsSet("endpoints") {
+		c.Endpoints = splitList(ctx.String("endpoints"))
+	}
+	if ctx.IsSet("database") {
+		c.Database = ctx.String("database")
+	}
+	if ctx.IsSet("arango-user") {
+		c.ArangoUser = ctx.String("arango-user")
+	}
+	if ctx.IsSet("arango-pass") {
+		c.ArangoPass = ctx.String("arango-pass")
+	}
+	if ctx.IsSet("cmc-key") {
+		c.CMCSecret = ctx.String("cmc-key")
+	}
+	if ctx.IsSet("cmc-endpoint") {
+		c.CMCEndpoint = ctx.String("cmc-endpoint")
+	}
+}
+
+// CheckArango explains what is missing if there isn't enough configured to
+// connect to arangodb.
+//
+// chip used to always connect to http://192.168.0.33:8529 with the credentials
+// in /home/evan/.creds/arango-cmc.json. To keep doing so, copy that file to
+// ~/.chip/config.json and add "endpoints": ["http://192.168.0.33:8529"] to it.
+func (c *Config) CheckArango() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("no arangodb endpoints configured: set endpoints in the config file, CHIP_ARANGO_ENDPOINTS or --endpoints")
+	}
+	if c.ArangoUser == "" {
+		return errors.New("no arangodb credentials configured: set ARANGO_USER and ARANGO_PASS in the config file, CHIP_ARANGO_USER and CHIP_ARANGO_PASS or --arango-user and --arango-pass")
+	}
+	return nil
+}
+
+// MaxLeverage is the most leverage the initial margin allows
+func (c *Config) MaxLeverage() int {
+	if c.InitialMargin <= 0 {
+		return 1
+	}
+	// leave room for rounding, 1/0.2 should be 5
+	return int(math.Floor(1/c.InitialMargin + 1e-9))
+}
+
+// RoundLength returns how long each competition round lasts, a week unless
+// RoundDays is set
+func (c *Config) RoundLength() time.Duration {
+	if c.RoundDays <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.RoundDays) * 24 * time.Hour
+}
+
+// PriceAge returns MaxPriceAge as a duration
+func (c *Config) PriceAge() time.Duration {
+	return time.Duration(c.MaxPriceAge) * time.Second
+}
+
+var (
+	mu      sync.RWMutex
+	current *Config
+)
+
+// Before loads the configuration used by Current. Commands coming from discord
+// reuse the configuration loaded at boot, so global flags can only be used
+// locally and a discord user can't point chip at another database.
+func Before(ctx *cli.Context) error {
+	if ctx.Slug != nil && loaded() {
+		return nil
+	}
+	cfg, err := Load(ctx.String("config"))
+	if err != nil {
+		return err
+	}
+	if ctx.Slug == nil {
+		cfg.applyFlags(ctx)
+	}
+	Set(cfg)
+	return nil
+}
+
+// Current returns the loaded configuration, or the defaults if none was loaded
+func Current() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current == nil {
+		return Default()
+	}
+	return current
+}
+
+// Set replaces the configuration returned by Current
+func Set(cfg *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = cfg
+}
+
+func loaded() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current != nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	const file = `{
+		"database": "staging",
+		"endpoints": ["http://10.0.0.1:8529"],
+		"ARANGO_USER": "chip",
+		"ARANGO_PASS": "hunter2",
+		"CMC_API_KEY": "abc"
+	}`
+	err = ioutil.WriteFile(path, []byte(file), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		Store:      "arango",
+		Endpoints:  []string{"http://10.0.0.1:8529"},
+		Database:   "staging",
+		ArangoUser: "chip",
+		ArangoPass: "hunter2",
+		CMCSecret:  "abc",
+		// defaults are kept for anything the file doesn't set
+		CMCEndpoint:       "https://pro-api.coinmarketcap.com",
+		IngestLimit:       300,
+		MaxPriceAge:       1800,
+		BorrowRate:        0.1,
+		InitialMargin:     0.2,
+		MaintenanceMargin: 0.05,
+		MarginCall:        0.1,
+		LiquidationFee:    0.01,
+		Fees:              Fees{Maker: 0.0005, Taker: 0.001},
+		SlippageImpact:    0.1,
+		MaxSlippage:       0.05,
+		Spread:            0.002,
+		RoundDays:         7,
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+
+	// environment variables override the file
+	os.Setenv("CHIP_DATABASE", "production")
+	os.Setenv("CHIP_ARANGO_ENDPOINTS", "http://10.0.0.2:8529, http://10.0.0.3:8529")
+	defer os.Unsetenv("CHIP_DATABASE")
+	defer os.Unsetenv("CHIP_ARANGO_ENDPOINTS")
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database != "production" {
+		t.Error("expected database to be overridden, got", cfg.Database)
+	}
+	if !reflect.DeepEqual(cfg.Endpoints, []string{"http://10.0.0.2:8529", "http://10.0.0.3:8529"}) {
+		t.Error("expected endpoints to be overridden, got", cfg.Endpoints)
+	}
+	if cfg.ArangoUser != "chip" {
+		t.Error("expected user from file, got", cfg.ArangoUser)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	_, err := Load(filepath.Join(os.TempDir(), "chip-does-not-exist.json"))
+	if err == nil {
+		t.Error("expected an explicit missing config file to fail")
+	}
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", os.TempDir())
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestCheckArango(t *testing.T) {
+	cfg := Default()
+	if cfg.CheckArango() == nil {
+		t.Error("expected the defaults to be missing an endpoint")
+	}
+	cfg.Endpoints = []string{"http://192.168.0.33:8529"}
+	if cfg.CheckArango() == nil {
+		t.Error("expected the defaults to be missing credentials")
+	}
+	cfg.ArangoUser, cfg.ArangoPass = "chip", "hunter2"
+	if err := cfg.CheckArango(); err != nil {
+		t.Error("expected endpoints and credentials to be enough, got", err)
+	}
+}
@@ -8,11 +8,22 @@ import (
 	"time"
 
 	"github.com/evan-forbes/chip/arango"
+	"github.com/evan-forbes/chip/cmd/award"
 	"github.com/evan-forbes/chip/cmd/begin"
+	"github.com/evan-forbes/chip/cmd/cancel"
+	"github.com/evan-forbes/chip/cmd/chart"
 	"github.com/evan-forbes/chip/cmd/close"
 	"github.com/evan-forbes/chip/cmd/folio"
+	"github.com/evan-forbes/chip/cmd/history"
+	"github.com/evan-forbes/chip/cmd/ingest"
+	"github.com/evan-forbes/chip/cmd/leaderboard"
+	"github.com/evan-forbes/chip/cmd/margin"
+	"github.com/evan-forbes/chip/cmd/orders"
 	"github.com/evan-forbes/chip/cmd/posts"
+	"github.com/evan-forbes/chip/cmd/stamps"
+	"github.com/evan-forbes/chip/cmd/stats"
 	"github.com/evan-forbes/chip/cmd/trade"
+	"github.com/evan-forbes/chip/config"
 	"github.com/pkg/errors"
 	cron "github.com/robfig/cron/v3"
 	"github.com/urfave/cli/v2"
@@ -36,6 +47,8 @@ func main() {
 	app.EnableBashCompletion = true
 	app.Name = "chip"
 	app.Usage = "paper trade the top 300 crypto currencies"
+	app.Flags = config.Flags()
+	app.Before = config.Before
 
 	// subcommands
 	app.Commands = []*cli.Command{
@@ -78,13 +91,56 @@ func main() {
 			Action:    close.Close,
 			Flags:     close.Flags(),
 		},
+		{
+			Name:      "addmargin",
+			Usage:     "add collateral to an open position",
+			UsageText: margin.AddUsageText,
+			Action:    margin.Resize(true),
+			Flags:     margin.Flags(),
+		},
+		{
+			Name:      "reduce",
+			Usage:     "take collateral out of an open position",
+			UsageText: margin.ReduceUsageText,
+			Action:    margin.Resize(false),
+			Flags:     margin.Flags(),
+		},
 
-		// {
-		// 	Name:  "award",
-		// 	Usage: "starts the process of issuing a reward",
-		// 	// Flags: "",
-		// 	// Action: trade.Short,s
-		// },
+		{
+			Name:      "history",
+			Usage:     "look at your past trades and closed positions",
+			UsageText: history.UsageText,
+			Action:    history.History,
+			Flags:     history.Flags(),
+		},
+		{
+			Name:      "leaderboard",
+			Usage:     "see who the best meat bags are",
+			UsageText: leaderboard.UsageText,
+			Action:    leaderboard.Leaderboard,
+			Flags:     leaderboard.Flags(),
+		},
+		{
+			Name:      "stats",
+			Usage:     "see how well you, or another meat bag, trade",
+			UsageText: stats.UsageText,
+			ArgsUsage: "[@user]",
+			Action:    stats.Stats,
+			Flags:     stats.Flags(),
+		},
+		{
+			Name:  "award",
+			Usage: "see who won the competition rounds",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "history",
+					Usage:     "show the results of past rounds",
+					UsageText: award.HistoryUsageText,
+					Action:    award.History,
+					Flags:     award.HistoryFlags(),
+				},
+			},
+		},
 		// {
 		// 	Name:  "post",
 		// 	Usage: "shows you your current open positions",
@@ -103,18 +159,45 @@ func main() {
 		// 	// Flags: tradeFlags,
 		// 	// Action: trade.Short,s
 		// },
-		// {
-		// 	Name:  "orders",
-		// 	Usage: "shows you all of your current limit orders",
-		// 	// Flags: tradeFlags,
-		// 	// Action: trade.Short,s
-		// },
-		// {
-		// 	Name:  "cancel",
-		// 	Usage: "removes a limit order",
-		// 	// Flags: tradeFlags,
-		// 	// Action: trade.Short,s
-		// },
+		{
+			Name:   "orders",
+			Usage:  "shows you all of your open market, limit, stop and take-profit orders",
+			Action: orders.Orders,
+		},
+		{
+			Name:      "cancel",
+			Usage:     "removes a limit order",
+			UsageText: cancel.UsageText,
+			Action:    cancel.Cancel,
+			Flags:     cancel.Flags(),
+		},
+		{
+			Name:      "chart",
+			Usage:     "look at the recent prices of an asset",
+			UsageText: chart.UsageText,
+			Action:    chart.Chart,
+			Flags:     chart.Flags(),
+		},
+		{
+			Name:      "ingest",
+			Usage:     "fetch the latest prices of the top crypto currencies",
+			UsageText: ingest.UsageText,
+			Action:    ingest.Ingest,
+			Flags:     ingest.Flags(),
+		},
+		{
+			Name:  "stamps",
+			Usage: "maintain the price history",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "compact",
+					Usage:     "downsample, archive and delete old prices",
+					UsageText: stamps.CompactUsageText,
+					Action:    stamps.CompactCmd,
+					Flags:     stamps.CompactFlags(),
+				},
+			},
+		},
 		{
 			Name:   "begin",
 			Usage:  "start your journey with chip",
@@ -126,31 +209,61 @@ func main() {
 	if strings.Contains(strings.Join(os.Args, ""), "boot") {
 		crn := cron.New()
 		crn.AddFunc("*/15 * * * *", func() {
-			time.Sleep(time.Second * 30)
+			cfg := config.Current()
 			// connect to arango
-			sesh, err := arango.NewSesh(context.Background(), "cookie")
+			sesh, err := arango.Open(context.Background(), cfg)
 			if err != nil {
 				log.Println(errors.Wrap(err, "failure to update chip:"))
 				return
 			}
+			if cfg.Ingest {
+				// fetch fresh prices ourselves
+				_, err = ingest.Run(context.Background(), sesh, ingest.NewClient(cfg), cfg.IngestLimit)
+				if err != nil {
+					log.Println(errors.Wrap(err, "failure to update chip"))
+					return
+				}
+			} else {
+				// give the ingestion service time to write fresh prices
+				time.Sleep(time.Second * 30)
+			}
+			// price everything in this tick against the same snapshot
+			prices := arango.NewSnapshotFrom(sesh, cfg)
+			err = trade.Prefetch(sesh, prices)
+			if err != nil {
+				log.Println(errors.Wrap(err, "failure to update chip"))
+				return
+			}
 			// execute market orders
-			err = trade.ExecuteMarketOrders(app.Disc, sesh)
+			err = trade.ExecuteMarketOrders(app.Disc, sesh, prices)
 			if err != nil {
 				log.Println(errors.Wrap(err, "failure to update chip: could not execute market orders"))
 				return
 			}
 			// update any limit orders
-			err = trade.CheckLimits(app.Disc, sesh)
+			err = trade.CheckLimits(app.Disc, sesh, prices)
 			if err != nil {
 				log.Println(errors.Wrap(err, "failure to update chip: could not update limit orders"))
 				return
 			}
 			// update all positions
-			err = trade.UpdatePositions(app.Disc, sesh)
+			err = trade.UpdatePositions(app.Disc, sesh, prices)
 			if err != nil {
 				log.Println(errors.Wrap(err, "failure to update chip: could not update positions"))
 				return
 			}
+			// record what everyone owns
+			err = folio.Record(sesh, prices, time.Now())
+			if err != nil {
+				log.Println(errors.Wrap(err, "failure to update chip: could not record valuations"))
+				return
+			}
+			// start or finish the competition round
+			err = award.Tick(app.Disc, sesh, prices, cfg.RoundLength(), time.Now())
+			if err != nil {
+				log.Println(errors.Wrap(err, "failure to update chip: could not update award round"))
+				return
+			}
 		})
 		crn.Start()
 		defer crn.Stop()